@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/diwise/cip-functions/internal/pkg/application"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
@@ -28,21 +33,78 @@ func main() {
 	var err error
 
 	msgCtx := createMessagingContextOrDie(ctx)
-	defer msgCtx.Close()
 
+	config := loadConfigurationOrDie(ctx)
+	authenticator := loadAuthenticatorOrDie(ctx)
 	storage := createDatabaseConnectionOrDie(ctx)
-	thingsClient := createThingsClientOrDie(ctx)
+	thingsClient := createThingsClientOrDie(ctx, config.Things)
 
-	_, err = initialize(ctx, msgCtx, thingsClient, storage)
+	app, err := initialize(ctx, msgCtx, thingsClient, storage, config)
 	if err != nil {
 		fatal(ctx, "initialization failed", err)
 	}
 
+	app.Start(ctx)
+
 	servicePort := env.GetVariableOrDefault(ctx, "SERVICE_PORT", "8080")
-	err = http.ListenAndServe(":"+servicePort, api.New())
+	server := &http.Server{
+		Addr: ":" + servicePort,
+		Handler: api.New(storage, app, authenticator,
+			api.HealthCheck{Name: "database", Check: storage.Ping},
+			api.HealthCheck{Name: "messaging", Check: app.Ready},
+			api.HealthCheck{Name: "things", Check: thingsClient.Health},
+		),
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(ctx, "failed to start request router", err)
+		}
+	}()
+
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	<-signalCtx.Done()
+
+	shutdown(ctx, app, msgCtx, server, storage, thingsClient)
+}
+
+// shutdown stops processing messages, waits for the messages in flight to be processed and publishes the
+// messages remaining in the outbox, before the messaging context, the http server, the database and the things
+// client are stopped. Messages received until the messaging context is closed are stored as dead letters and
+// are replayed on the next start.
+func shutdown(ctx context.Context, app application.App, msgCtx messaging.MsgContext, server *http.Server, storage *database.JsonDataStore, thingsClient *things.ClientImpl) {
+	log := logging.GetFromContext(ctx)
+
+	timeout, err := time.ParseDuration(env.GetVariableOrDefault(ctx, "SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		log.Warn("invalid SHUTDOWN_TIMEOUT, using default", "err", err.Error())
+		timeout = 30 * time.Second
+	}
+
+	log.Info("shutting down", slog.Duration("timeout", timeout))
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = app.Stop(shutdownCtx)
+	if err != nil {
+		log.Error("failed to stop application", "err", err.Error())
+	}
+
+	msgCtx.Close()
+
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		fatal(ctx, "failed to start request router", err)
+		log.Error("failed to shut down http server", "err", err.Error())
 	}
+
+	storage.Close()
+	thingsClient.Stop()
+
+	log.Info("shutdown complete")
 }
 
 func createMessagingContextOrDie(ctx context.Context) messaging.MsgContext {
@@ -60,7 +122,7 @@ func createMessagingContextOrDie(ctx context.Context) messaging.MsgContext {
 	return messenger
 }
 
-func createDatabaseConnectionOrDie(ctx context.Context) storage.Storage {
+func createDatabaseConnectionOrDie(ctx context.Context) *database.JsonDataStore {
 	storage, err := database.Connect(ctx, database.LoadConfiguration(ctx))
 	if err != nil {
 		fatal(ctx, "database connect failed", err)
@@ -72,13 +134,13 @@ func createDatabaseConnectionOrDie(ctx context.Context) storage.Storage {
 	return storage
 }
 
-func createThingsClientOrDie(ctx context.Context) *things.ClientImpl {
+func createThingsClientOrDie(ctx context.Context, config things.Config) *things.ClientImpl {
 	tokenUrl := env.GetVariableOrDie(ctx, "OAUTH2_TOKEN_URL", "")
 	clientId := env.GetVariableOrDie(ctx, "OAUTH2_CLIENT_ID", "")
 	secret := env.GetVariableOrDie(ctx, "OAUTH2_CLIENT_SECRET", "")
 	thingsUrl := env.GetVariableOrDefault(ctx, "THINGS_URL", "http://iot-things:8080")
 
-	c, err := things.NewClient(ctx, thingsUrl, tokenUrl, clientId, secret)
+	c, err := things.NewClient(ctx, thingsUrl, tokenUrl, clientId, secret, config)
 	if err != nil {
 		fatal(ctx, "failed to create things client", err)
 	}
@@ -86,8 +148,30 @@ func createThingsClientOrDie(ctx context.Context) *things.ClientImpl {
 	return c
 }
 
-func initialize(ctx context.Context, msgctx messaging.MsgContext, tc things.Client, storage storage.Storage) (application.App, error) {
-	app, err := application.New(msgctx, tc, storage)
+func loadConfigurationOrDie(ctx context.Context) application.Config {
+	configPath := env.GetVariableOrDefault(ctx, "CIP_FUNCTIONS_CONFIG_PATH", "")
+
+	config, err := application.LoadConfig(configPath)
+	if err != nil {
+		fatal(ctx, "failed to load configuration", err)
+	}
+
+	return config
+}
+
+func loadAuthenticatorOrDie(ctx context.Context) *api.Authenticator {
+	tokensPath := env.GetVariableOrDefault(ctx, "CIP_FUNCTIONS_API_TOKENS_PATH", "")
+
+	authenticator, err := api.LoadAuthenticator(tokensPath)
+	if err != nil {
+		fatal(ctx, "failed to load api tokens", err)
+	}
+
+	return authenticator
+}
+
+func initialize(ctx context.Context, msgctx messaging.MsgContext, tc things.Client, storage storage.Storage, config application.Config) (application.App, error) {
+	app, err := application.New(msgctx, tc, storage, config)
 	if err != nil {
 		fatal(ctx, "failed to initialize application", err)
 	}
@@ -0,0 +1,182 @@
+package alarms
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Threshold raises an alarm when a value has been at or above Limit for at least MinDuration. The alarm is
+// cleared when the value has been below Limit - Hysteresis for at least MinDuration. No alarm is raised if
+// Limit is not set.
+type Threshold struct {
+	Limit       *float64      `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Hysteresis  float64       `json:"hysteresis,omitempty" yaml:"hysteresis,omitempty"`
+	MinDuration time.Duration `json:"minDuration,omitempty" yaml:"minDuration,omitempty"`
+
+	above bool
+}
+
+// Merge returns t with the values that are set in o
+func (t Threshold) Merge(o Threshold) Threshold {
+	if o.Limit != nil {
+		t.Limit = o.Limit
+	}
+	if o.Hysteresis != 0 {
+		t.Hysteresis = o.Hysteresis
+	}
+	if o.MinDuration != 0 {
+		t.MinDuration = o.MinDuration
+	}
+	return t
+}
+
+// Above returns t that raises the alarm only when the value is above Limit, e.g. for counts that may not exceed Limit.
+// The alarm is then cleared when the value is at or below Limit - Hysteresis.
+func (t Threshold) Above() Threshold {
+	t.above = true
+	return t
+}
+
+// WithLimit returns t with Limit set to limit
+func (t Threshold) WithLimit(limit float64) Threshold {
+	t.Limit = &limit
+	return t
+}
+
+// Alarm is the state of an alarm for a single value of a cip function
+type Alarm struct {
+	Active       bool       `json:"active"`
+	Value        float64    `json:"value"`
+	Limit        float64    `json:"limit"`
+	Raised       *time.Time `json:"raised,omitempty"`
+	Cleared      *time.Time `json:"cleared,omitempty"`
+	PendingSince *time.Time `json:"pendingSince,omitempty"` // time when the value crossed the limit, or the clear level if active
+}
+
+// Evaluate updates the alarm with a value observed at ts and returns true if the alarm was raised or cleared.
+// Values observed before the alarm was pending are ignored. An active alarm is cleared if the limit is removed.
+func (a *Alarm) Evaluate(t Threshold, value float64, ts time.Time) bool {
+	a.Value = value
+
+	if t.Limit == nil {
+		a.PendingSince = nil
+		if a.Active {
+			a.Active = false
+			a.Cleared = &ts
+			return true
+		}
+		return false
+	}
+
+	a.Limit = *t.Limit
+
+	crossed := value >= *t.Limit
+	if t.above {
+		crossed = value > *t.Limit
+	}
+	if a.Active {
+		crossed = value < *t.Limit-t.Hysteresis
+		if t.above {
+			crossed = value <= *t.Limit-t.Hysteresis
+		}
+	}
+
+	if !crossed {
+		a.PendingSince = nil
+		return false
+	}
+
+	if a.PendingSince == nil {
+		a.PendingSince = &ts
+	}
+
+	if ts.Before(*a.PendingSince) || ts.Sub(*a.PendingSince) < t.MinDuration {
+		return false
+	}
+
+	a.PendingSince = nil
+	a.Active = !a.Active
+
+	if a.Active {
+		a.Raised = &ts
+		a.Cleared = nil
+	} else {
+		a.Cleared = &ts
+	}
+
+	return true
+}
+
+// Alarms holds the alarms of a cip function by name
+type Alarms map[string]Alarm
+
+// Evaluate evaluates the alarm name, like Alarm.Evaluate, and returns true if it was raised or cleared. An alarm
+// that does not exist is only created if the threshold has a limit. changed is true if the alarm changed in any way.
+func (as *Alarms) Evaluate(name string, t Threshold, value float64, ts time.Time) (transitioned, changed bool) {
+	a, ok := (*as)[name]
+	if !ok && t.Limit == nil {
+		return false, false
+	}
+
+	before := a
+	transitioned = a.Evaluate(t, value, ts)
+
+	if *as == nil {
+		*as = Alarms{}
+	}
+	(*as)[name] = a
+
+	return transitioned, !reflect.DeepEqual(before, a)
+}
+
+// Active returns true if any alarm is active
+func (as Alarms) Active() bool {
+	for _, a := range as {
+		if a.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is published on cip-function.alarm when an alarm is raised or cleared
+type Message struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Tenant    string    `json:"tenant"`
+	Alarm     string    `json:"alarm"`
+	Active    bool      `json:"active"`
+	Value     float64   `json:"value"`
+	Limit     float64   `json:"limit"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewMessage creates a message about the alarm name of the cip function id of type functionType
+func NewMessage(id, functionType, tenant, name string, a Alarm, ts time.Time) Message {
+	return Message{
+		ID:        id,
+		Type:      functionType,
+		Tenant:    tenant,
+		Alarm:     name,
+		Active:    a.Active,
+		Value:     a.Value,
+		Limit:     a.Limit,
+		Timestamp: ts,
+	}
+}
+
+func (m Message) TopicName() string {
+	return "cip-function.alarm"
+}
+
+func (m Message) ContentType() string {
+	return fmt.Sprintf("application/vnd.diwise.%s.alarm+json", strings.ToLower(m.Type))
+}
+
+func (m Message) Body() []byte {
+	b, _ := json.Marshal(m)
+	return b
+}
@@ -0,0 +1,130 @@
+package alarms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestAlarmIsRaisedAfterMinDuration(t *testing.T) {
+	is := is.New(t)
+
+	threshold := Threshold{MinDuration: 10 * time.Minute}.WithLimit(2.0)
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	a := Alarm{}
+
+	is.True(!a.Evaluate(threshold, 2.5, start))
+	is.True(!a.Active)
+	is.Equal(start, *a.PendingSince)
+
+	is.True(!a.Evaluate(threshold, 2.6, start.Add(5*time.Minute)))
+	is.True(!a.Active)
+
+	is.True(a.Evaluate(threshold, 2.7, start.Add(10*time.Minute)))
+	is.True(a.Active)
+	is.Equal(start.Add(10*time.Minute), *a.Raised)
+	is.Equal(nil, a.PendingSince)
+}
+
+func TestShortPeakDoesNotRaiseAlarm(t *testing.T) {
+	is := is.New(t)
+
+	threshold := Threshold{MinDuration: 10 * time.Minute}.WithLimit(2.0)
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	a := Alarm{}
+
+	is.True(!a.Evaluate(threshold, 2.5, start))
+	is.True(!a.Evaluate(threshold, 1.5, start.Add(5*time.Minute)))
+	is.Equal(nil, a.PendingSince)
+	is.True(!a.Evaluate(threshold, 2.5, start.Add(10*time.Minute)))
+	is.True(!a.Active)
+}
+
+func TestAlarmIsClearedBelowHysteresis(t *testing.T) {
+	is := is.New(t)
+
+	threshold := Threshold{Hysteresis: 0.5}.WithLimit(2.0)
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	a := Alarm{}
+
+	is.True(a.Evaluate(threshold, 2.0, start))
+	is.True(a.Active)
+
+	is.True(!a.Evaluate(threshold, 1.6, start.Add(time.Minute))) // below limit but within hysteresis
+	is.True(a.Active)
+
+	is.True(a.Evaluate(threshold, 1.4, start.Add(2*time.Minute)))
+	is.True(!a.Active)
+	is.Equal(start.Add(2*time.Minute), *a.Cleared)
+}
+
+func TestAlarmIsClearedWhenLimitIsRemoved(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	a := Alarm{}
+
+	is.True(a.Evaluate(Threshold{}.WithLimit(2.0), 3.0, start))
+	is.True(a.Evaluate(Threshold{}, 3.0, start.Add(time.Minute)))
+	is.True(!a.Active)
+}
+
+func TestAlarmsAreOnlyCreatedWithLimit(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	var as Alarms
+
+	transitioned, changed := as.Evaluate("high", Threshold{}, 3.0, start)
+	is.True(!transitioned)
+	is.True(!changed)
+	is.Equal(0, len(as))
+
+	transitioned, changed = as.Evaluate("high", Threshold{}.WithLimit(2.0), 3.0, start)
+	is.True(transitioned)
+	is.True(changed)
+	is.True(as.Active())
+
+	transitioned, changed = as.Evaluate("high", Threshold{}.WithLimit(2.0), 3.0, start.Add(time.Minute))
+	is.True(!transitioned)
+	is.True(!changed)
+}
+
+func TestMerge(t *testing.T) {
+	is := is.New(t)
+
+	merged := Threshold{Hysteresis: 0.5, MinDuration: time.Minute}.WithLimit(2.0).Merge(Threshold{}.WithLimit(1.0))
+
+	is.Equal(1.0, *merged.Limit)
+	is.Equal(0.5, merged.Hysteresis)
+	is.Equal(time.Minute, merged.MinDuration)
+}
+
+func TestMessage(t *testing.T) {
+	is := is.New(t)
+
+	m := NewMessage("sewer:1", "Sewer", "default", "highLevel", Alarm{Active: true, Value: 2.5, Limit: 2.0}, time.Now())
+
+	is.Equal("cip-function.alarm", m.TopicName())
+	is.Equal("application/vnd.diwise.sewer.alarm+json", m.ContentType())
+}
+
+func TestAboveRaisesAlarmOnlyAboveLimit(t *testing.T) {
+	is := is.New(t)
+
+	threshold := Threshold{}.WithLimit(3).Above()
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	a := Alarm{}
+	is.True(!a.Evaluate(threshold, 3, start))
+	is.True(a.Evaluate(threshold, 4, start.Add(time.Minute)))
+	is.True(a.Active)
+	is.True(a.Evaluate(threshold, 3, start.Add(2*time.Minute)))
+	is.True(!a.Active)
+}
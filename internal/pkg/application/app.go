@@ -10,14 +10,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/diwise/cip-functions/internal/pkg/application/combinedsewageoverflow"
-	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
-	"github.com/diwise/cip-functions/internal/pkg/application/sewer"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
-	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
 	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
 	"github.com/diwise/messaging-golang/pkg/messaging"
-	"github.com/diwise/senml"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
@@ -36,75 +31,115 @@ type App struct {
 	msgCtx       messaging.MsgContext
 	thingsClient things.Client
 	store        storage.Storage
+	registry     *Registry
+	queue        *KeyedQueue
+	outbox       *OutboxRelay
+	dedup        *deduplicator
+	validator    *stateValidator
+	lifecycle    *lifecycle
+	evaluators   map[string]evaluateFunc
+	evaluation   *Evaluation
 }
 
-func New(msgCtx messaging.MsgContext, tc things.Client, s storage.Storage) (App, error) {
+func New(msgCtx messaging.MsgContext, tc things.Client, s storage.Storage, cfg Config) (App, error) {
+	registry, err := NewRegistry(cfg)
+	if err != nil {
+		return App{}, err
+	}
+
+	err = cfg.Validation.validate()
+	if err != nil {
+		return App{}, err
+	}
+
 	app := App{
 		msgCtx:       msgCtx,
 		thingsClient: tc,
 		store:        s,
+		registry:     registry,
+		queue:        NewKeyedQueue(cfg.WorkQueue.MaxQueueSize),
+		outbox:       NewOutboxRelay(s, msgCtx, cfg.Outbox),
+		dedup:        newDeduplicator(s, cfg.Deduplication),
+		validator:    newStateValidator(s, cfg.Validation),
+		lifecycle:    &lifecycle{},
+		evaluators:   newEvaluateFuncs(cfg.Functions),
 	}
 
+	app.evaluation = newEvaluation(cfg.Evaluation, app.evaluateAlarms)
+
 	return app, app.registerMessageHandlers()
 }
 
-func (a App) registerMessageHandlers() error {
-	var err error
-	var errs []error
+// Start starts publishing the messages that are added to the outbox when the state of a cip function is changed,
+// and the periodic evaluation of alarms that depend on how much time has passed. Messages that were received while
+// the service was last shutting down are replayed in the background.
+func (a App) Start(ctx context.Context) {
+	a.outbox.Start(ctx)
+	a.evaluation.Start(ctx)
 
-	err = a.msgCtx.RegisterTopicMessageHandler("function.updated", newFunctionUpdatedHandler(a))
-	if err != nil {
-		errs = append(errs, err)
+	go a.replayShutdownDeadLetters(ctx)
+}
+
+// Stop stops the periodic evaluation of alarms and processing of incoming messages, and waits, until ctx is done, for
+// the messages that are being processed. The outbox relay is then stopped after the messages that remain in the outbox
+// have been published. Messages that are received after Stop has been called, until the messaging context is closed,
+// are stored as dead letters and are replayed by Start when the service is started again.
+func (a App) Stop(ctx context.Context) error {
+	evalErr := a.evaluation.Stop(ctx)
+	if evalErr != nil {
+		evalErr = fmt.Errorf("failed to wait for evaluation of alarms: %w", evalErr)
 	}
 
-	err = a.msgCtx.RegisterTopicMessageHandler("message.accepted", newMessageAcceptedHandler(a))
+	err := a.lifecycle.stop(ctx)
 	if err != nil {
-		errs = append(errs, err)
+		err = fmt.Errorf("failed to wait for messages in flight: %w", err)
 	}
 
-	return errors.Join(errs...)
+	return errors.Join(evalErr, err, a.outbox.Stop(ctx))
 }
 
-func newMessageAcceptedHandler(app App) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		var err error
-		var errs []error
-
-		ctx, span := tracer.Start(ctx, "message.accepted")
-		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
-		_, ctx, l = o11y.AddTraceIDToLoggerAndStoreInContext(span, l, ctx)
+// Ready returns ErrShuttingDown once Stop has been called, an error if a ping command could not be sent to
+// the message broker, or an error if the messages in the outbox could not be published the last time the
+// outbox was processed
+func (a App) Ready(ctx context.Context) error {
+	if a.lifecycle.isStopping() {
+		return ErrShuttingDown
+	}
 
-		l.Debug("incoming message", slog.String("body", string(itm.Body())), slog.String("topic_name", itm.TopicName()), slog.String("content_type", itm.ContentType()))
+	if err := a.msgCtx.NoteToSelf(ctx, messaging.NewPingCommand()); err != nil {
+		return fmt.Errorf("failed to send ping to message broker: %w", err)
+	}
 
-		ctx = logging.NewContextWithLogger(ctx, l, slog.String("uuid", uuid.NewString()))
+	if err := a.outbox.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages from outbox: %w", err)
+	}
 
-		if TemperatureMessageFilter(itm) {
-			err = handleMessageAcceptedMessage(ctx, app, itm, wastecontainer.WasteContainerFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
+	return nil
+}
 
-		if DistanceMessageFilter(itm) {
-			err = handleMessageAcceptedMessage(ctx, app, itm, sewer.SewerFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
+func (a App) registerMessageHandlers() error {
+	var errs []error
 
-		err = errors.Join(errs...)
+	for _, topic := range a.registry.Topics() {
+		err := a.msgCtx.RegisterTopicMessageHandler(topic, newTopicMessageHandler(a, topic))
 		if err != nil {
-			l.Error("could not handle message.accepted without errors", "err", err.Error())
+			errs = append(errs, err)
 		}
 	}
+
+	err := a.registerCacheInvalidation()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
-func newFunctionUpdatedHandler(app App) messaging.TopicMessageHandler {
+func newTopicMessageHandler(app App, topic string) messaging.TopicMessageHandler {
 	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
 		var err error
-		var errs []error
 
-		ctx, span := tracer.Start(ctx, "function.updated")
+		ctx, span := tracer.Start(ctx, topic)
 		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
 		_, ctx, l = o11y.AddTraceIDToLoggerAndStoreInContext(span, l, ctx)
 
@@ -112,110 +147,108 @@ func newFunctionUpdatedHandler(app App) messaging.TopicMessageHandler {
 
 		ctx = logging.NewContextWithLogger(ctx, l, slog.String("uuid", uuid.NewString()))
 
-		if LevelMessageFilter(itm) {
-			err = handleFunctionUpdatedMessage(ctx, app, itm, wastecontainer.WasteContainerFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
-			err = handleFunctionUpdatedMessage(ctx, app, itm, sewer.SewerFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
+		if !app.lifecycle.begin() {
+			err = ErrShuttingDown
+			app.storeDeadLetter(ctx, topic, itm, handlerFailure{err: err})
+			l.Warn("message received during shutdown was stored as dead letter", slog.String("topic_name", topic))
+			return
 		}
+		defer app.lifecycle.end()
 
-		if StopwatchMessageFilter(itm) {
-			err = handleFunctionUpdatedMessage(ctx, app, itm, combinedsewageoverflow.CombinedSewageOverflowFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
+		err = handleTopicMessage(ctx, app, topic, itm)
+		if err != nil {
+			l.Error(fmt.Sprintf("could not handle %s without errors", topic), "err", err.Error())
 		}
+	}
+}
 
-		if DigitalInputMessageFilter(itm) {
-			err = handleFunctionUpdatedMessage(ctx, app, itm, sewagepumpingstation.SewagePumpingStationFactory, l)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
+// handleTopicMessage passes the message to every handler that is configured for it. Messages that
+// fail in a handler, or that cannot be handled at all, are stored as dead letters.
+func handleTopicMessage(ctx context.Context, app App, topic string, itm messaging.IncomingTopicMessage) error {
+	var errs []error
 
-		err = errors.Join(errs...)
-		if err != nil {
-			l.Error("could not handle function.updated without errors", "err", err.Error())
-		}
+	for _, failure := range dispatchTopicMessage(ctx, app, topic, itm, "") {
+		app.storeDeadLetter(ctx, topic, itm, failure)
+		errs = append(errs, failure.err)
 	}
+
+	return errors.Join(errs...)
 }
 
-func handleMessageAcceptedMessage[T CipFunctionHandler](ctx context.Context, app App, itm messaging.IncomingTopicMessage, factoryFn func(id, tenant string) T, log *slog.Logger) error {
-	var err error
+// handlerFailure is an error returned from the handler of type handlerType, or from finding
+// the source of the message if handlerType is empty
+type handlerFailure struct {
+	handlerType string
+	err         error
+}
 
-	m := struct {
-		Pack      senml.Pack `json:"pack"`
-		Timestamp time.Time  `json:"timestamp"`
-	}{}
+// dispatchTopicMessage passes the message to the handlers that are configured for it, or only
+// to the handler of type handlerType if it is set, and returns the failures
+func dispatchTopicMessage(ctx context.Context, app App, topic string, itm messaging.IncomingTopicMessage, handlerType string) []handlerFailure {
+	log := logging.GetFromContext(ctx)
 
-	err = json.Unmarshal(itm.Body(), &m)
-	if err != nil {
-		log.Error("unmarshal error", "err", err.Error())
-		return err
+	source, ok := sources[topic]
+	if !ok {
+		return []handlerFailure{{err: fmt.Errorf("%w: %s", ErrUnsupportedTopic, topic)}}
 	}
 
-	r, ok := m.Pack.GetRecord(senml.FindByName("0"))
-	if !ok {
-		log.Error("package contains no deviceID")
-		return err
+	id, typeName, err := source(itm)
+	if err != nil {
+		log.Error("could not find source of message", "err", err.Error())
+		log.Debug("could not find source of message", "message", string(itm.Body()))
+		return []handlerFailure{{err: err}}
 	}
 
-	deviceID := strings.Split(r.Name, "/")[0]
-	if deviceID == "" {
-		b, _ := json.Marshal(m)
-		log.Error("deviceID is empty")
-		log.Debug("deviceID is empty", "message", string(b))
-		return err
+	handlerTypes := app.registry.Match(topic, itm.ContentType(), typeName)
+	if handlerType != "" {
+		handlerTypes = []string{strings.ToLower(handlerType)}
 	}
 
-	log = log.With(slog.String("device_id", deviceID))
-	ctx = logging.NewContextWithLogger(ctx, log)
+	if len(handlerTypes) == 0 {
+		log.Debug("no handlers configured for message", slog.String("content_type", itm.ContentType()), slog.String("type", typeName))
+		return nil
+	}
 
-	_, err = processIncomingTopicMessage(ctx, app, deviceID, "Device", itm, factoryFn) // all message.accepted are from a "Device"
-	if err != nil {
-		log.Error("failed to handle message", "err", err.Error())
-		return err
+	if strings.EqualFold(typeName, "Device") {
+		log = log.With(slog.String("device_id", id))
+	} else {
+		log = log.With(slog.String("function_id", id), slog.String("function_type", typeName))
 	}
+	ctx = logging.NewContextWithLogger(ctx, log)
 
-	return nil
-}
+	var failures []handlerFailure
 
-func handleFunctionUpdatedMessage[T CipFunctionHandler](ctx context.Context, app App, itm messaging.IncomingTopicMessage, factoryFn func(id, tenant string) T, log *slog.Logger) error {
-	var err error
+	for _, handlerType := range handlerTypes {
+		handle, ok := app.registry.handler(handlerType)
+		if !ok {
+			failures = append(failures, handlerFailure{handlerType, fmt.Errorf("%w: %s", ErrUnknownHandlerType, handlerType)})
+			continue
+		}
 
-	f := struct {
-		ID   string `json:"id"`
-		Type string `json:"type"`
-	}{}
+		messagesReceived.WithLabelValues(handlerType).Inc()
+		start := time.Now()
 
-	log.Debug("incoming function.updated message", slog.String("body", string(itm.Body())), slog.String("topic_name", itm.TopicName()), slog.String("content_type", itm.ContentType()))
+		_, err = handle(ctx, app, id, typeName, itm)
 
-	err = json.Unmarshal(itm.Body(), &f)
-	if err != nil {
-		log.Error("unmarshal error", "err", err.Error())
-		return err
-	}
+		messageProcessingDuration.WithLabelValues(handlerType).Observe(time.Since(start).Seconds())
 
-	if f.ID == "" {
-		log.Error("ID is empty")
-		log.Debug("ID is empty", "message", string(itm.Body()))
-		return err
-	}
+		if errors.Is(err, ErrNoRelatedThingFound) {
+			log.Debug("no related thing found for handler", slog.String("handler_type", handlerType))
+			messagesFiltered.WithLabelValues(handlerType).Inc()
+			continue
+		}
 
-	log = log.With(slog.String("function_id", f.ID), slog.String("function_type", f.Type))
-	ctx = logging.NewContextWithLogger(ctx, log)
+		if err != nil {
+			log.Error("failed to handle message", slog.String("handler_type", handlerType), "err", err.Error())
+			messagesFailed.WithLabelValues(handlerType).Inc()
+			failures = append(failures, handlerFailure{handlerType, err})
+			continue
+		}
 
-	_, err = processIncomingTopicMessage(ctx, app, f.ID, f.Type, itm, factoryFn)
-	if err != nil {
-		log.Error("failed to handle message", "err", err.Error())
-		return err
+		messagesProcessed.WithLabelValues(handlerType).Inc()
 	}
 
-	return nil
+	return failures
 }
 
 func processIncomingTopicMessage[T CipFunctionHandler](ctx context.Context, app App, id, type_ string, itm messaging.IncomingTopicMessage, fn func(id, t string) T) (bool, error) {
@@ -226,16 +259,55 @@ func processIncomingTopicMessage[T CipFunctionHandler](ctx context.Context, app
 	log = log.With(slog.String("thing_type", thingType))
 	ctx = logging.NewContextWithLogger(ctx, log)
 
-	theThing, err := app.getRelatedThings(ctx, id, type_, thingType) // type is a function or a device, ex: stopwatch for CombinedSewerOwerflow (thingType)
+	relatedThings, err := app.getRelatedThings(ctx, id, type_, thingType) // type is a function or a device, ex: stopwatch for CombinedSewerOwerflow (thingType)
 	if err != nil {
 		log.Error("could not find thing to process, no such related thing found on function/device", "err", err.Error())
 		return false, err
 	}
 
-	log = log.With(slog.String("thing_id", theThing.ID))
+	changed := false
+	notFound := 0
+	var errs []error
+
+	// each related thing is processed separately so that a failure for one thing does not stop the others from being updated.
+	// Messages for the same thing are processed one at a time to keep its state consistent, but not necessarily in the
+	// order they were received, so handlers check the timestamps of the observations, e.g. a CombinedSewageOverflow
+	// ignores the start of an overflow that has already ended.
+	for _, relatedThing := range relatedThings {
+		change := false
+		err := app.queue.Do(ctx, thingType+":"+relatedThing.ID, func(ctx context.Context) error {
+			var err error
+			change, err = processRelatedThing(ctx, app, relatedThing, itm, fn)
+			return err
+		})
+		if errors.Is(err, ErrNoRelatedThingFound) {
+			log.Debug("related thing not found", slog.String("thing_id", relatedThing.ID))
+			notFound++
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to process %s %s: %w", thingType, relatedThing.ID, err))
+			continue
+		}
+
+		changed = changed || change
+	}
+
+	// the message is only filtered if none of the related things exist, errors for other things must not be hidden
+	if notFound == len(relatedThings) {
+		return false, ErrNoRelatedThingFound
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+func processRelatedThing[T CipFunctionHandler](ctx context.Context, app App, relatedThing things.Thing, itm messaging.IncomingTopicMessage, fn func(id, t string) T) (bool, error) {
+	log := logging.GetFromContext(ctx)
+
+	log = log.With(slog.String("thing_id", relatedThing.ID))
 	ctx = logging.NewContextWithLogger(ctx, log)
 
-	theThing, err = app.findByID(ctx, theThing.ID, theThing.Type)
+	theThing, err := app.findByID(ctx, relatedThing.ID, relatedThing.Type)
 	if err != nil {
 		log.Error("could not fetch thing", "err", err.Error())
 		return false, err
@@ -251,41 +323,106 @@ func processIncomingTopicMessage[T CipFunctionHandler](ctx context.Context, app
 		log.Debug(fmt.Sprintf("thing: \"%s\"", string(b)))
 	}
 
-	state, err := storage.GetOrDefault(ctx, app.store, theThing.ID, fn(theThing.ID, tenant))
+	state, change, err := handleAndStore(ctx, app, theThing.ID, tenant, itm, func() T { return fn(theThing.ID, tenant) })
 	if err != nil {
-		log.Error("could not get or create current state", "err", err.Error())
 		return false, err
 	}
 
-	change, err := state.Handle(ctx, itm, app.thingsClient)
-	if err != nil {
-		log.Error("could not handle incomig message", "err", err.Error())
-		return false, err
-	}
-
-	log.Debug(fmt.Sprintf("processed incomming message %s, change is %t", itm.ContentType(), change))
-
 	if !change {
 		return false, nil
 	}
 
-	err = storage.CreateOrUpdate(ctx, app.store, theThing.ID, state)
-	if err != nil {
-		log.Error("could not store state", "err", err.Error())
-		return change, nil
-	}
+	// the outgoing message is stored in the outbox together with the state and is published by the outbox relay
+	app.outbox.Notify()
 
-	err = app.msgCtx.PublishOnTopic(ctx, state)
-	if err != nil {
-		log.Error("could not publish message", "err", err.Error())
-		return change, err
-	}
+	recordChange(storage.GetTypeName[T](), tenant, time.Now())
 
 	log.Debug("handled incoming message", slog.String("in", itm.ContentType()), slog.String("out", state.ContentType()))
 
 	return change, nil
 }
 
+// maxStoreAttempts is the number of times a message is handled if the state is concurrently changed by someone else
+const maxStoreAttempts int = 3
+
+// handleAndStore applies the incoming message to the current state of a thing and stores the result, together with
+// the message that should be published about the change. If the stored state is changed by someone else before the
+// result could be stored, the message is handled again using the fresh state. Events, such as overflows, and the
+// message being marked as processed for the thing are stored in the same transaction. Messages that have already been
+// processed for the thing are not handled again. A changed state is validated before it is stored, and is not
+// stored if the validation policy of the thing type rejects or quarantines it. A state that only recorded an
+// observation, e.g. in the percent history of a waste container, is stored without publishing any messages.
+func handleAndStore[T CipFunctionHandler](ctx context.Context, app App, id, tenant string, itm messaging.IncomingTopicMessage, newState func() T) (T, bool, error) {
+	log := logging.GetFromContext(ctx)
+
+	thingType := storage.GetTypeName[T]()
+
+	if app.dedup.isDuplicate(ctx, itm, id, thingType) {
+		log.Debug("message has already been processed, will not be handled again")
+		return newState(), false, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		state, version, err := storage.Load(ctx, app.store, id, newState())
+		if err != nil {
+			log.Error("could not get or create current state", "err", err.Error())
+			return state, false, err
+		}
+
+		change, err := state.Handle(ctx, itm, app.thingsClient)
+		if err != nil {
+			log.Error("could not handle incomig message", "err", err.Error())
+			return state, false, err
+		}
+
+		log.Debug(fmt.Sprintf("processed incomming message %s, change is %t", itm.ContentType(), change))
+
+		recorded := false
+		if r, ok := any(state).(observationRecorder); ok {
+			recorded = r.RecordedObservation()
+		}
+
+		if !change && !recorded {
+			return state, false, nil
+		}
+
+		accepted, err := app.validator.validate(ctx, state, itm, id, thingType, tenant)
+		if err != nil {
+			log.Error("could not validate state", "err", err.Error())
+			return state, false, err
+		}
+
+		if !accepted {
+			app.dedup.processed(ctx, itm, id, thingType)
+			return state, false, nil
+		}
+
+		var messages []storage.OutboxMessage
+		if change {
+			messages = outboxMessages(state)
+		}
+
+		// the message is marked as processed in the same transaction, so that it is handled again if storing fails
+		events := historyEvents(state)
+		events.Processed = app.dedup.processedMessages(itm, id, thingType)
+
+		_, err = storage.SaveWithOutbox(ctx, app.store, id, state, version, messages, events)
+		if errors.Is(err, storage.ErrConcurrencyConflict) && attempt < maxStoreAttempts {
+			log.Debug("state was changed concurrently, will handle message again", slog.Int("attempt", attempt))
+			continue
+		}
+
+		if err != nil {
+			log.Error("could not store state", "err", err.Error())
+			return state, change, err
+		}
+
+		app.dedup.purgeExpired(ctx)
+
+		return state, change, nil
+	}
+}
+
 var ErrNoRelatedThingFound = fmt.Errorf("no related thing found")
 
 func (a App) findByID(ctx context.Context, id, thingType string) (things.Thing, error) {
@@ -306,37 +443,42 @@ func (a App) findByID(ctx context.Context, id, thingType string) (things.Thing,
 	return t, nil
 }
 
-// id - function/device id 
+// id - function/device id
 // typeName - function type (stopwatch, level ...) or "Device"
 // relatedType - type of related thing, i.e. CombinedSewerOverflow, Sewer, WasteContainer ...
-func (a App) getRelatedThings(ctx context.Context, id, typeName, relatedType string) (things.Thing, error) {
+func (a App) getRelatedThings(ctx context.Context, id, typeName, relatedType string) ([]things.Thing, error) {
 	log := logging.GetFromContext(ctx)
 
-	log.Debug("get related thing", slog.String("id", id), slog.String("type", typeName), slog.String("related_type", relatedType))
+	log.Debug("get related things", slog.String("id", id), slog.String("type", typeName), slog.String("related_type", relatedType))
 
 	// fetch "function"/device and returns .Included
 	ts, err := a.thingsClient.FindRelatedThings(ctx, id, typeName)
 	if err != nil {
 		if errors.Is(err, things.ErrThingNotFound) {
-			return things.Thing{}, ErrNoRelatedThingFound
+			return nil, ErrNoRelatedThingFound
 		}
 
 		log.Error(fmt.Sprintf("failed to get related things - %s", err.Error()))
-		return things.Thing{}, err
+		return nil, err
 	}
 
-	if len(ts) == 0 {
-		return things.Thing{}, ErrNoRelatedThingFound
-	}
+	// gets all things of correct type, a function or device may be related to more than one thing.
+	relatedThings := []things.Thing{}
+	for _, t := range ts {
+		if !strings.EqualFold(t.Type, relatedType) {
+			continue
+		}
+
+		if slices.ContainsFunc(relatedThings, func(r things.Thing) bool { return r.ID == t.ID }) {
+			continue
+		}
 
-	// gets the first thing of correct type.
-	idx := slices.IndexFunc(ts, func(t things.Thing) bool {
-		return strings.EqualFold(t.Type, relatedType)
-	})
+		relatedThings = append(relatedThings, t)
+	}
 
-	if idx == -1 {
-		return things.Thing{}, ErrNoRelatedThingFound
+	if len(relatedThings) == 0 {
+		return nil, ErrNoRelatedThingFound
 	}
 
-	return ts[idx], nil
+	return relatedThings, nil
 }
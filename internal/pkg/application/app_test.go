@@ -3,25 +3,33 @@ package application
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
 	"github.com/diwise/cip-functions/internal/pkg/application/combinedsewageoverflow"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
 	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
 	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
 	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage/database"
 	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type functionUpdated struct {
 	ID        string    `json:"id"`
 	Type      string    `json:"type"`
 	SubType   string    `json:"subtype"`
+	Tenant    string    `json:"tenant,omitempty"`
 	Level     level     `json:"level,omitempty"`
 	Stopwatch stopwatch `json:"stopwatch,omitempty"`
 }
@@ -67,26 +75,543 @@ func TestGenericHandler(t *testing.T) {
 		},
 	}
 
-	app, _ := New(msgCtx, tc, s)
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
 
-	handleFunctionUpdatedMessage(ctx, app, itm, func(id, tenant string) *wastecontainer.WasteContainer {
-		return &wastecontainer.WasteContainer{
-			ID:     id,
-			Type:   "WasteContainer",
-			Tenant: tenant,
+	ctx = logging.NewContextWithLogger(ctx, log)
+	handleTopicMessage(ctx, app, "function.updated", itm)
+
+	is.Equal(60.0, *memStore["WasteContainer:72fb1b1c-d574-4946-befe-0ad1ba57bcf4"].(*wastecontainer.WasteContainer).Percent)
+}
+
+func TestMessageIsHandledByAllRelatedThings(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		return []things.Thing{
+			{ID: "wastecontainer:1", Type: "WasteContainer"},
+			{ID: "sewer:1", Type: "Sewer"},
+			{ID: "wastecontainer:2", Type: "WasteContainer"},
+			{ID: "wastecontainer:3", Type: "WasteContainer"},
+		}, nil
+	}
+
+	tc.FindByIDFunc = func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		if id == "wastecontainer:2" {
+			return things.Thing{}, fmt.Errorf("iot-things is unavailable")
 		}
-	}, log)
+		return things.Thing{ID: id, Type: thingType, Tenant: "default"}, nil
+	}
+
+	var percent float64 = 42
+	itm := functionUpdated{
+		ID:      "25e185f6-bdba-4c68-b6e8-23ae2bb10254",
+		Type:    "level",
+		SubType: "overflow",
+		Level: level{
+			Percent: &percent,
+		},
+	}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	changed, err := processIncomingTopicMessage(ctx, app, itm.ID, itm.Type, itm, wastecontainer.WasteContainerFactory)
+	is.True(changed)
+	is.True(err != nil) // wastecontainer:2 should fail without stopping the others
+
+	is.Equal(42.0, *memStore["WasteContainer:wastecontainer:1"].(*wastecontainer.WasteContainer).Percent)
+	is.Equal(42.0, *memStore["WasteContainer:wastecontainer:3"].(*wastecontainer.WasteContainer).Percent)
+	is.Equal(2, len(s.UpsertWithOutboxCalls()))
+	is.Equal(2, len(memStore["Outbox"].([]storage.OutboxMessage)))
+}
+
+func TestMissingRelatedThingDoesNotHideErrorsForOtherThings(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		return []things.Thing{
+			{ID: "wastecontainer:1", Type: "WasteContainer"},
+			{ID: "wastecontainer:2", Type: "WasteContainer"},
+		}, nil
+	}
+
+	tc.FindByIDFunc = func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		if id == "wastecontainer:1" {
+			return things.Thing{}, things.ErrThingNotFound
+		}
+		return things.Thing{}, fmt.Errorf("iot-things is unavailable")
+	}
+
+	var percent float64 = 42
+	itm := functionUpdated{ID: "level:1", Type: "level", SubType: "overflow", Level: level{Percent: &percent}}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	_, err := processIncomingTopicMessage(ctx, app, itm.ID, itm.Type, itm, wastecontainer.WasteContainerFactory)
+	is.True(err != nil)
+	is.True(!errors.Is(err, ErrNoRelatedThingFound)) // the failure for wastecontainer:2 must not be filtered
+
+	tc.FindByIDFunc = func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		return things.Thing{}, things.ErrThingNotFound
+	}
+
+	_, err = processIncomingTopicMessage(ctx, app, itm.ID, itm.Type, itm, wastecontainer.WasteContainerFactory)
+	is.True(errors.Is(err, ErrNoRelatedThingFound))
+}
+
+func TestSewagePumpingStationAlarmsAreEvaluatedPeriodically(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		return []things.Thing{{ID: "sps:1", Type: "SewagePumpingStation"}}, nil
+	}
+	tc.FindByIDFunc = func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		return things.Thing{ID: id, Type: thingType, Tenant: "default"}, nil
+	}
+	s.ReadAllFunc = func(ctx context.Context, typeName string, params storage.QueryParams) (storage.QueryResult, error) {
+		b, _ := json.Marshal(memStore[typeName+":sps:1"])
+		var data map[string]any
+		json.Unmarshal(b, &data)
+		return storage.QueryResult{Data: []any{data}, TotalRecords: 1, Limit: params.Limit}, nil
+	}
+
+	cfg := DefaultConfig()
+	cfg.Functions.SewagePumpingStation.Alarms.RunningTime = alarms.Threshold{}.WithLimit(30)
+
+	app, err := New(msgCtx, tc, s, cfg)
+	is.NoErr(err)
+
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+	itm := newTestMessage("application/vnd.diwise.digitalinput+json", `{"id":"di:1","type":"digitalinput","digitalinput":{"state":true,"timestamp":"2024-08-08T12:00:00Z"}}`)
+
+	_, err = processIncomingTopicMessage(ctx, app, "di:1", "digitalinput", itm, sewagepumpingstation.NewSewagePumpingStationFactory(cfg.Functions.SewagePumpingStation))
+	is.NoErr(err)
+	is.Equal(1, len(memStore["Outbox"].([]storage.OutboxMessage)))
+
+	// the pump keeps running without any more messages
+	app.evaluateAlarms(ctx, start.Add(10*time.Minute))
+	is.Equal(1, len(memStore["Outbox"].([]storage.OutboxMessage)))
 
+	app.evaluateAlarms(ctx, start.Add(40*time.Minute))
+
+	outbox := memStore["Outbox"].([]storage.OutboxMessage)
+	is.Equal(3, len(outbox))
+	is.Equal("cip-function.updated", outbox[1].Topic)
+	is.Equal("cip-function.alarm", outbox[2].Topic)
+	is.True(strings.Contains(string(outbox[2].Body), `"alarm":"longRunning"`))
+}
+
+func TestOverflowsAreStoredSeparately(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		return []things.Thing{{ID: "cso:1", Type: "CombinedSewageOverflow"}}, nil
+	}
+	tc.FindByIDFunc = func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		return things.Thing{ID: id, Type: thingType, Tenant: "default"}, nil
+	}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	itm := newTestMessage("application/vnd.diwise.stopwatch.overflow+json", function_updated_stopwatch[2])
+	_, err := processIncomingTopicMessage(ctx, app, "xyz123", "stopwatch", itm, combinedsewageoverflow.CombinedSewageOverflowFactory)
+	is.NoErr(err)
+
+	// the overflow is stored in the same transaction as the state
+	is.Equal(1, len(s.UpsertWithOutboxCalls()))
+	overflows := s.UpsertWithOutboxCalls()[0].Events.Overflows
+	is.Equal(1, len(overflows))
+	overflow := overflows[0]
+	is.Equal("cso:1", overflow.CombinedSewageOverflowID)
+	is.Equal("default", overflow.Tenant)
+	is.True(overflow.State)
+}
+
+func TestMessageIsHandledAgainOnConcurrencyConflict(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	upsert := s.UpsertWithOutboxFunc
+	s.UpsertWithOutboxFunc = func(ctx context.Context, id, typeName string, value any, version int64, messages []storage.OutboxMessage, events storage.Events) (int64, error) {
+		if len(s.UpsertWithOutboxCalls()) == 1 {
+			return 0, storage.ErrConcurrencyConflict
+		}
+		return upsert(ctx, id, typeName, value, version, messages, events)
+	}
+
+	var percent float64 = 60
+	itm := functionUpdated{
+		ID:      "25e185f6-bdba-4c68-b6e8-23ae2bb10254",
+		Type:    "level",
+		SubType: "overflow",
+		Level: level{
+			Percent: &percent,
+		},
+	}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	changed, err := processIncomingTopicMessage(ctx, app, itm.ID, itm.Type, itm, wastecontainer.WasteContainerFactory)
+	is.NoErr(err)
+	is.True(changed)
+
+	is.Equal(2, len(s.ReadWithVersionCalls()))
+	is.Equal(2, len(s.UpsertWithOutboxCalls()))
+	is.Equal(1, len(memStore["Outbox"].([]storage.OutboxMessage)))
+}
+
+func TestFailedMessageIsStoredAsDeadLetterAndCanBeReplayed(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	findRelatedThings := tc.FindRelatedThingsFunc
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		return nil, things.ErrCircuitOpen
+	}
+
+	var percent float64 = 60
+	itm := functionUpdated{
+		ID:      "25e185f6-bdba-4c68-b6e8-23ae2bb10254",
+		Type:    "level",
+		SubType: "overflow",
+		Tenant:  "default",
+		Level: level{
+			Percent: &percent,
+		},
+	}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	err := handleTopicMessage(ctx, app, "function.updated", itm)
+	is.True(errors.Is(err, things.ErrCircuitOpen))
+
+	is.Equal(2, len(s.StoreDeadLetterCalls())) // one per handler, WasteContainer and Sewer
+	dl := s.StoreDeadLetterCalls()[0].DeadLetter
+	is.Equal("function.updated", dl.Topic)
+	is.Equal("wastecontainer", dl.HandlerType)
+	is.Equal("default", dl.Tenant)
+	is.Equal(string(itm.Body()), string(dl.Body))
+
+	err = app.ReplayDeadLetter(ctx, dl.ID)
+	is.True(errors.Is(err, ErrReplayFailed))
+	is.Equal(2, memStore["DeadLetter:"+dl.ID].(storage.DeadLetter).Attempts)
+
+	tc.FindRelatedThingsFunc = findRelatedThings
+
+	err = app.ReplayDeadLetter(ctx, dl.ID)
+	is.NoErr(err)
+
+	_, ok := memStore["DeadLetter:"+dl.ID]
+	is.True(!ok)
 	is.Equal(60.0, *memStore["WasteContainer:72fb1b1c-d574-4946-befe-0ad1ba57bcf4"].(*wastecontainer.WasteContainer).Percent)
 }
 
+func TestDeadLettersReceivedDuringShutdownAreReplayedOnStart(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	var percent float64 = 60
+	itm := functionUpdated{ID: "25e185f6-bdba-4c68-b6e8-23ae2bb10254", Type: "level", SubType: "overflow", Level: level{Percent: &percent}}
+
+	memStore["DeadLetter:dl:1"] = storage.DeadLetter{ID: "dl:1", Topic: "function.updated", ContentType: itm.ContentType(), Body: itm.Body(), Error: ErrShuttingDown.Error(), Attempts: 1}
+
+	s.QueryDeadLettersFunc = func(ctx context.Context, params storage.DeadLetterQuery) ([]storage.DeadLetter, int64, error) {
+		deadLetters := []storage.DeadLetter{}
+		for k, v := range memStore {
+			if dl, ok := v.(storage.DeadLetter); ok && strings.HasPrefix(k, "DeadLetter:") && dl.Error == params.Error {
+				deadLetters = append(deadLetters, dl)
+			}
+		}
+		return deadLetters, int64(len(deadLetters)), nil
+	}
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+	app.replayShutdownDeadLetters(ctx)
+
+	is.Equal(ErrShuttingDown.Error(), s.QueryDeadLettersCalls()[0].Params.Error)
+	_, ok := memStore["DeadLetter:dl:1"]
+	is.True(!ok)
+	is.Equal(60.0, *memStore["WasteContainer:72fb1b1c-d574-4946-befe-0ad1ba57bcf4"].(*wastecontainer.WasteContainer).Percent)
+}
+
+func TestDuplicateMessageIsNotHandledAgain(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	itm := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:1","type":"level","subtype":"overflow","level":{"percent":40},"timestamp":"2024-08-08T11:21:25Z"}`)
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	changed, err := processIncomingTopicMessage(ctx, app, "level:1", "level", itm, wastecontainer.WasteContainerFactory)
+	is.NoErr(err)
+	is.True(changed)
+
+	changed, err = processIncomingTopicMessage(ctx, app, "level:1", "level", itm, wastecontainer.WasteContainerFactory)
+	is.NoErr(err)
+	is.True(!changed)
+
+	is.Equal(1, len(s.UpsertWithOutboxCalls()))
+	is.Equal(1, len(memStore["Outbox"].([]storage.OutboxMessage)))
+
+	// the message is marked as processed in the same transaction as the state
+	processed := s.UpsertWithOutboxCalls()[0].Events.Processed
+	is.Equal(1, len(processed))
+	is.Equal("72fb1b1c-d574-4946-befe-0ad1ba57bcf4", processed[0].ThingID) // the related waste container
+	is.Equal(0, len(s.MarkMessageProcessedCalls()))
+}
+
+func TestMetricsAreRecordedPerHandlerType(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	itm := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:2","type":"level","subtype":"overflow","level":{"percent":40},"timestamp":"2024-08-08T11:21:25Z"}`)
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	counters := map[string]prometheus.Counter{
+		"wastecontainer received":  messagesReceived.WithLabelValues("wastecontainer"),
+		"wastecontainer processed": messagesProcessed.WithLabelValues("wastecontainer"),
+		"wastecontainer changed":   functionsChanged.WithLabelValues("wastecontainer", "tenant"),
+		"sewer received":           messagesReceived.WithLabelValues("sewer"),
+		"sewer filtered":           messagesFiltered.WithLabelValues("sewer"),
+	}
+
+	before := map[string]float64{}
+	for name, c := range counters {
+		before[name] = testutil.ToFloat64(c)
+	}
+
+	err := handleTopicMessage(ctx, app, "function.updated", itm)
+	is.NoErr(err)
+
+	for name, c := range counters {
+		is.Equal(before[name]+1, testutil.ToFloat64(c)) // each counter should be incremented once
+	}
+
+	is.Equal(0, len(s.StoreDeadLetterCalls())) // a message without a related sewer is not a failure
+	is.True(testutil.ToFloat64(functionsLastChanged.WithLabelValues("wastecontainer", "tenant")) > 0)
+}
+
+func TestEmptyingIsStoredAndPublished(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	full := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:3","type":"level","subtype":"overflow","level":{"current":0.9,"percent":90},"timestamp":"2024-08-08T11:00:00Z"}`)
+	empty := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:3","type":"level","subtype":"overflow","level":{"current":0.05,"percent":5},"timestamp":"2024-08-08T12:00:00Z"}`)
+
+	_, err := processIncomingTopicMessage(ctx, app, "level:3", "level", full, wastecontainer.WasteContainerFactory)
+	is.NoErr(err)
+	_, err = processIncomingTopicMessage(ctx, app, "level:3", "level", empty, wastecontainer.WasteContainerFactory)
+	is.NoErr(err)
+
+	calls := s.UpsertWithOutboxCalls()
+	is.Equal(2, len(calls))
+	is.Equal(0, len(calls[0].Events.Emptyings))
+	is.Equal(1, len(calls[1].Events.Emptyings))
+	emptying := calls[1].Events.Emptyings[0]
+	is.Equal(90.0, emptying.PercentBefore)
+	is.Equal(5.0, emptying.PercentAfter)
+
+	outbox := memStore["Outbox"].([]storage.OutboxMessage)
+	is.Equal(3, len(outbox)) // two updates and one emptying
+	is.Equal("cip-function.emptied", outbox[2].Topic)
+}
+
+func TestRecordedObservationIsStoredWithoutPublishing(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
+
+	for _, ts := range []string{"2024-08-08T11:00:00Z", "2024-08-08T12:00:00Z", "2024-08-08T13:00:00Z"} {
+		msg := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:3","type":"level","subtype":"overflow","level":{"current":0.2,"percent":20},"timestamp":"`+ts+`"}`)
+		_, err := processIncomingTopicMessage(ctx, app, "level:3", "level", msg, wastecontainer.WasteContainerFactory)
+		is.NoErr(err)
+	}
+
+	calls := s.UpsertWithOutboxCalls()
+	is.Equal(3, len(calls))
+	is.Equal(0, len(calls[2].Messages)) // the fill rate is unchanged, so nothing is published
+
+	wc := calls[2].Value.(*wastecontainer.WasteContainer)
+	is.Equal(3, len(wc.PercentHistory))
+}
+
+func TestInvalidValuesAreHandledByValidationPolicy(t *testing.T) {
+	invalid := newTestMessage("application/vnd.diwise.level.overflow+json", `{"id":"level:4","type":"level","subtype":"overflow","level":{"current":1.2,"percent":120},"timestamp":"2024-08-08T11:00:00Z"}`)
+
+	for policy, expected := range map[ValidationPolicy]struct {
+		stored      bool
+		quarantined int
+	}{
+		ValidationPolicyWarn:       {stored: true},
+		ValidationPolicyReject:     {stored: false},
+		ValidationPolicyClamp:      {stored: true},
+		ValidationPolicyQuarantine: {stored: false, quarantined: 1},
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			memStore := make(map[string]any)
+			is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+			s.StoreQuarantinedFunc = func(ctx context.Context, reading storage.QuarantinedReading) error {
+				return nil
+			}
+
+			cfg := DefaultConfig()
+			cfg.Validation = ValidationConfig{"wasteContainer": policy}
+
+			app, err := New(msgCtx, tc, s, cfg)
+			is.NoErr(err)
+
+			changed, err := processIncomingTopicMessage(ctx, app, "level:4", "level", invalid, wastecontainer.WasteContainerFactory)
+			is.NoErr(err)
+			is.Equal(expected.stored, changed)
+
+			is.Equal(expected.quarantined, len(s.StoreQuarantinedCalls()))
+			if expected.quarantined > 0 {
+				reading := s.StoreQuarantinedCalls()[0].Reading
+				is.Equal("WasteContainer", reading.ThingType)
+				is.Equal("tenant", reading.Tenant)
+				is.Equal(invalid.Body(), reading.Body)
+				is.True(strings.Contains(reading.Reason, "percent is invalid"))
+			}
+
+			wc, ok := memStore["WasteContainer:72fb1b1c-d574-4946-befe-0ad1ba57bcf4"].(*wastecontainer.WasteContainer)
+			is.Equal(expected.stored, ok)
+
+			if policy == ValidationPolicyClamp {
+				is.Equal(100.0, *wc.Percent)
+			}
+		})
+	}
+}
+
+func TestUnknownValidationPolicyIsAnError(t *testing.T) {
+	is, msgCtx, tc, s, _, _ := setup(t, make(map[string]any))
+
+	cfg := DefaultConfig()
+	cfg.Validation = ValidationConfig{"wasteContainer": "ignore"}
+
+	_, err := New(msgCtx, tc, s, cfg)
+	is.True(errors.Is(err, ErrUnknownValidationPolicy))
+}
+
+func TestNotReadyIfMessageBrokerIsUnavailable(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, _ := setup(t, memStore)
+
+	app, err := New(msgCtx, tc, s, DefaultConfig())
+	is.NoErr(err)
+	is.NoErr(app.Ready(ctx))
+
+	msgCtx.NoteToSelfFunc = func(ctx context.Context, command messaging.Command) error {
+		return errors.New("channel/connection is not open")
+	}
+
+	err = app.Ready(ctx)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "channel/connection is not open"))
+}
+
+func TestStopWaitsForMessagesInFlight(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, log := setup(t, memStore)
+
+	handlers := map[string]messaging.TopicMessageHandler{}
+	msgCtx.RegisterTopicMessageHandlerFunc = func(routingKey string, handler messaging.TopicMessageHandler) error {
+		handlers[routingKey] = handler
+		return nil
+	}
+	s.ProcessOutboxFunc = func(ctx context.Context, limit, maxAttempts int, deliver func(ctx context.Context, message storage.OutboxMessage) error) (int, error) {
+		return 0, nil
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	tc.FindRelatedThingsFunc = func(ctx context.Context, id, thingType string) ([]things.Thing, error) {
+		close(started)
+		<-release
+		return nil, things.ErrThingNotFound
+	}
+
+	app, err := New(msgCtx, tc, s, DefaultConfig())
+	is.NoErr(err)
+
+	itm := newTestMessage("application/vnd.diwise.stopwatch.overflow+json", function_updated_stopwatch[2])
+
+	handled := make(chan struct{})
+	go func() {
+		handlers["function.updated"](ctx, itm, log)
+		close(handled)
+	}()
+	<-started
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- app.Stop(ctx)
+	}()
+
+	// wait until Stop has been called, messages received after that are stored as dead letters
+	for app.Ready(ctx) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	handlers["function.updated"](ctx, itm, log)
+	is.Equal(1, len(s.StoreDeadLetterCalls()))
+	is.Equal(ErrShuttingDown.Error(), s.StoreDeadLetterCalls()[0].DeadLetter.Error)
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the message in flight was processed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-handled
+	is.NoErr(<-stopped)
+}
+
+func TestChangedThingIsRemovedFromCache(t *testing.T) {
+	memStore := make(map[string]any)
+	is, msgCtx, tc, s, ctx, log := setup(t, memStore)
+
+	handlers := map[string]messaging.TopicMessageHandler{}
+	msgCtx.RegisterTopicMessageHandlerFunc = func(routingKey string, handler messaging.TopicMessageHandler) error {
+		handlers[routingKey] = handler
+		return nil
+	}
+	tc.InvalidateFunc = func(id, thingType string) int {
+		return 1
+	}
+
+	_, err := New(msgCtx, tc, s, DefaultConfig())
+	is.NoErr(err)
+
+	handlers["thing.updated"](ctx, &messaging.IncomingTopicMessageMock{
+		BodyFunc: func() []byte { return []byte(`{"id":"sewer:1","type":"Sewer","tenant":"default"}`) },
+	}, log)
+	handlers["thing.deleted"](ctx, &messaging.IncomingTopicMessageMock{
+		BodyFunc: func() []byte { return []byte(`{"thing":{"id":"sewer:2","type":"Sewer"}}`) },
+	}, log)
+
+	is.Equal(2, len(tc.InvalidateCalls()))
+	is.Equal("sewer:1", tc.InvalidateCalls()[0].ID)
+	is.Equal("Sewer", tc.InvalidateCalls()[0].ThingType)
+	is.Equal("sewer:2", tc.InvalidateCalls()[1].ID)
+}
+
 func TestCombinedSewageOverflowIntegrationTest(t *testing.T) {
 	is, msgCtx, tc, s, ctx, ok := setupIntegrationTest(t)
 	if !ok {
 		t.Skip()
 	}
 
-	app, _ := New(msgCtx, tc, s)
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
 
 	startTime := time.Now()
 
@@ -135,7 +660,7 @@ func TestCombinedSewageOverflow(t *testing.T) {
 	if !ok {
 		t.Skip()
 	}
-	app, _ := New(msgCtx, tc, s)
+	app, _ := New(msgCtx, tc, s, DefaultConfig())
 	for _, m := range function_updated_stopwatch {
 		itm := newTestMessage("application/vnd.diwise.stopwatch.overflow+json", m)
 		_, err := processIncomingTopicMessage(ctx, app, "xyz123", "stopwatch", itm, combinedsewageoverflow.CombinedSewageOverflowFactory)
@@ -177,6 +702,9 @@ func setupIntegrationTest(t *testing.T) (*is.I, *messaging.MsgContextMock, *thin
 	msgCtx.RegisterTopicMessageHandlerFunc = func(routingKey string, handler messaging.TopicMessageHandler) error {
 		return nil
 	}
+	msgCtx.NoteToSelfFunc = func(ctx context.Context, command messaging.Command) error {
+		return nil
+	}
 
 	cfg := database.NewConfig("localhost", "postgres", "postgres", "5432", "postgres", "disable")
 	db, err := database.Connect(ctx, cfg)
@@ -199,23 +727,58 @@ func setup(t *testing.T, store map[string]any) (*is.I, *messaging.MsgContextMock
 	s := &storage.StorageMock{}
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	s.ReadFunc = func(ctx context.Context, id, typeName string) (any, error) {
+	versions := make(map[string]int64)
+
+	s.ReadWithVersionFunc = func(ctx context.Context, id, typeName string) (any, int64, error) {
 		fullID := fmt.Sprintf("%s:%s", typeName, id)
 		if a, ok := store[fullID]; ok {
-			return a, nil
+			return a, versions[fullID], nil
 		}
-		return nil, fmt.Errorf("not found")
+		return nil, 0, storage.ErrNotFound
 	}
 
-	s.ExistsFunc = func(ctx context.Context, id, typeName string) bool {
+	s.UpsertWithOutboxFunc = func(ctx context.Context, id, typeName string, value any, version int64, messages []storage.OutboxMessage, events storage.Events) (int64, error) {
 		fullID := fmt.Sprintf("%s:%s", typeName, id)
-		_, ok := store[fullID]
-		return ok
+		if version != storage.AnyVersion && version != versions[fullID] {
+			return 0, storage.ErrConcurrencyConflict
+		}
+		store[fullID] = value
+		versions[fullID]++
+
+		outbox, _ := store["Outbox"].([]storage.OutboxMessage)
+		store["Outbox"] = append(outbox, messages...)
+
+		for _, p := range events.Processed {
+			store[fmt.Sprintf("Processed:%s:%s:%s", p.Hash, p.ThingType, p.ThingID)] = p.Expires
+		}
+
+		return versions[fullID], nil
 	}
 
-	s.CreateFunc = func(ctx context.Context, id, tn string, value any) error {
-		fullID := fmt.Sprintf("%s:%s", tn, id)
-		store[fullID] = value
+	s.IsMessageProcessedFunc = func(ctx context.Context, hash, thingID, thingType string) (bool, error) {
+		_, ok := store[fmt.Sprintf("Processed:%s:%s:%s", hash, thingType, thingID)]
+		return ok, nil
+	}
+
+	s.MarkMessageProcessedFunc = func(ctx context.Context, hash, thingID, thingType string, expires time.Time) error {
+		store[fmt.Sprintf("Processed:%s:%s:%s", hash, thingType, thingID)] = expires
+		return nil
+	}
+
+	s.StoreDeadLetterFunc = func(ctx context.Context, deadLetter storage.DeadLetter) error {
+		store["DeadLetter:"+deadLetter.ID] = deadLetter
+		return nil
+	}
+
+	s.GetDeadLetterFunc = func(ctx context.Context, id string) (storage.DeadLetter, error) {
+		if dl, ok := store["DeadLetter:"+id]; ok {
+			return dl.(storage.DeadLetter), nil
+		}
+		return storage.DeadLetter{}, storage.ErrNotFound
+	}
+
+	s.DeleteDeadLetterFunc = func(ctx context.Context, id string) error {
+		delete(store, "DeadLetter:"+id)
 		return nil
 	}
 
@@ -242,6 +805,9 @@ func setup(t *testing.T, store map[string]any) (*is.I, *messaging.MsgContextMock
 	msgCtx.RegisterTopicMessageHandlerFunc = func(routingKey string, handler messaging.TopicMessageHandler) error {
 		return nil
 	}
+	msgCtx.NoteToSelfFunc = func(ctx context.Context, command messaging.Command) error {
+		return nil
+	}
 
 	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
 		return nil
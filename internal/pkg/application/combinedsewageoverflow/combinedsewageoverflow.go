@@ -2,41 +2,59 @@ package combinedsewageoverflow
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"slices"
 	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/ids"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
-	"github.com/google/uuid"
 )
 
-var CombinedSewageOverflowFactory = func(id, tenant string) *CombinedSewageOverflow {
-	return &CombinedSewageOverflow{
-		ID:           id,
-		Type:         "CombinedSewageOverflow",
-		Tenant:       tenant,
-		DateObserved: time.Now().UTC(),
-		CumulativeTime: 0,
+var CombinedSewageOverflowFactory = NewCombinedSewageOverflowFactory(Config{})
+
+func NewCombinedSewageOverflowFactory(cfg Config) func(id, tenant string) *CombinedSewageOverflow {
+	return func(id, tenant string) *CombinedSewageOverflow {
+		return &CombinedSewageOverflow{
+			ID:             id,
+			Type:           "CombinedSewageOverflow",
+			Tenant:         tenant,
+			DateObserved:   time.Now().UTC(),
+			CumulativeTime: 0,
+			retention:      cfg.Retention,
+		}
 	}
 }
 
+type Config struct {
+	Retention RetentionPolicy `json:"retention" yaml:"retention"`
+}
+
+// RetentionPolicy limits the number of ended overflows that are kept in Overflows. A zero value means no limit.
+type RetentionPolicy struct {
+	MaxCount int           `json:"maxCount" yaml:"maxCount"` // keep at most the last MaxCount overflows
+	MaxAge   time.Duration `json:"maxAge" yaml:"maxAge"`     // keep overflows that ended within MaxAge
+}
+
 type CombinedSewageOverflow struct {
-	ID                     string        `json:"id"`
-	Type                   string        `json:"type"`
-	CumulativeTime         time.Duration `json:"cumulativeTime"`                   // total time for all overflows
-	DateObserved           time.Time     `json:"dateObserved"`                     // last time
-	Overflows              []Overflow    `json:"overflow"`                         // all detected overflows
-	OverflowDetected       bool          `json:"overflowDetected"`                 // true if last handled message created/updated an overflow
-	OverflowObserved       *time.Time    `json:"overflowObserved,omitempty"`       // time for last overflow observation
-	State                  bool          `json:"state"`                            // current state
-	StateChanged           bool          `json:"stateChanged"`                     // true if last handled message changed state
-	Tenant                 string        `json:"tenant"`                           // tenant
-	CombinedSewageOverflow *things.Thing `json:"combinedsewageoverflow,omitempty"` // related thing
+	ID                       string        `json:"id"`
+	Type                     string        `json:"type"`
+	CumulativeTime           time.Duration `json:"cumulativeTime"`                     // total time for all overflows
+	HistoricalCumulativeTime time.Duration `json:"historicalCumulativeTime,omitempty"` // total time for overflows removed by the retention policy
+	CompactedUntil           *time.Time    `json:"compactedUntil,omitempty"`           // start time of the latest overflow removed by the retention policy
+	DateObserved             time.Time     `json:"dateObserved"`                       // last time
+	Overflows                []Overflow    `json:"overflow"`                           // all detected overflows within the retention policy
+	OverflowDetected         bool          `json:"overflowDetected"`                   // true if last handled message created/updated an overflow
+	OverflowObserved         *time.Time    `json:"overflowObserved,omitempty"`         // time for last overflow observation
+	State                    bool          `json:"state"`                              // current state
+	StateChanged             bool          `json:"stateChanged"`                       // true if last handled message changed state
+	Tenant                   string        `json:"tenant"`                             // tenant
+	CombinedSewageOverflow   *things.Thing `json:"combinedsewageoverflow,omitempty"`   // related thing
+
+	retention        RetentionPolicy
+	updatedOverflows []Overflow // overflows created or changed by the last handled message
 }
 
 type Overflow struct {
@@ -94,6 +112,8 @@ func (cso *CombinedSewageOverflow) Handle(ctx context.Context, itm messaging.Inc
 
 	log := logging.GetFromContext(ctx)
 
+	cso.updatedOverflows = nil
+
 	sw, err := getStopwatch(itm)
 	if err != nil {
 		return false, err
@@ -112,16 +132,33 @@ func (cso *CombinedSewageOverflow) Handle(ctx context.Context, itm messaging.Inc
 		return true, nil
 	}
 
+	if cso.isCompacted(sw.StartTime) {
+		log.Debug("overflow has been removed by the retention policy, will ignore message")
+		return false, nil
+	}
+
+	updated := []string{}
+
 	i, changed := getIndexForOverflow(cso, sw.StartTime)
 
 	overflow := &cso.Overflows[i]
 	cso.OverflowDetected = true
 
+	if changed {
+		updated = append(updated, overflow.ID)
+	}
+
+	// messages are not always handled in the order they were sent, a message for an overflow that has ended is
+	// older than, or the same as, the message that ended it and is ignored
 	if overflow.StopTime != nil {
-		return changed, fmt.Errorf("current overflow already ended")
+		log.Debug("overflow has already ended, will ignore message")
+		return changed, nil
 	}
 
-	if overflow.State != sw.State {
+	// a stop that is handled before its start ends the overflow, the start is then ignored when it is handled
+	stopped := !sw.State && sw.StopTime != nil
+
+	if overflow.State != sw.State || stopped {
 		if sw.State {
 			if sw.Duration != nil {
 				overflow.Duration = *sw.Duration
@@ -152,13 +189,27 @@ func (cso *CombinedSewageOverflow) Handle(ctx context.Context, itm messaging.Inc
 
 		overflow.State = sw.State
 		changed = true
+
+		if !slices.Contains(updated, overflow.ID) {
+			updated = append(updated, overflow.ID)
+		}
 	}
 
 	slices.SortFunc(cso.Overflows, func(a, b Overflow) int {
 		return a.StartTime.Compare(b.StartTime)
 	})
 
-	cumulativeTime := 0
+	for _, o := range cso.Overflows {
+		if slices.Contains(updated, o.ID) {
+			cso.updatedOverflows = append(cso.updatedOverflows, o)
+		}
+	}
+
+	if cso.compact(time.Now().UTC()) {
+		changed = true
+	}
+
+	cumulativeTime := int(cso.HistoricalCumulativeTime)
 	for _, o := range cso.Overflows {
 		cumulativeTime += int(o.Duration)
 	}
@@ -168,8 +219,14 @@ func (cso *CombinedSewageOverflow) Handle(ctx context.Context, itm messaging.Inc
 		changed = true
 	}
 
-	if cso.State != cso.Overflows[len(cso.Overflows)-1].State {
-		cso.State = cso.Overflows[len(cso.Overflows)-1].State
+	// all overflows may have been removed by the retention policy, but only ended overflows are removed
+	state := false
+	if len(cso.Overflows) > 0 {
+		state = cso.Overflows[len(cso.Overflows)-1].State
+	}
+
+	if cso.State != state {
+		cso.State = state
 		changed = true
 		cso.StateChanged = true
 	}
@@ -177,6 +234,68 @@ func (cso *CombinedSewageOverflow) Handle(ctx context.Context, itm messaging.Inc
 	return changed, nil
 }
 
+// UpdatedOverflows returns the overflows that were created or changed by the last call to Handle,
+// including overflows that were removed from Overflows by the retention policy
+func (cso CombinedSewageOverflow) UpdatedOverflows() []Overflow {
+	return slices.Clone(cso.updatedOverflows)
+}
+
+// compact removes ended overflows that are outside of the retention policy. Overflows must be sorted by start time.
+// The duration of each removed overflow is added to HistoricalCumulativeTime so that CumulativeTime is unaffected.
+// Removed overflows are added to the updated overflows so that they are stored as events before they are lost.
+func (cso *CombinedSewageOverflow) compact(now time.Time) bool {
+	if cso.retention.MaxCount <= 0 && cso.retention.MaxAge <= 0 {
+		return false
+	}
+
+	kept := make([]Overflow, 0, len(cso.Overflows))
+
+	for i, o := range cso.Overflows {
+		tooMany := cso.retention.MaxCount > 0 && i < len(cso.Overflows)-cso.retention.MaxCount
+		tooOld := cso.retention.MaxAge > 0 && o.StopTime != nil && now.Sub(*o.StopTime) > cso.retention.MaxAge
+
+		if o.StopTime == nil || !(tooMany || tooOld) {
+			kept = append(kept, o)
+			continue
+		}
+
+		cso.HistoricalCumulativeTime += o.Duration
+
+		if !slices.ContainsFunc(cso.updatedOverflows, func(u Overflow) bool { return u.ID == o.ID }) {
+			cso.updatedOverflows = append(cso.updatedOverflows, o)
+		}
+
+		if cso.CompactedUntil == nil || o.StartTime.After(*cso.CompactedUntil) {
+			startTime := o.StartTime
+			cso.CompactedUntil = &startTime
+		}
+	}
+
+	if len(kept) == len(cso.Overflows) {
+		return false
+	}
+
+	slices.SortFunc(cso.updatedOverflows, func(a, b Overflow) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+
+	cso.Overflows = kept
+	return true
+}
+
+// isCompacted returns true if an overflow starting at t is unknown and has been removed by the retention policy
+func (cso *CombinedSewageOverflow) isCompacted(t time.Time) bool {
+	if cso.CompactedUntil == nil || t.UTC().After(*cso.CompactedUntil) {
+		return false
+	}
+
+	overflowID := deterministicUUID(t)
+
+	return !slices.ContainsFunc(cso.Overflows, func(o Overflow) bool {
+		return o.ID == overflowID
+	})
+}
+
 func getIndexForOverflow(cso *CombinedSewageOverflow, t time.Time) (int, bool) {
 	overflowID := deterministicUUID(t)
 
@@ -199,16 +318,5 @@ func getIndexForOverflow(cso *CombinedSewageOverflow, t time.Time) (int, bool) {
 }
 
 func deterministicUUID(t time.Time) string {
-	str := fmt.Sprintf("%d", t.UnixNano())
-
-	md5hash := md5.New()
-	md5hash.Write([]byte(str))
-	md5string := hex.EncodeToString(md5hash.Sum(nil))
-
-	unique, err := uuid.FromBytes([]byte(md5string[0:16]))
-	if err != nil {
-		return uuid.New().String()
-	}
-
-	return unique.String()
+	return ids.DeterministicUUID(fmt.Sprintf("%d", t.UnixNano()))
 }
@@ -54,6 +54,8 @@ func TestStartStop(t *testing.T) {
 	changed, err := cso.Handle(ctx, stopwatch1, tc)
 	is.NoErr(err)
 	is.True(changed)
+	is.Equal(1, len(cso.UpdatedOverflows()))
+	is.True(cso.UpdatedOverflows()[0].State)
 
 	stopTime := time.Date(2024, 4, 17, 15, 15, 0, 0, time.UTC)
 	stopwatch1.Stopwatch.StopTime = &stopTime
@@ -62,6 +64,43 @@ func TestStartStop(t *testing.T) {
 	changed, err = cso.Handle(ctx, stopwatch1, tc)
 	is.NoErr(err)
 	is.True(changed)
+	is.Equal(1, len(cso.UpdatedOverflows()))
+	is.Equal(15*time.Minute, cso.UpdatedOverflows()[0].Duration)
+
+	changed, err = cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{}}, tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(0, len(cso.UpdatedOverflows()))
+}
+
+func TestStopBeforeStartEndsOverflow(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: "cso:1", Type: "CombinedSewageOverflow"}, nil
+		},
+	}
+
+	startTime := time.Date(2024, 4, 17, 15, 0, 0, 0, time.UTC)
+	stopTime := startTime.Add(15 * time.Minute)
+
+	cso := CombinedSewageOverflow{ID: "cso:1", Type: "CombinedSewageOverflow", Tenant: "default"}
+
+	changed, err := cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime, StopTime: &stopTime, State: false}}, tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(1, len(cso.Overflows))
+	is.Equal(stopTime, *cso.Overflows[0].StopTime)
+	is.Equal(15*time.Minute, cso.Overflows[0].Duration)
+
+	// the start is older than the stop and should not reopen the overflow
+	changed, err = cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime, State: true}}, tc)
+	is.NoErr(err)
+	is.True(!changed)
+	is.True(!cso.Overflows[0].State)
+	is.True(!cso.State)
+	is.Equal(15*time.Minute, cso.CumulativeTime)
 }
 
 func TestMultipleStopwatches(t *testing.T) {
@@ -121,3 +160,107 @@ func TestMultipleStopwatches(t *testing.T) {
 	is.True(changed)
 	is.True(cso.State)
 }
+
+func TestRetentionPolicyKeepsCumulativeTime(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: "cso:1", Type: "CombinedSewageOverflow"}, nil
+		},
+	}
+
+	cso := NewCombinedSewageOverflowFactory(Config{Retention: RetentionPolicy{MaxCount: 2}})("cso:1", "default")
+
+	startTime := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+
+	for i := range 3 {
+		sw := functionUpdated{
+			ID:   "sw:1",
+			Type: "Stopwatch",
+			Stopwatch: stopwatch{
+				StartTime: startTime.Add(time.Duration(i) * time.Hour),
+				State:     true,
+			},
+		}
+
+		_, err := cso.Handle(ctx, sw, tc)
+		is.NoErr(err)
+
+		stopTime := sw.Stopwatch.StartTime.Add(10 * time.Minute)
+		sw.Stopwatch.StopTime = &stopTime
+		sw.Stopwatch.State = false
+
+		_, err = cso.Handle(ctx, sw, tc)
+		is.NoErr(err)
+	}
+
+	is.Equal(2, len(cso.Overflows))
+	is.Equal(10*time.Minute, cso.HistoricalCumulativeTime)
+	is.Equal(30*time.Minute, cso.CumulativeTime)
+	is.Equal(startTime, *cso.CompactedUntil)
+
+	// a redelivered stop message for the removed overflow should be ignored
+	stopTime := startTime.Add(10 * time.Minute)
+	changed, err := cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime, StopTime: &stopTime}}, tc)
+	is.NoErr(err)
+	is.True(!changed)
+	is.Equal(2, len(cso.Overflows))
+	is.Equal(30*time.Minute, cso.CumulativeTime)
+}
+
+func TestRetentionPolicyRemovesOldOverflows(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: "cso:1", Type: "CombinedSewageOverflow"}, nil
+		},
+	}
+
+	cso := NewCombinedSewageOverflowFactory(Config{Retention: RetentionPolicy{MaxAge: 24 * time.Hour}})("cso:1", "default")
+
+	startTime := time.Now().UTC().Add(-72 * time.Hour).Truncate(time.Second)
+	stopTime := startTime.Add(15 * time.Minute)
+
+	_, err := cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime, State: true}}, tc)
+	is.NoErr(err)
+
+	changed, err := cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime, StopTime: &stopTime}}, tc)
+	is.NoErr(err)
+	is.True(changed)
+
+	is.Equal(0, len(cso.Overflows))
+	is.Equal(1, len(cso.UpdatedOverflows())) // the ended overflow should still be stored as an event
+	is.Equal(15*time.Minute, cso.CumulativeTime)
+	is.True(!cso.State)
+}
+
+func TestRetentionPolicyStoresRemovedOverflowsAsEvents(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: "cso:1", Type: "CombinedSewageOverflow"}, nil
+		},
+	}
+
+	startTime := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+
+	// overflows that were stored in the state before the retention policy was configured
+	cso := NewCombinedSewageOverflowFactory(Config{Retention: RetentionPolicy{MaxCount: 1}})("cso:1", "default")
+	for i := range 2 {
+		st := startTime.Add(time.Duration(i) * time.Hour)
+		stopTime := st.Add(10 * time.Minute)
+		cso.Overflows = append(cso.Overflows, Overflow{ID: deterministicUUID(st), StartTime: st, StopTime: &stopTime, Duration: 10 * time.Minute})
+	}
+
+	changed, err := cso.Handle(ctx, functionUpdated{Stopwatch: stopwatch{StartTime: startTime.Add(2 * time.Hour), State: true}}, tc)
+	is.NoErr(err)
+	is.True(changed)
+
+	is.Equal(1, len(cso.Overflows))
+	is.Equal(3, len(cso.UpdatedOverflows())) // the removed overflows should be stored as events together with the new one
+	is.Equal(startTime, cso.UpdatedOverflows()[0].StartTime)
+	is.True(cso.UpdatedOverflows()[2].State)
+}
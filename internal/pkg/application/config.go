@@ -0,0 +1,164 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/combinedsewageoverflow"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewer"
+	"github.com/diwise/cip-functions/internal/pkg/application/things"
+	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
+	"gopkg.in/yaml.v3"
+)
+
+// Config maps incoming messages to the cip function handlers that should process them.
+// A config file can be written in either YAML or JSON, e.g.
+//
+//	routes:
+//	  - topic: function.updated
+//	    contentType: application/vnd.diwise.level
+//	    handlers: [WasteContainer, Sewer]
+//	  - topic: message.accepted
+//	    contentType: application/vnd.oma.lwm2m.ext.3330
+//	    handlers: [Sewer]
+//	functions:
+//	  combinedSewageOverflow:
+//	    retention:
+//	      maxCount: 100
+//	      maxAge: 8760h
+//	  sewagePumpingStation:
+//	    retention:
+//	      maxAge: 168h
+//	    alarms:
+//	      runningTime:
+//	        limit: 30
+//	      cyclesPerHour:
+//	        limit: 10
+//	  sewer:
+//	    alarms:
+//	      level:
+//	        limit: 2.5
+//	        hysteresis: 0.1
+//	        minDuration: 5m
+//	    sewers:
+//	      sewer-01:
+//	        level:
+//	          limit: 1.8
+//	  wasteContainer:
+//	    fullThreshold: 90
+//	    historyMaxAge: 72h
+//	    historyMaxCount: 50
+//	    fireRisk:
+//	      temperature:
+//	        limit: 60
+//	      riseRate:
+//	        limit: 20
+//	      tenants:
+//	        south:
+//	          temperature:
+//	            limit: 70
+//	workQueue:
+//	  maxQueueSize: 100
+//	things:
+//	  cache:
+//	    maxSize: 1000
+//	    defaultTTL: 1m
+//	    ttls:
+//	      wastecontainer: 10m
+//	  retry:
+//	    maxAttempts: 3
+//	    timeout: 30s
+//	  circuitBreaker:
+//	    failureThreshold: 5
+//	    openTimeout: 30s
+//	outbox:
+//	  interval: 1s
+//	  batchSize: 100
+//	  maxAttempts: 100
+//	  retention: 24h
+//	deduplication:
+//	  ttl: 24h
+//	validation:
+//	  wasteContainer: quarantine
+//	evaluation:
+//	  interval: 1m
+type Config struct {
+	Routes        []Route             `json:"routes" yaml:"routes"`
+	Functions     FunctionsConfig     `json:"functions" yaml:"functions"`
+	WorkQueue     WorkQueueConfig     `json:"workQueue" yaml:"workQueue"`
+	Things        things.Config       `json:"things" yaml:"things"`
+	Outbox        OutboxConfig        `json:"outbox" yaml:"outbox"`
+	Deduplication DeduplicationConfig `json:"deduplication" yaml:"deduplication"`
+	Validation    ValidationConfig    `json:"validation,omitempty" yaml:"validation,omitempty"`
+	Evaluation    EvaluationConfig    `json:"evaluation" yaml:"evaluation"`
+}
+
+// WorkQueueConfig limits the number of messages that may wait to be processed for a single thing.
+// Messages for a thing whose queue is full are rejected with ErrQueueFull.
+type WorkQueueConfig struct {
+	MaxQueueSize int `json:"maxQueueSize" yaml:"maxQueueSize"`
+}
+
+// FunctionsConfig contains settings for each type of cip function
+type FunctionsConfig struct {
+	CombinedSewageOverflow combinedsewageoverflow.Config `json:"combinedSewageOverflow" yaml:"combinedSewageOverflow"`
+	SewagePumpingStation   sewagepumpingstation.Config   `json:"sewagePumpingStation" yaml:"sewagePumpingStation"`
+	Sewer                  sewer.Config                  `json:"sewer" yaml:"sewer"`
+	WasteContainer         wastecontainer.Config         `json:"wasteContainer" yaml:"wasteContainer"`
+}
+
+// Route matches messages on Topic whose content type starts with ContentType. If Type is set
+// the function type (i.e. level, stopwatch) or "Device" must match as well.
+type Route struct {
+	Topic       string   `json:"topic" yaml:"topic"`
+	ContentType string   `json:"contentType" yaml:"contentType"`
+	Type        string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Handlers    []string `json:"handlers" yaml:"handlers"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Routes: []Route{
+			{Topic: "message.accepted", ContentType: "application/vnd.oma.lwm2m.ext.3303", Handlers: []string{"WasteContainer"}},
+			{Topic: "message.accepted", ContentType: "application/vnd.oma.lwm2m.ext.3330", Handlers: []string{"Sewer"}},
+			{Topic: "function.updated", ContentType: "application/vnd.diwise.level", Handlers: []string{"WasteContainer", "Sewer"}},
+			{Topic: "function.updated", ContentType: "application/vnd.diwise.stopwatch", Handlers: []string{"CombinedSewageOverflow"}},
+			{Topic: "function.updated", ContentType: "application/vnd.diwise.digitalinput", Handlers: []string{"SewagePumpingStation"}},
+		},
+	}
+}
+
+// LoadConfig reads the configuration from path, or returns the default configuration if path is empty
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to open config file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	return ParseConfig(f)
+}
+
+// ParseConfig decodes a YAML (or JSON) configuration. The default routes are used if no routes are configured,
+// so that a file that only contains settings for the functions does not leave the service without routes.
+func ParseConfig(r io.Reader) (Config, error) {
+	cfg := Config{}
+
+	err := yaml.NewDecoder(r).Decode(&cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	if len(cfg.Routes) == 0 {
+		cfg.Routes = DefaultConfig().Routes
+	}
+
+	return cfg, nil
+}
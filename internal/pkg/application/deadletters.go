@@ -0,0 +1,159 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrReplayFailed = errors.New("replay of dead letter failed")
+
+func (a App) storeDeadLetter(ctx context.Context, topic string, itm messaging.IncomingTopicMessage, failure handlerFailure) {
+	log := logging.GetFromContext(ctx)
+
+	dl := storage.DeadLetter{
+		ID:          uuid.NewString(),
+		Topic:       topic,
+		ContentType: itm.ContentType(),
+		Body:        itm.Body(),
+		HandlerType: failure.handlerType,
+		Tenant:      messageTenant(itm),
+		Error:       failure.err.Error(),
+		TraceID:     traceID(ctx),
+		Attempts:    1,
+	}
+
+	err := a.store.StoreDeadLetter(ctx, dl)
+	if err != nil {
+		log.Error("could not store dead letter", slog.String("handler_type", failure.handlerType), "err", err.Error())
+		return
+	}
+
+	log.Debug("message stored as dead letter", slog.String("dead_letter_id", dl.ID), slog.String("handler_type", failure.handlerType))
+}
+
+// ReplayDeadLetter passes a dead letter to its handler again. The dead letter is deleted if it is
+// handled without errors, otherwise its error and number of attempts are updated.
+func (a App) ReplayDeadLetter(ctx context.Context, id string) error {
+	var err error
+
+	ctx, span := tracer.Start(ctx, "replay-dead-letter")
+	defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+	dl, err := a.store.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log := logging.GetFromContext(ctx).With(slog.String("dead_letter_id", id), slog.String("topic_name", dl.Topic))
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	failures := dispatchTopicMessage(ctx, a, dl.Topic, deadLetterMessage{dl}, dl.HandlerType)
+	if len(failures) == 0 {
+		err = a.store.DeleteDeadLetter(ctx, id)
+		return err
+	}
+
+	errs := []error{}
+	for _, failure := range failures {
+		errs = append(errs, failure.err)
+	}
+	replayErr := errors.Join(errs...)
+
+	dl.Error = replayErr.Error()
+	dl.TraceID = traceID(ctx)
+	dl.Attempts++
+
+	err = errors.Join(fmt.Errorf("%w: %w", ErrReplayFailed, replayErr), a.store.StoreDeadLetter(ctx, dl))
+	return err
+}
+
+// replayShutdownDeadLetters replays the messages that were stored as dead letters because they were received while
+// the service was shutting down. Such messages were acknowledged without being processed.
+func (a App) replayShutdownDeadLetters(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	deadLetters, _, err := a.store.QueryDeadLetters(ctx, storage.DeadLetterQuery{Error: ErrShuttingDown.Error(), Before: time.Now()})
+	if err != nil {
+		log.Error("could not query dead letters received during shutdown", "err", err.Error())
+		return
+	}
+
+	replayed := 0
+
+	for _, dl := range deadLetters {
+		if !a.lifecycle.begin() {
+			return
+		}
+
+		err := a.ReplayDeadLetter(ctx, dl.ID)
+		a.lifecycle.end()
+
+		if err != nil {
+			log.Warn("could not replay dead letter received during shutdown", slog.String("dead_letter_id", dl.ID), "err", err.Error())
+			continue
+		}
+
+		replayed++
+	}
+
+	if len(deadLetters) > 0 {
+		log.Info("replayed dead letters received during shutdown", slog.Int("replayed", replayed), slog.Int("count", len(deadLetters)))
+	}
+}
+
+// messageTenant returns the tenant of a function, or the tenant record of a senml pack, in an incoming message so that
+// access to the dead letter can be limited to the tenant. An empty string is returned if the message has no tenant.
+func messageTenant(itm messaging.IncomingTopicMessage) string {
+	m := struct {
+		Tenant string     `json:"tenant"`
+		Pack   senml.Pack `json:"pack"`
+	}{}
+
+	if err := json.Unmarshal(itm.Body(), &m); err != nil {
+		return ""
+	}
+
+	if m.Tenant != "" {
+		return m.Tenant
+	}
+
+	tenant, _ := m.Pack.GetStringValue(senml.FindByName("tenant"))
+	return tenant
+}
+
+// deadLetterMessage makes it possible to pass a dead letter to a handler as an incoming message
+type deadLetterMessage struct {
+	dl storage.DeadLetter
+}
+
+func (m deadLetterMessage) Body() []byte {
+	return m.dl.Body
+}
+
+func (m deadLetterMessage) ContentType() string {
+	return m.dl.ContentType
+}
+
+func (m deadLetterMessage) TopicName() string {
+	return m.dl.Topic
+}
+
+func traceID(ctx context.Context) string {
+	sc := trace.SpanFromContext(ctx).SpanContext()
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
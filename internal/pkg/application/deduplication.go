@@ -0,0 +1,144 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultDeduplicationTTL    time.Duration = 24 * time.Hour
+	deduplicationPurgeInterval time.Duration = 1 * time.Hour
+)
+
+var duplicateMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cip_functions_duplicate_messages_total",
+	Help: "Number of messages that were not handled because they had already been processed for a thing",
+}, []string{"thing_type"})
+
+// DeduplicationConfig controls for how long a processed message is remembered. A message that is received again
+// within TTL, e.g. when it is redelivered by the broker, is not handled again for things it has already been
+// processed for.
+type DeduplicationConfig struct {
+	Disabled bool          `json:"disabled" yaml:"disabled"`
+	TTL      time.Duration `json:"ttl" yaml:"ttl"`
+}
+
+type deduplicator struct {
+	store    storage.Storage
+	disabled bool
+	ttl      time.Duration
+
+	mu         sync.Mutex
+	lastPurged time.Time
+}
+
+func newDeduplicator(s storage.Storage, cfg DeduplicationConfig) *deduplicator {
+	d := &deduplicator{
+		store:      s,
+		disabled:   cfg.Disabled,
+		ttl:        cfg.TTL,
+		lastPurged: time.Now(),
+	}
+
+	if d.ttl <= 0 {
+		d.ttl = defaultDeduplicationTTL
+	}
+
+	return d
+}
+
+// messageHash identifies a message by its content type and body
+func messageHash(itm messaging.IncomingTopicMessage) string {
+	h := sha256.New()
+	h.Write([]byte(itm.ContentType()))
+	h.Write([]byte{0})
+	h.Write(itm.Body())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isDuplicate reports whether itm has already been processed for the thing. Errors are logged and the
+// message is then handled as if it was not a duplicate.
+func (d *deduplicator) isDuplicate(ctx context.Context, itm messaging.IncomingTopicMessage, thingID, thingType string) bool {
+	if d.disabled {
+		return false
+	}
+
+	seen, err := d.store.IsMessageProcessed(ctx, messageHash(itm), thingID, thingType)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not check if message has already been processed", "err", err.Error())
+		return false
+	}
+
+	if seen {
+		duplicateMessages.WithLabelValues(thingType).Inc()
+	}
+
+	return seen
+}
+
+// processedMessages returns the record that itm has been processed for the thing, that should be stored in the same
+// transaction as the state it changed, or nothing if deduplication is disabled
+func (d *deduplicator) processedMessages(itm messaging.IncomingTopicMessage, thingID, thingType string) []storage.ProcessedMessage {
+	if d.disabled {
+		return nil
+	}
+
+	return []storage.ProcessedMessage{{
+		Hash:      messageHash(itm),
+		ThingID:   thingID,
+		ThingType: thingType,
+		Expires:   time.Now().Add(d.ttl),
+	}}
+}
+
+// processed remembers that itm has been processed for the thing, when it was not stored together with a changed state.
+// Expired messages are purged at most once per purge interval.
+func (d *deduplicator) processed(ctx context.Context, itm messaging.IncomingTopicMessage, thingID, thingType string) {
+	if d.disabled {
+		return
+	}
+
+	err := d.store.MarkMessageProcessed(ctx, messageHash(itm), thingID, thingType, time.Now().Add(d.ttl))
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not mark message as processed", "err", err.Error())
+	}
+
+	d.purgeExpired(ctx)
+}
+
+// purgeExpired purges expired processed messages at most once per purge interval
+func (d *deduplicator) purgeExpired(ctx context.Context) {
+	if d.disabled {
+		return
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	now := time.Now()
+
+	d.mu.Lock()
+	purge := now.Sub(d.lastPurged) >= deduplicationPurgeInterval
+	if purge {
+		d.lastPurged = now
+	}
+	d.mu.Unlock()
+
+	if purge {
+		n, err := d.store.PurgeProcessedMessages(ctx, now)
+		if err != nil {
+			log.Error("could not purge expired processed messages", "err", err.Error())
+			return
+		}
+		log.Debug("purged expired processed messages", slog.Int64("count", n))
+	}
+}
@@ -0,0 +1,194 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const (
+	defaultEvaluationInterval time.Duration = 1 * time.Minute
+	evaluationPageSize        int           = 100
+)
+
+// EvaluationConfig controls how often the alarms of the stored cip functions are evaluated, so that alarms that
+// depend on how much time has passed are raised even if no messages are received
+type EvaluationConfig struct {
+	Interval time.Duration `json:"interval" yaml:"interval"`
+}
+
+// evaluatedHandler is implemented by cip functions whose alarms are evaluated periodically
+type evaluatedHandler interface {
+	CipFunctionHandler
+	Evaluate(now time.Time) bool
+}
+
+// evaluateFunc evaluates the alarms of all stored cip functions of a type as of now
+type evaluateFunc func(ctx context.Context, app App, now time.Time) error
+
+func newEvaluateFunc[T evaluatedHandler](fn func(id, tenant string) T) evaluateFunc {
+	return func(ctx context.Context, app App, now time.Time) error {
+		return evaluateStoredThings(ctx, app, now, fn)
+	}
+}
+
+func newEvaluateFuncs(cfg FunctionsConfig) map[string]evaluateFunc {
+	return map[string]evaluateFunc{
+		strings.ToLower(storage.GetTypeName[*sewagepumpingstation.SewagePumpingStation]()): newEvaluateFunc(sewagepumpingstation.NewSewagePumpingStationFactory(cfg.SewagePumpingStation)),
+	}
+}
+
+// evaluateStoredThings evaluates every stored thing of type T. Things are evaluated one at a time in the same
+// queue as the incoming messages for the thing, so that its state is kept consistent.
+func evaluateStoredThings[T evaluatedHandler](ctx context.Context, app App, now time.Time, fn func(id, tenant string) T) error {
+	thingType := storage.GetTypeName[T]()
+
+	var errs []error
+
+	for offset := 0; ; offset += evaluationPageSize {
+		result, err := app.store.ReadAll(ctx, thingType, storage.QueryParams{Offset: offset, Limit: evaluationPageSize})
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("failed to read %s: %w", thingType, err))...)
+		}
+
+		for _, data := range result.Data {
+			m, ok := data.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			id, _ := m["id"].(string)
+			tenant, _ := m["tenant"].(string)
+			if id == "" {
+				continue
+			}
+
+			err := app.queue.Do(ctx, thingType+":"+id, func(ctx context.Context) error {
+				return evaluateThing(ctx, app, id, now, func() T { return fn(id, tenant) })
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to evaluate %s %s: %w", thingType, id, err))
+			}
+		}
+
+		if len(result.Data) < evaluationPageSize || int64(offset+len(result.Data)) >= result.TotalRecords {
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// evaluateThing evaluates the alarms of a stored thing and stores the result, together with the messages that should
+// be published, if an alarm was changed. The thing is evaluated again if it is concurrently changed by someone else.
+func evaluateThing[T evaluatedHandler](ctx context.Context, app App, id string, now time.Time, newState func() T) error {
+	for attempt := 1; ; attempt++ {
+		state, version, err := storage.Load(ctx, app.store, id, newState())
+		if err != nil {
+			return err
+		}
+
+		if !state.Evaluate(now) {
+			return nil
+		}
+
+		_, err = storage.SaveWithOutbox(ctx, app.store, id, state, version, outboxMessages(state), historyEvents(state))
+		if errors.Is(err, storage.ErrConcurrencyConflict) && attempt < maxStoreAttempts {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		app.outbox.Notify()
+
+		return nil
+	}
+}
+
+// Evaluation periodically evaluates the alarms of the stored cip functions
+type Evaluation struct {
+	interval time.Duration
+	evaluate func(ctx context.Context, now time.Time)
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+}
+
+func newEvaluation(cfg EvaluationConfig, evaluate func(ctx context.Context, now time.Time)) *Evaluation {
+	e := &Evaluation{
+		interval: cfg.Interval,
+		evaluate: evaluate,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if e.interval <= 0 {
+		e.interval = defaultEvaluationInterval
+	}
+
+	return e
+}
+
+// Start runs the evaluation every interval until Stop is called
+func (e *Evaluation) Start(ctx context.Context) {
+	e.started.Store(true)
+	go e.run(ctx)
+}
+
+// Stop stops the evaluation and waits, until ctx is done, for an ongoing evaluation to finish
+func (e *Evaluation) Stop(ctx context.Context) error {
+	e.stopOnce.Do(func() { close(e.stop) })
+
+	if !e.started.Load() {
+		return nil
+	}
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Evaluation) run(ctx context.Context) {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.evaluate(ctx, now)
+		}
+	}
+}
+
+// evaluateAlarms evaluates the alarms of all stored cip functions that are evaluated periodically
+func (a App) evaluateAlarms(ctx context.Context, now time.Time) {
+	log := logging.GetFromContext(ctx)
+
+	for handlerType, evaluate := range a.evaluators {
+		err := evaluate(ctx, a, now)
+		if err != nil {
+			log.Error("failed to evaluate alarms", slog.String("handler_type", handlerType), "err", err.Error())
+		}
+	}
+}
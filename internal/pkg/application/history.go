@@ -0,0 +1,55 @@
+package application
+
+import (
+	"github.com/diwise/cip-functions/internal/pkg/application/combinedsewageoverflow"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
+	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+// historyEvents returns events, such as overflows, pump cycles and emptyings, that are stored apart from the current
+// state of a function. They are stored in the same transaction as the state so that they are not lost if storing fails.
+func historyEvents(state any) storage.Events {
+	events := storage.Events{}
+
+	switch f := state.(type) {
+	case *combinedsewageoverflow.CombinedSewageOverflow:
+		for _, o := range f.UpdatedOverflows() {
+			events.Overflows = append(events.Overflows, storage.Overflow{
+				ID:                       o.ID,
+				CombinedSewageOverflowID: f.ID,
+				Tenant:                   f.Tenant,
+				State:                    o.State,
+				StartTime:                o.StartTime,
+				StopTime:                 o.StopTime,
+				Duration:                 o.Duration,
+			})
+		}
+	case *sewagepumpingstation.SewagePumpingStation:
+		for _, c := range f.UpdatedCycles() {
+			events.PumpCycles = append(events.PumpCycles, storage.PumpCycle{
+				ID:                     c.ID,
+				SewagePumpingStationID: f.ID,
+				Tenant:                 f.Tenant,
+				StartTime:              c.StartTime,
+				StopTime:               c.StopTime,
+				Duration:               c.Duration,
+			})
+		}
+	case *wastecontainer.WasteContainer:
+		for _, e := range f.DetectedEmptyings() {
+			events.Emptyings = append(events.Emptyings, storage.Emptying{
+				ID:               e.ID,
+				WasteContainerID: e.WasteContainerID,
+				Tenant:           e.Tenant,
+				Timestamp:        e.Timestamp,
+				PercentBefore:    e.PercentBefore,
+				PercentAfter:     e.PercentAfter,
+				LevelBefore:      e.LevelBefore,
+				LevelAfter:       e.LevelAfter,
+			})
+		}
+	}
+
+	return events
+}
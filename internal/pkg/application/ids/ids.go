@@ -0,0 +1,23 @@
+package ids
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+
+	"github.com/google/uuid"
+)
+
+// DeterministicUUID returns a UUID that is derived from key, so that an event that is detected again, i.e. when
+// a message is redelivered, gets the same id. The UUID is made from the first half of the hex encoded md5 hash of
+// key, which is how the ids of stored overflows were created.
+func DeterministicUUID(key string) string {
+	h := md5.Sum([]byte(key))
+	str := hex.EncodeToString(h[:])
+
+	unique, err := uuid.FromBytes([]byte(str[0:16]))
+	if err != nil {
+		return uuid.New().String()
+	}
+
+	return unique.String()
+}
@@ -0,0 +1,20 @@
+package ids
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDeterministicUUIDIsStable(t *testing.T) {
+	is := is.New(t)
+
+	ts := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	// the id of an overflow that started at ts, it must not change since overflows are stored with it
+	is.Equal("64396231-6136-3833-3564-616231393036", DeterministicUUID(fmt.Sprintf("%d", ts.UnixNano())))
+	is.Equal(DeterministicUUID("sps:1"), DeterministicUUID("sps:1"))
+	is.True(DeterministicUUID("sps:1") != DeterministicUUID("sps:2"))
+}
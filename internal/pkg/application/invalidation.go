@@ -0,0 +1,76 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+// thingTopics are the topics on which iot-things publishes changes to things. A changed thing is removed
+// from the things cache, together with every cached thing that is related to it, so that e.g. a sensor
+// that is linked to another sewer is handled by the new sewer immediately.
+var thingTopics = []string{"thing.updated", "thing.deleted"}
+
+func (a App) registerCacheInvalidation() error {
+	for _, topic := range thingTopics {
+		err := a.msgCtx.RegisterTopicMessageHandler(topic, newThingChangedHandler(a, topic))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newThingChangedHandler(app App, topic string) messaging.TopicMessageHandler {
+	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+		var err error
+
+		ctx, span := tracer.Start(ctx, topic)
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, _, l = o11y.AddTraceIDToLoggerAndStoreInContext(span, l, ctx)
+
+		id, thingType, err := thingSource(itm)
+		if err != nil {
+			l.Error("could not find changed thing", slog.String("topic_name", topic), "err", err.Error())
+			return
+		}
+
+		removed := app.thingsClient.Invalidate(id, thingType)
+
+		l.Debug("removed changed thing from cache", slog.String("thing_id", id), slog.String("thing_type", thingType), slog.Int("removed", removed))
+	}
+}
+
+// thingSource returns the id and type of a thing in a message from iot-things. The thing is
+// either the message itself or is found in the property "thing".
+func thingSource(itm messaging.IncomingTopicMessage) (string, string, error) {
+	t := struct {
+		ID    string `json:"id"`
+		Type  string `json:"type"`
+		Thing *struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"thing,omitempty"`
+	}{}
+
+	err := json.Unmarshal(itm.Body(), &t)
+	if err != nil {
+		return "", "", fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	if t.Thing != nil {
+		t.ID, t.Type = t.Thing.ID, t.Thing.Type
+	}
+
+	if t.ID == "" {
+		return "", "", fmt.Errorf("ID is empty")
+	}
+
+	return t.ID, t.Type, nil
+}
@@ -0,0 +1,60 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("cip-functions is shutting down")
+
+// lifecycle keeps track of the messages that are being processed so that they can be completed before shutdown
+type lifecycle struct {
+	mu       sync.Mutex
+	stopping bool
+	inFlight sync.WaitGroup
+}
+
+// begin returns false if no more messages should be processed, otherwise end must be called when the message is processed
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopping {
+		return false
+	}
+
+	l.inFlight.Add(1)
+	return true
+}
+
+func (l *lifecycle) end() {
+	l.inFlight.Done()
+}
+
+// stop stops new messages from being processed and waits until the messages in flight have been processed, or ctx is done
+func (l *lifecycle) stop(ctx context.Context) error {
+	l.mu.Lock()
+	l.stopping = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *lifecycle) isStopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stopping
+}
@@ -0,0 +1,65 @@
+package application
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics for the cip function pipeline, labeled by handler type, i.e. the lower case name of the cip function type
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_received_total",
+		Help: "Number of messages passed to a handler",
+	}, []string{"handler_type"})
+	messagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_filtered_total",
+		Help: "Number of messages that were ignored by a handler because no related thing of the handler type was found",
+	}, []string{"handler_type"})
+	messagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_processed_total",
+		Help: "Number of messages processed by a handler without errors",
+	}, []string{"handler_type"})
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_failed_total",
+		Help: "Number of messages that failed in a handler and were stored as dead letters",
+	}, []string{"handler_type"})
+	messageProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cip_functions_message_processing_duration_seconds",
+		Help:    "Time it took for a handler to process a message",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"handler_type"})
+	functionsChanged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_changed_total",
+		Help: "Number of times the state of a cip function was changed",
+	}, []string{"handler_type", "tenant"})
+	functionsLastChanged = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cip_functions_last_changed_timestamp_seconds",
+		Help: "Unix time when the state of a cip function was last changed",
+	}, []string{"handler_type", "tenant"})
+	messagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_published_total",
+		Help: "Number of messages published from the outbox",
+	}, []string{"handler_type", "topic"})
+	messagesGivenUp = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_messages_given_up_total",
+		Help: "Number of messages in the outbox that were not published within the max number of attempts",
+	}, []string{"handler_type", "topic"})
+)
+
+func recordChange(thingType, tenant string, now time.Time) {
+	handlerType := strings.ToLower(thingType)
+	functionsChanged.WithLabelValues(handlerType, tenant).Inc()
+	functionsLastChanged.WithLabelValues(handlerType, tenant).Set(float64(now.Unix()))
+}
+
+// handlerTypeFromContentType returns the handler type of an outgoing message, i.e. sewer for
+// application/vnd.diwise.sewer+json and application/vnd.diwise.sewer.alarm+json
+func handlerTypeFromContentType(contentType string) string {
+	handlerType := strings.TrimPrefix(strings.ToLower(contentType), "application/vnd.diwise.")
+	handlerType, _, _ = strings.Cut(handlerType, "+")
+	handlerType, _, _ = strings.Cut(handlerType, ".")
+	return handlerType
+}
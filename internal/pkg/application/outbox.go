@@ -0,0 +1,269 @@
+package application
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const (
+	defaultOutboxInterval  time.Duration = 1 * time.Second
+	defaultOutboxBatchSize int           = 100
+	defaultOutboxRetention time.Duration = 24 * time.Hour
+	defaultOutboxAttempts  int           = 100
+	outboxPurgeInterval    time.Duration = 1 * time.Hour
+)
+
+// OutboxConfig controls how often the outbox is checked for messages that should be published, how many times a
+// message is attempted before it is given up, and for how long delivered messages are kept in the outbox
+type OutboxConfig struct {
+	Interval    time.Duration `json:"interval" yaml:"interval"`
+	BatchSize   int           `json:"batchSize" yaml:"batchSize"`
+	MaxAttempts int           `json:"maxAttempts" yaml:"maxAttempts"`
+	Retention   time.Duration `json:"retention" yaml:"retention"`
+}
+
+// OutboxRelay publishes the messages that are stored in the outbox together with the state of the cip functions.
+// A message is marked as delivered after it has been published, so each message is published at least once, unless
+// it could not be published in maxAttempts attempts. It is then given up so that it does not block later messages.
+type OutboxRelay struct {
+	store  storage.Storage
+	msgCtx messaging.MsgContext
+
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	retention   time.Duration
+
+	notify   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+func NewOutboxRelay(s storage.Storage, msgCtx messaging.MsgContext, cfg OutboxConfig) *OutboxRelay {
+	r := &OutboxRelay{
+		store:       s,
+		msgCtx:      msgCtx,
+		interval:    cfg.Interval,
+		batchSize:   cfg.BatchSize,
+		maxAttempts: cfg.MaxAttempts,
+		retention:   cfg.Retention,
+		notify:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if r.interval <= 0 {
+		r.interval = defaultOutboxInterval
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = defaultOutboxBatchSize
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaultOutboxAttempts
+	}
+	if r.retention <= 0 {
+		r.retention = defaultOutboxRetention
+	}
+
+	return r
+}
+
+// Start runs the relay until Stop is called. The outbox is checked every interval, or directly when Notify is called.
+func (r *OutboxRelay) Start(ctx context.Context) {
+	r.started.Store(true)
+	go r.run(ctx)
+}
+
+// Notify tells the relay that new messages have been added to the outbox
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the relay and publishes the messages that are still in the outbox
+func (r *OutboxRelay) Stop(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+
+	if r.started.Load() {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return r.Flush(ctx)
+}
+
+// Flush publishes messages from the outbox until it is empty or a message could not be published
+func (r *OutboxRelay) Flush(ctx context.Context) error {
+	for {
+		delivered, err := r.store.ProcessOutbox(ctx, r.batchSize, r.maxAttempts, r.deliver)
+		if err != nil {
+			return err
+		}
+
+		if delivered < r.batchSize {
+			return nil
+		}
+	}
+}
+
+// Err returns the error from the last attempt to publish the messages in the outbox, or nil if it succeeded
+func (r *OutboxRelay) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastErr
+}
+
+func (r *OutboxRelay) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastErr = err
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, m storage.OutboxMessage) error {
+	err := r.msgCtx.PublishOnTopic(ctx, outboxMessage{m})
+	if err != nil {
+		if m.Attempts+1 >= r.maxAttempts {
+			log := logging.GetFromContext(ctx)
+			log.Error("message from outbox could not be published and is given up", slog.Int64("outbox_id", m.ID), slog.String("topic", m.Topic), slog.Int("attempts", m.Attempts+1), "err", err.Error())
+			messagesGivenUp.WithLabelValues(handlerTypeFromContentType(m.ContentType), m.Topic).Inc()
+		}
+		return err
+	}
+
+	messagesPublished.WithLabelValues(handlerTypeFromContentType(m.ContentType), m.Topic).Inc()
+
+	return nil
+}
+
+func (r *OutboxRelay) run(ctx context.Context) {
+	defer close(r.done)
+
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	lastPurge := time.Now()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.notify:
+		}
+
+		err := r.Flush(ctx)
+		if err != nil {
+			log.Error("failed to publish messages from outbox", "err", err.Error())
+		}
+		r.setErr(err)
+
+		if time.Since(lastPurge) >= outboxPurgeInterval {
+			lastPurge = time.Now()
+
+			purged, err := r.store.PurgeOutbox(ctx, lastPurge.Add(-r.retention))
+			if err != nil {
+				log.Error("failed to purge delivered messages from outbox", "err", err.Error())
+				continue
+			}
+
+			log.Debug("purged delivered messages from outbox", slog.Int64("count", purged))
+		}
+	}
+}
+
+// outboxMessage makes it possible to publish a message from the outbox
+type outboxMessage struct {
+	m storage.OutboxMessage
+}
+
+func (m outboxMessage) Body() []byte {
+	return m.m.Body
+}
+
+func (m outboxMessage) ContentType() string {
+	return m.m.ContentType
+}
+
+func (m outboxMessage) TopicName() string {
+	return m.m.Topic
+}
+
+// alarmRaiser is implemented by cip functions that publish messages when alarms are raised or cleared
+type alarmRaiser interface {
+	UpdatedAlarms() []alarms.Message
+}
+
+// emptyingDetector is implemented by cip functions that publish messages when a container is emptied
+type emptyingDetector interface {
+	DetectedEmptyings() []wastecontainer.Emptying
+}
+
+// observationRecorder is implemented by cip functions that record observations in their state, that should be stored
+// even when the state has no change to publish
+type observationRecorder interface {
+	RecordedObservation() bool
+}
+
+// fireRiskAlerter is implemented by cip functions that publish messages when fire risk alerts are raised or cleared
+type fireRiskAlerter interface {
+	FireRiskAlerts() []wastecontainer.FireRiskAlert
+}
+
+// outboxMessages returns the messages that should be published when state has changed, i.e. the state itself
+// on cip-function.updated followed by any alarms that were raised or cleared, any emptyings and any fire risk alerts
+func outboxMessages(state messaging.TopicMessage) []storage.OutboxMessage {
+	messages := []storage.OutboxMessage{newOutboxMessage(state)}
+
+	if a, ok := state.(alarmRaiser); ok {
+		for _, m := range a.UpdatedAlarms() {
+			messages = append(messages, newOutboxMessage(m))
+		}
+	}
+
+	if e, ok := state.(emptyingDetector); ok {
+		for _, m := range e.DetectedEmptyings() {
+			messages = append(messages, newOutboxMessage(m))
+		}
+	}
+
+	if f, ok := state.(fireRiskAlerter); ok {
+		for _, m := range f.FireRiskAlerts() {
+			messages = append(messages, newOutboxMessage(m))
+		}
+	}
+
+	return messages
+}
+
+func newOutboxMessage(m messaging.TopicMessage) storage.OutboxMessage {
+	return storage.OutboxMessage{
+		Topic:       m.TopicName(),
+		ContentType: m.ContentType(),
+		Body:        m.Body(),
+	}
+}
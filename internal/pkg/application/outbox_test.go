@@ -0,0 +1,206 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewer"
+	"github.com/diwise/cip-functions/internal/pkg/application/things"
+	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestOutboxRelayPublishesMessagesInOrder(t *testing.T) {
+	is, s, msgCtx, outbox := outboxTestSetup(t, 3)
+
+	published := []string{}
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		published = append(published, string(message.Body()))
+		return nil
+	}
+
+	r := NewOutboxRelay(s, msgCtx, OutboxConfig{BatchSize: 2})
+	is.NoErr(r.Flush(context.Background()))
+
+	is.Equal([]string{"1", "2", "3"}, published)
+	is.Equal(0, len(*outbox))
+}
+
+func TestOutboxRelayStopsAtFailedMessage(t *testing.T) {
+	is, s, msgCtx, outbox := outboxTestSetup(t, 3)
+
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		if string(message.Body()) == "2" {
+			return errors.New("broker is unavailable")
+		}
+		return nil
+	}
+
+	r := NewOutboxRelay(s, msgCtx, OutboxConfig{})
+	is.True(r.Flush(context.Background()) != nil)
+
+	is.Equal(2, len(*outbox)) // 2 and 3 should remain in the outbox
+	is.Equal("2", string((*outbox)[0].Body))
+}
+
+func TestOutboxRelayGivesUpMessageAfterMaxAttempts(t *testing.T) {
+	is, s, msgCtx, outbox := outboxTestSetup(t, 3)
+
+	published := []string{}
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		if string(message.Body()) == "2" {
+			return errors.New("message can not be published")
+		}
+		published = append(published, string(message.Body()))
+		return nil
+	}
+
+	r := NewOutboxRelay(s, msgCtx, OutboxConfig{MaxAttempts: 3})
+	is.True(r.Flush(context.Background()) != nil)
+	is.True(r.Flush(context.Background()) != nil)
+	is.Equal(2, len(*outbox)) // 2 is attempted again until it has been attempted 3 times
+
+	is.NoErr(r.Flush(context.Background()))
+	is.Equal([]string{"1", "3"}, published)
+	is.Equal(0, len(*outbox))
+}
+
+func TestOutboxRelayReportsFailedPublish(t *testing.T) {
+	is, s, msgCtx, _ := outboxTestSetup(t, 1)
+
+	var available atomic.Bool
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		if !available.Load() {
+			return errors.New("broker is unavailable")
+		}
+		return nil
+	}
+
+	r := NewOutboxRelay(s, msgCtx, OutboxConfig{Interval: time.Millisecond})
+	r.Start(context.Background())
+	defer r.Stop(context.Background())
+
+	is.True(eventually(func() bool { return r.Err() != nil }))
+
+	available.Store(true)
+
+	is.True(eventually(func() bool { return r.Err() == nil }))
+}
+
+func TestOutboxRelayPublishesRemainingMessagesWhenStopped(t *testing.T) {
+	is, s, msgCtx, outbox := outboxTestSetup(t, 0)
+
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		return nil
+	}
+
+	r := NewOutboxRelay(s, msgCtx, OutboxConfig{Interval: time.Hour})
+	r.Start(context.Background())
+
+	*outbox = append(*outbox, storage.OutboxMessage{ID: 1, Topic: "cip-function.updated", Body: []byte("1")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	is.NoErr(r.Stop(ctx))
+	is.Equal(0, len(*outbox))
+	is.Equal(1, len(msgCtx.PublishOnTopicCalls()))
+}
+
+func TestOutboxMessagesIncludeAlarms(t *testing.T) {
+	is := is.New(t)
+
+	s := sewer.NewSewerFactory(sewer.Config{
+		Alarms: sewer.AlarmsConfig{Level: alarms.Threshold{}.WithLimit(1.0)},
+	})("sewer:1", "default")
+
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: id, Type: "Sewer"}, nil
+		},
+	}
+
+	itm := newTestMessage("application/vnd.diwise.level+json", `{"id":"level:1","level":{"current":1.5},"timestamp":"2024-08-08T11:21:25Z"}`)
+
+	_, err := s.Handle(context.Background(), itm, tc)
+	is.NoErr(err)
+
+	messages := outboxMessages(s)
+	is.Equal(2, len(messages))
+	is.Equal("cip-function.updated", messages[0].Topic)
+	is.Equal("cip-function.alarm", messages[1].Topic)
+	is.Equal("application/vnd.diwise.sewer.alarm+json", messages[1].ContentType)
+	is.Equal("sewer", handlerTypeFromContentType(messages[1].ContentType))
+}
+
+func TestOutboxMessagesIncludeFireRiskAlerts(t *testing.T) {
+	is := is.New(t)
+
+	wc := wastecontainer.NewWasteContainerFactory(wastecontainer.Config{
+		FireRisk: wastecontainer.FireRiskConfig{Temperature: alarms.Threshold{}.WithLimit(60)},
+	})("wc:1", "default")
+
+	tc := &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: id, Type: "WasteContainer"}, nil
+		},
+	}
+
+	itm := newTestMessage("application/vnd.oma.lwm2m.ext.3303", `{"pack":[{"bn":"dev:1/3303/","bt":1723116085,"n":"0","vs":"urn:oma:lwm2m:ext:3303"},{"n":"5700","v":75}],"timestamp":"2024-08-08T11:21:25Z"}`)
+
+	_, err := wc.Handle(context.Background(), itm, tc)
+	is.NoErr(err)
+
+	messages := outboxMessages(wc)
+	is.Equal(2, len(messages))
+	is.Equal("cip-function.updated", messages[0].Topic)
+	is.Equal("cip-function.firerisk", messages[1].Topic)
+	is.Equal("wastecontainer", handlerTypeFromContentType(messages[1].ContentType))
+}
+
+func outboxTestSetup(t *testing.T, count int) (*is.I, *storage.StorageMock, *messaging.MsgContextMock, *[]storage.OutboxMessage) {
+	is := is.New(t)
+	s := &storage.StorageMock{}
+	msgCtx := &messaging.MsgContextMock{}
+
+	outbox := []storage.OutboxMessage{}
+	for i := range count {
+		outbox = append(outbox, storage.OutboxMessage{ID: int64(i + 1), Topic: "cip-function.updated", Body: []byte{byte('1' + i)}})
+	}
+
+	s.ProcessOutboxFunc = func(ctx context.Context, limit, maxAttempts int, deliver func(ctx context.Context, message storage.OutboxMessage) error) (int, error) {
+		delivered := 0
+		for len(outbox) > 0 && delivered < limit {
+			err := deliver(ctx, outbox[0])
+			if err != nil {
+				outbox[0].Attempts++
+				if outbox[0].Attempts < maxAttempts {
+					return delivered, err
+				}
+				outbox = outbox[1:]
+				continue
+			}
+			outbox = outbox[1:]
+			delivered++
+		}
+		return delivered, nil
+	}
+
+	return is, s, msgCtx, &outbox
+}
+
+func eventually(condition func() bool) bool {
+	for range 1000 {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
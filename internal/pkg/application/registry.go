@@ -0,0 +1,183 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/combinedsewageoverflow"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
+	"github.com/diwise/cip-functions/internal/pkg/application/sewer"
+	"github.com/diwise/cip-functions/internal/pkg/application/wastecontainer"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
+)
+
+var ErrUnknownHandlerType = fmt.Errorf("unknown handler type")
+var ErrUnsupportedTopic = fmt.Errorf("unsupported topic")
+
+// handlerFunc processes an incoming message from the function or device id of type typeName
+type handlerFunc func(ctx context.Context, app App, id, typeName string, itm messaging.IncomingTopicMessage) (bool, error)
+
+// sourceFunc returns the id and type of the function or device that sent the message
+type sourceFunc func(itm messaging.IncomingTopicMessage) (string, string, error)
+
+func newHandlerFunc[T CipFunctionHandler](fn func(id, tenant string) T) handlerFunc {
+	return func(ctx context.Context, app App, id, typeName string, itm messaging.IncomingTopicMessage) (bool, error) {
+		return processIncomingTopicMessage(ctx, app, id, typeName, itm, fn)
+	}
+}
+
+func newHandlerFuncs(cfg FunctionsConfig) map[string]handlerFunc {
+	handlers := map[string]handlerFunc{}
+
+	add := func(typeName string, fn handlerFunc) {
+		handlers[strings.ToLower(typeName)] = fn
+	}
+
+	add(storage.GetTypeName[*combinedsewageoverflow.CombinedSewageOverflow](), newHandlerFunc(combinedsewageoverflow.NewCombinedSewageOverflowFactory(cfg.CombinedSewageOverflow)))
+	add(storage.GetTypeName[*sewagepumpingstation.SewagePumpingStation](), newHandlerFunc(sewagepumpingstation.NewSewagePumpingStationFactory(cfg.SewagePumpingStation)))
+	add(storage.GetTypeName[*sewer.Sewer](), newHandlerFunc(sewer.NewSewerFactory(cfg.Sewer)))
+	add(storage.GetTypeName[*wastecontainer.WasteContainer](), newHandlerFunc(wastecontainer.NewWasteContainerFactory(cfg.WasteContainer)))
+
+	return handlers
+}
+
+var sources = map[string]sourceFunc{
+	"function.updated": functionSource,
+	"message.accepted": deviceSource,
+}
+
+type route struct {
+	contentType string
+	typeName    string
+	handlers    []string
+}
+
+type Registry struct {
+	routes   map[string][]route
+	handlers map[string]handlerFunc
+}
+
+func NewRegistry(cfg Config) (*Registry, error) {
+	var errs []error
+
+	r := &Registry{
+		routes:   map[string][]route{},
+		handlers: newHandlerFuncs(cfg.Functions),
+	}
+
+	for _, rt := range cfg.Routes {
+		if _, ok := sources[rt.Topic]; !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrUnsupportedTopic, rt.Topic))
+			continue
+		}
+
+		handlers := []string{}
+		for _, h := range rt.Handlers {
+			h = strings.ToLower(h)
+			if _, ok := r.handlers[h]; !ok {
+				errs = append(errs, fmt.Errorf("%w: %s", ErrUnknownHandlerType, h))
+				continue
+			}
+			handlers = append(handlers, h)
+		}
+
+		r.routes[rt.Topic] = append(r.routes[rt.Topic], route{
+			contentType: strings.ToLower(rt.ContentType),
+			typeName:    strings.ToLower(rt.Type),
+			handlers:    handlers,
+		})
+	}
+
+	return r, errors.Join(errs...)
+}
+
+// Topics returns the topics that have at least one route
+func (r *Registry) Topics() []string {
+	topics := []string{}
+	for topic := range r.routes {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// Match returns the handler types that should process a message on topic with the given content type
+// sent from a function or device of type typeName. Each handler type is returned at most once.
+func (r *Registry) Match(topic, contentType, typeName string) []string {
+	handlers := []string{}
+
+	contentType = strings.ToLower(contentType)
+	typeName = strings.ToLower(typeName)
+
+	for _, rt := range r.routes[topic] {
+		if !strings.HasPrefix(contentType, rt.contentType) {
+			continue
+		}
+
+		if rt.typeName != "" && rt.typeName != typeName {
+			continue
+		}
+
+		for _, h := range rt.handlers {
+			if !slices.Contains(handlers, h) {
+				handlers = append(handlers, h)
+			}
+		}
+	}
+
+	return handlers
+}
+
+func (r *Registry) handler(handlerType string) (handlerFunc, bool) {
+	fn, ok := r.handlers[strings.ToLower(handlerType)]
+	return fn, ok
+}
+
+func functionSource(itm messaging.IncomingTopicMessage) (string, string, error) {
+	f := struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}{}
+
+	err := json.Unmarshal(itm.Body(), &f)
+	if err != nil {
+		return "", "", fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	if f.ID == "" {
+		return "", "", fmt.Errorf("ID is empty")
+	}
+
+	return f.ID, f.Type, nil
+}
+
+func deviceSource(itm messaging.IncomingTopicMessage) (string, string, error) {
+	m := struct {
+		Pack      senml.Pack `json:"pack"`
+		Timestamp time.Time  `json:"timestamp"`
+	}{}
+
+	err := json.Unmarshal(itm.Body(), &m)
+	if err != nil {
+		return "", "", fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	r, ok := m.Pack.GetRecord(senml.FindByName("0"))
+	if !ok {
+		return "", "", fmt.Errorf("package contains no deviceID")
+	}
+
+	deviceID := strings.Split(r.Name, "/")[0]
+	if deviceID == "" {
+		return "", "", fmt.Errorf("deviceID is empty")
+	}
+
+	return deviceID, "Device", nil // all message.accepted are from a "Device"
+}
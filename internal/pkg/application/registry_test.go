@@ -0,0 +1,116 @@
+package application
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDefaultConfigRoutesToHandlers(t *testing.T) {
+	is := is.New(t)
+
+	r, err := NewRegistry(DefaultConfig())
+	is.NoErr(err)
+
+	is.Equal([]string{"function.updated", "message.accepted"}, r.Topics())
+	is.Equal([]string{"wastecontainer", "sewer"}, r.Match("function.updated", "application/vnd.diwise.level.overflow+json", "level"))
+	is.Equal([]string{"combinedsewageoverflow"}, r.Match("function.updated", "application/vnd.diwise.stopwatch+json", "stopwatch"))
+	is.Equal([]string{"sewer"}, r.Match("message.accepted", "application/vnd.oma.lwm2m.ext.3330", "Device"))
+	is.Equal(0, len(r.Match("function.updated", "application/vnd.diwise.counter+json", "counter")))
+}
+
+func TestRoutesFromYamlConfig(t *testing.T) {
+	is := is.New(t)
+
+	cfg, err := ParseConfig(strings.NewReader(yamlConfig))
+	is.NoErr(err)
+
+	r, err := NewRegistry(cfg)
+	is.NoErr(err)
+
+	is.Equal([]string{"function.updated"}, r.Topics())
+	is.Equal([]string{"sewer"}, r.Match("function.updated", "application/vnd.diwise.level+json", "Level"))
+	is.Equal(0, len(r.Match("function.updated", "application/vnd.diwise.level+json", "presence")))
+	is.Equal([]string{"combinedsewageoverflow", "sewer"}, r.Match("function.updated", "application/vnd.diwise.stopwatch+json", "stopwatch"))
+}
+
+func TestRoutesFromJsonConfig(t *testing.T) {
+	is := is.New(t)
+
+	cfg, err := ParseConfig(strings.NewReader(jsonConfig))
+	is.NoErr(err)
+
+	r, err := NewRegistry(cfg)
+	is.NoErr(err)
+
+	is.Equal([]string{"wastecontainer"}, r.Match("message.accepted", "application/vnd.oma.lwm2m.ext.3303", "Device"))
+}
+
+func TestFunctionSettingsFromConfig(t *testing.T) {
+	is := is.New(t)
+
+	cfg, err := ParseConfig(strings.NewReader(yamlConfig))
+	is.NoErr(err)
+
+	is.Equal(100, cfg.Functions.CombinedSewageOverflow.Retention.MaxCount)
+	is.Equal(30*24*time.Hour, cfg.Functions.CombinedSewageOverflow.Retention.MaxAge)
+}
+
+func TestDefaultRoutesAreUsedIfNoRoutesAreConfigured(t *testing.T) {
+	is := is.New(t)
+
+	cfg, err := ParseConfig(strings.NewReader(`
+functions:
+  combinedSewageOverflow:
+    retention:
+      maxCount: 100
+`))
+	is.NoErr(err)
+
+	r, err := NewRegistry(cfg)
+	is.NoErr(err)
+
+	is.Equal(100, cfg.Functions.CombinedSewageOverflow.Retention.MaxCount)
+	is.Equal([]string{"function.updated", "message.accepted"}, r.Topics())
+	is.Equal([]string{"combinedsewageoverflow"}, r.Match("function.updated", "application/vnd.diwise.stopwatch+json", "stopwatch"))
+}
+
+func TestUnknownHandlerTypeIsAnError(t *testing.T) {
+	is := is.New(t)
+
+	_, err := NewRegistry(Config{
+		Routes: []Route{
+			{Topic: "function.updated", ContentType: "application/vnd.diwise.level", Handlers: []string{"Lighthouse"}},
+			{Topic: "thing.updated", ContentType: "application/vnd.diwise.level", Handlers: []string{"Sewer"}},
+		},
+	})
+
+	is.True(errors.Is(err, ErrUnknownHandlerType))
+	is.True(errors.Is(err, ErrUnsupportedTopic))
+}
+
+const yamlConfig string = `
+routes:
+  - topic: function.updated
+    contentType: application/vnd.diwise.level
+    type: level
+    handlers:
+      - Sewer
+  - topic: function.updated
+    contentType: application/vnd.diwise.stopwatch
+    handlers: [CombinedSewageOverflow, Sewer]
+functions:
+  combinedSewageOverflow:
+    retention:
+      maxCount: 100
+      maxAge: 720h
+`
+
+const jsonConfig string = `{
+	"routes": [
+		{"topic": "message.accepted", "contentType": "application/vnd.oma.lwm2m.ext.3303", "handlers": ["WasteContainer"]}
+	]
+}`
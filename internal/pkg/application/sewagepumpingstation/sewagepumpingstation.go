@@ -3,27 +3,113 @@ package sewagepumpingstation
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/ids"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
 	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 )
 
-var SewagePumpingStationFactory = func(id, tenant string) *SewagePumpingStation {
-	return &SewagePumpingStation{
-		ID:     id,
-		Type:   "SewagePumpingStation",
-		Tenant: tenant,
+var ErrInvalidMessage = errors.New("invalid digital input message")
+
+var SewagePumpingStationFactory = NewSewagePumpingStationFactory(Config{})
+
+func NewSewagePumpingStationFactory(cfg Config) func(id, tenant string) *SewagePumpingStation {
+	return func(id, tenant string) *SewagePumpingStation {
+		return &SewagePumpingStation{
+			ID:          id,
+			Type:        "SewagePumpingStation",
+			Tenant:      tenant,
+			retention:   cfg.Retention.withDefaults(),
+			alarmConfig: cfg.alarmsFor(id),
+		}
+	}
+}
+
+// defaultRetentionMaxAge keeps a week of pump cycles if no retention policy is configured
+const defaultRetentionMaxAge time.Duration = 7 * 24 * time.Hour
+
+// Config contains the retention policy for pump cycles, the alarm thresholds for all sewage pumping stations
+// and the thresholds that are overridden for specific sewage pumping stations by id
+type Config struct {
+	Retention RetentionPolicy         `json:"retention" yaml:"retention"`
+	Alarms    AlarmsConfig            `json:"alarms" yaml:"alarms"`
+	Stations  map[string]AlarmsConfig `json:"stations,omitempty" yaml:"stations,omitempty"`
+}
+
+type AlarmsConfig struct {
+	RunningTime    alarms.Threshold `json:"runningTime" yaml:"runningTime"`       // minutes the pump has been running
+	StateUnchanged alarms.Threshold `json:"stateUnchanged" yaml:"stateUnchanged"` // minutes since the pump started or stopped
+	CyclesPerHour  alarms.Threshold `json:"cyclesPerHour" yaml:"cyclesPerHour"`   // cycles started within the last hour, raised above the limit
+}
+
+func (cfg Config) alarmsFor(id string) AlarmsConfig {
+	a := cfg.Alarms
+
+	for stationID, override := range cfg.Stations {
+		if strings.EqualFold(stationID, id) {
+			a.RunningTime = a.RunningTime.Merge(override.RunningTime)
+			a.StateUnchanged = a.StateUnchanged.Merge(override.StateUnchanged)
+			a.CyclesPerHour = a.CyclesPerHour.Merge(override.CyclesPerHour)
+		}
+	}
+
+	return a
+}
+
+const (
+	LongRunningAlarm    string = "longRunning"
+	StateUnchangedAlarm string = "stateUnchanged"
+	FrequentCyclesAlarm string = "frequentCycles"
+)
+
+// RetentionPolicy limits the number of ended pump cycles that are kept in Cycles. All cycles are kept in the
+// pump cycle event store. MaxAge defaults to 7 days if neither MaxCount nor MaxAge is set.
+type RetentionPolicy struct {
+	MaxCount int           `json:"maxCount" yaml:"maxCount"` // keep at most the last MaxCount cycles
+	MaxAge   time.Duration `json:"maxAge" yaml:"maxAge"`     // keep cycles that ended within MaxAge
+}
+
+func (r RetentionPolicy) withDefaults() RetentionPolicy {
+	if r.MaxCount <= 0 && r.MaxAge <= 0 {
+		r.MaxAge = defaultRetentionMaxAge
 	}
+	return r
 }
 
 type SewagePumpingStation struct {
-	ID                   string        `json:"id"`
-	Type                 string        `json:"type"`
-	State                bool          `json:"state"`
-	Tenant               string        `json:"tenant"`
-	ObservedAt           *time.Time    `json:"observedAt"`
-	SewagePumpingStation *things.Thing `json:"sewagepumpingstation,omitempty"`
+	ID                    string        `json:"id"`
+	Type                  string        `json:"type"`
+	State                 bool          `json:"state"`
+	Tenant                string        `json:"tenant"`
+	ObservedAt            *time.Time    `json:"observedAt"`                      // time when the state last changed
+	Cycles                []Cycle       `json:"cycles,omitempty"`                // pump cycles within the retention policy
+	CycleCount            int           `json:"cycleCount"`                      // number of cycles started since the pump was first observed
+	CyclesPerDay          int           `json:"cyclesPerDay"`                    // number of cycles started within 24 hours before ObservedAt
+	CumulativeRunningTime time.Duration `json:"cumulativeRunningTime"`           // total running time of all cycles
+	HistoricalRunningTime time.Duration `json:"historicalRunningTime,omitempty"` // total running time of cycles removed by the retention policy
+	LastRun               *time.Time    `json:"lastRun,omitempty"`               // time when the pump last stopped
+	Alarms                alarms.Alarms `json:"alarms,omitempty"`                // alarms by name, longRunning, stateUnchanged and frequentCycles
+	SewagePumpingStation  *things.Thing `json:"sewagepumpingstation,omitempty"`
+
+	retention     RetentionPolicy
+	alarmConfig   AlarmsConfig
+	updatedCycles []Cycle          // cycles started or stopped by the last handled message
+	updatedAlarms []alarms.Message // alarms raised or cleared by the last handled message
+}
+
+// Cycle is a single run of the pump, from when the digital input turned on until it turned off
+type Cycle struct {
+	ID        string        `json:"id"`
+	StartTime time.Time     `json:"startTime"`
+	StopTime  *time.Time    `json:"stopTime,omitempty"`
+	Duration  time.Duration `json:"duration"`
 }
 
 func (sp SewagePumpingStation) Body() []byte {
@@ -36,6 +122,16 @@ func (sp SewagePumpingStation) Body() []byte {
 	return bytes
 }
 
+// TimeSinceLastRun returns the time from when the pump last stopped until now, or zero if the pump is running or has
+// not been observed to stop. It is not stored, since it changes all the time while the pump is idle.
+func (sp SewagePumpingStation) TimeSinceLastRun(now time.Time) time.Duration {
+	if sp.State || sp.LastRun == nil || now.Before(*sp.LastRun) {
+		return 0
+	}
+
+	return now.Sub(*sp.LastRun)
+}
+
 func (sp SewagePumpingStation) TopicName() string {
 	return "cip-function.updated"
 }
@@ -44,25 +140,57 @@ func (sp SewagePumpingStation) ContentType() string {
 	return "application/vnd.diwise.sewagepumpingstation+json"
 }
 
+// Handle updates the state from a digital input. Only a change of state, i.e. when the pump starts or stops, or of an
+// alarm is regarded as a change. Observations that are older than the current state are ignored, and malformed
+// messages are rejected. Alarms are evaluated for every observation, also when the state is unchanged.
 func (sp *SewagePumpingStation) Handle(ctx context.Context, itm messaging.IncomingTopicMessage, tc things.Client) (bool, error) {
+	log := logging.GetFromContext(ctx)
 
 	m := struct {
 		ID           string    `json:"id"`
 		Tenant       string    `json:"tenant,omitempty"`
 		Timestamp    time.Time `json:"timestamp,omitempty"`
-		DigitalInput struct {
+		DigitalInput *struct {
 			Timestamp string `json:"timestamp"`
-			State     bool   `json:"state"`
-		}
+			State     *bool  `json:"state"`
+		} `json:"digitalinput"`
 	}{}
 
-	json.Unmarshal(itm.Body(), &m)
+	err := json.Unmarshal(itm.Body(), &m)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	if m.DigitalInput == nil || m.DigitalInput.State == nil {
+		return false, fmt.Errorf("%w: no digital input state", ErrInvalidMessage)
+	}
+
+	ts, err := observedAt(m.DigitalInput.Timestamp, m.Timestamp)
+	if err != nil {
+		return false, err
+	}
+
+	state := *m.DigitalInput.State
+
+	sp.updatedCycles = nil
+	sp.updatedAlarms = nil
+
+	if sp.ObservedAt != nil && ts.Before(*sp.ObservedAt) {
+		log.Debug("digital input was observed before the current state, will ignore message")
+		return false, nil
+	}
+
+	changed := false
 
-	changed := sp.State != m.DigitalInput.State || sp.ObservedAt != &m.Timestamp
+	if sp.ObservedAt == nil || sp.State != state {
+		sp.State = state
+		sp.ObservedAt = &ts
+		sp.observeCycle(state, ts)
+		changed = true
+	}
 
-	if changed {
-		sp.State = m.DigitalInput.State
-		sp.ObservedAt = &m.Timestamp
+	if sp.evaluateAlarms(ts) {
+		changed = true
 	}
 
 	if sp.Tenant == "" && m.Tenant != "" {
@@ -78,3 +206,150 @@ func (sp *SewagePumpingStation) Handle(ctx context.Context, itm messaging.Incomi
 
 	return changed, nil
 }
+
+// observedAt returns the time of the digital input, or the time of the message if the digital input has no time
+func observedAt(digitalInputTimestamp string, messageTimestamp time.Time) (time.Time, error) {
+	if digitalInputTimestamp != "" {
+		ts, err := time.Parse(time.RFC3339Nano, digitalInputTimestamp)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid digital input timestamp %s", ErrInvalidMessage, digitalInputTimestamp)
+		}
+		return ts.UTC(), nil
+	}
+
+	if !messageTimestamp.IsZero() {
+		return messageTimestamp.UTC(), nil
+	}
+
+	return time.Now().UTC(), nil
+}
+
+// Evaluate evaluates the alarms as of now without an incoming message, so that alarms that depend on how much time
+// has passed, such as a pump that keeps running or a state that does not change, are raised and cleared even if no
+// more messages are received. Returns true if any alarm was raised or cleared, or started or stopped waiting for
+// its minimum duration.
+func (sp *SewagePumpingStation) Evaluate(now time.Time) bool {
+	sp.updatedCycles = nil
+	sp.updatedAlarms = nil
+
+	if sp.ObservedAt == nil || now.Before(*sp.ObservedAt) {
+		return false
+	}
+
+	return sp.evaluateAlarms(now.UTC())
+}
+
+// UpdatedCycles returns the cycles that were started or stopped by the last call to Handle,
+// including cycles that were removed from Cycles by the retention policy
+func (sp SewagePumpingStation) UpdatedCycles() []Cycle {
+	return slices.Clone(sp.updatedCycles)
+}
+
+// UpdatedAlarms returns messages about the alarms that were raised or cleared by the last call to Handle
+func (sp SewagePumpingStation) UpdatedAlarms() []alarms.Message {
+	return slices.Clone(sp.updatedAlarms)
+}
+
+// evaluateAlarms evaluates for how long the pump has been running, for how long the state has been unchanged and
+// the number of cycles within the last hour, as of ts, against the configured thresholds. Returns true if any
+// alarm was raised or cleared, or started or stopped waiting for its minimum duration.
+func (sp *SewagePumpingStation) evaluateAlarms(ts time.Time) bool {
+	var runningTime, stateUnchanged time.Duration
+	cyclesPerHour := 0
+
+	for _, c := range sp.Cycles {
+		if c.StopTime == nil && sp.State {
+			runningTime = ts.Sub(c.StartTime)
+		}
+		if !c.StartTime.After(ts) && ts.Sub(c.StartTime) < time.Hour {
+			cyclesPerHour++
+		}
+	}
+
+	if sp.ObservedAt != nil {
+		stateUnchanged = ts.Sub(*sp.ObservedAt)
+	}
+
+	changed := sp.evaluateAlarm(LongRunningAlarm, sp.alarmConfig.RunningTime, runningTime.Minutes(), ts)
+	changed = sp.evaluateAlarm(StateUnchangedAlarm, sp.alarmConfig.StateUnchanged, stateUnchanged.Minutes(), ts) || changed
+	changed = sp.evaluateAlarm(FrequentCyclesAlarm, sp.alarmConfig.CyclesPerHour.Above(), float64(cyclesPerHour), ts) || changed
+
+	return changed
+}
+
+// evaluateAlarm returns true if the alarm was raised or cleared, or if it started or stopped waiting for its
+// minimum duration. Changes of the value alone are not regarded as changes, so that they are not published.
+func (sp *SewagePumpingStation) evaluateAlarm(name string, t alarms.Threshold, value float64, ts time.Time) bool {
+	pendingBefore := sp.Alarms[name].PendingSince
+
+	transitioned, _ := sp.Alarms.Evaluate(name, t, value, ts)
+	if transitioned {
+		sp.updatedAlarms = append(sp.updatedAlarms, alarms.NewMessage(sp.ID, sp.Type, sp.Tenant, name, sp.Alarms[name], ts))
+		return true
+	}
+
+	pendingAfter := sp.Alarms[name].PendingSince
+
+	return (pendingBefore == nil) != (pendingAfter == nil)
+}
+
+// observeCycle starts a cycle when the pump starts and stops the ongoing cycle when the pump stops,
+// and computes the statistics as of ts
+func (sp *SewagePumpingStation) observeCycle(running bool, ts time.Time) {
+	i := slices.IndexFunc(sp.Cycles, func(c Cycle) bool { return c.StopTime == nil })
+
+	switch {
+	case running && i < 0:
+		sp.Cycles = append(sp.Cycles, Cycle{ID: cycleID(sp.ID, ts), StartTime: ts})
+		sp.CycleCount++
+		sp.updatedCycles = append(sp.updatedCycles, sp.Cycles[len(sp.Cycles)-1])
+	case !running && i >= 0 && !ts.Before(sp.Cycles[i].StartTime):
+		sp.Cycles[i].StopTime = &ts
+		sp.Cycles[i].Duration = ts.Sub(sp.Cycles[i].StartTime)
+		sp.LastRun = &ts
+		sp.updatedCycles = append(sp.updatedCycles, sp.Cycles[i])
+	case !running && sp.LastRun == nil:
+		// the pump has not been observed running yet, it is regarded as stopped since the first observation
+		sp.LastRun = &ts
+	}
+
+	sp.compact(ts)
+
+	sp.CumulativeRunningTime = sp.HistoricalRunningTime
+	sp.CyclesPerDay = 0
+
+	for _, c := range sp.Cycles {
+		sp.CumulativeRunningTime += c.Duration
+		if !c.StartTime.After(ts) && ts.Sub(c.StartTime) < 24*time.Hour {
+			sp.CyclesPerDay++
+		}
+	}
+}
+
+// compact removes ended cycles that are outside of the retention policy. The running time of each
+// removed cycle is added to HistoricalRunningTime so that CumulativeRunningTime is unaffected.
+func (sp *SewagePumpingStation) compact(now time.Time) {
+	retention := sp.retention.withDefaults()
+
+	kept := make([]Cycle, 0, len(sp.Cycles))
+
+	for i, c := range sp.Cycles {
+		tooMany := retention.MaxCount > 0 && i < len(sp.Cycles)-retention.MaxCount
+		tooOld := retention.MaxAge > 0 && c.StopTime != nil && now.Sub(*c.StopTime) > retention.MaxAge
+
+		if c.StopTime == nil || !(tooMany || tooOld) {
+			kept = append(kept, c)
+			continue
+		}
+
+		sp.HistoricalRunningTime += c.Duration
+	}
+
+	sp.Cycles = kept
+}
+
+// cycleID is derived from the pumping station and the start time of the cycle so that
+// a cycle that is started again, i.e. when a message is redelivered, gets the same id
+func cycleID(id string, ts time.Time) string {
+	return ids.DeterministicUUID(fmt.Sprintf("%s:%d", id, ts.UnixNano()))
+}
@@ -0,0 +1,292 @@
+package sewagepumpingstation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/things"
+	"github.com/matryer/is"
+)
+
+type digitalInputMessage []byte
+
+func (m digitalInputMessage) Body() []byte {
+	return m
+}
+func (m digitalInputMessage) ContentType() string {
+	return "application/vnd.diwise.digitalinput+json"
+}
+func (m digitalInputMessage) TopicName() string {
+	return "function.updated"
+}
+
+func newDigitalInputMessage(state bool, ts time.Time) digitalInputMessage {
+	return digitalInputMessage(fmt.Sprintf(`{"id":"di:1","type":"digitalinput","digitalinput":{"timestamp":"%s","state":%t},"timestamp":"%s"}`, ts.Format(time.RFC3339), state, ts.Format(time.RFC3339)))
+}
+
+var tc = &things.ClientMock{
+	FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		return things.Thing{ID: id, Type: "SewagePumpingStation"}, nil
+	},
+}
+
+func TestPumpCycles(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := SewagePumpingStationFactory("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	sp.Handle(ctx, newDigitalInputMessage(false, start), tc)
+	is.Equal(0, len(sp.Cycles))
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start.Add(time.Hour)), tc)
+	is.Equal(1, len(sp.Cycles))
+	is.Equal(1, len(sp.UpdatedCycles()))
+	is.Equal(1, sp.CycleCount)
+	is.Equal(start, *sp.LastRun) // the pump was stopped when it was first observed
+
+	sp.Handle(ctx, newDigitalInputMessage(false, start.Add(70*time.Minute)), tc)
+	is.Equal(start.Add(70*time.Minute), *sp.Cycles[0].StopTime)
+	is.Equal(10*time.Minute, sp.Cycles[0].Duration)
+	is.Equal(start.Add(70*time.Minute), *sp.LastRun)
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start.Add(2*time.Hour)), tc)
+	is.Equal(start.Add(70*time.Minute), *sp.LastRun) // last run is kept while the pump is running
+
+	sp.Handle(ctx, newDigitalInputMessage(false, start.Add(2*time.Hour+20*time.Minute)), tc)
+
+	is.Equal(2, len(sp.Cycles))
+	is.Equal(2, sp.CycleCount)
+	is.Equal(2, sp.CyclesPerDay)
+	is.Equal(30*time.Minute, sp.CumulativeRunningTime)
+	is.Equal(cycleID("sps:1", start.Add(2*time.Hour)), sp.Cycles[1].ID)
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start.Add(25*time.Hour+5*time.Minute)), tc)
+	is.Equal(2, sp.CyclesPerDay) // the first cycle started more than 24 hours ago
+}
+
+func TestOnlyChangesOfStateAreChanges(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := SewagePumpingStationFactory("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	changed, err := sp.Handle(ctx, newDigitalInputMessage(true, start), tc)
+	is.NoErr(err)
+	is.True(changed)
+
+	changed, err = sp.Handle(ctx, newDigitalInputMessage(true, start), tc)
+	is.NoErr(err)
+	is.True(!changed) // the same message again
+
+	changed, err = sp.Handle(ctx, newDigitalInputMessage(true, start.Add(time.Minute)), tc)
+	is.NoErr(err)
+	is.True(!changed) // the pump is still running
+	is.Equal(start, *sp.ObservedAt)
+
+	changed, err = sp.Handle(ctx, newDigitalInputMessage(false, start.Add(10*time.Minute)), tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(start.Add(10*time.Minute), *sp.ObservedAt)
+}
+
+func TestDigitalInputTimestampIsUsed(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := SewagePumpingStationFactory("sps:1", "default")
+
+	changed, err := sp.Handle(ctx, digitalInputMessage(`{"id":"di:1","digitalinput":{"timestamp":"2024-08-08T11:58:00Z","state":true},"timestamp":"2024-08-08T12:00:00Z"}`), tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.Equal(time.Date(2024, 8, 8, 11, 58, 0, 0, time.UTC), *sp.ObservedAt)
+
+	_, err = sp.Handle(ctx, digitalInputMessage(`{"id":"di:1","digitalinput":{"state":false},"timestamp":"2024-08-08T12:10:00Z"}`), tc)
+	is.NoErr(err)
+	is.Equal(time.Date(2024, 8, 8, 12, 10, 0, 0, time.UTC), *sp.ObservedAt) // the time of the message if the digital input has none
+}
+
+func TestOutOfOrderObservationIsIgnored(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := SewagePumpingStationFactory("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start), tc)
+	changed, err := sp.Handle(ctx, newDigitalInputMessage(false, start.Add(-time.Minute)), tc)
+
+	is.NoErr(err)
+	is.True(!changed)
+	is.True(sp.State)
+	is.Equal(0, len(sp.UpdatedCycles()))
+}
+
+func TestMalformedMessageIsRejected(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	for _, body := range []string{
+		`{"id":"di:1","digitalinput":`,
+		`{"id":"di:1","timestamp":"2024-08-08T12:00:00Z"}`,
+		`{"id":"di:1","digitalinput":{"timestamp":"2024-08-08T12:00:00Z"}}`,
+		`{"id":"di:1","digitalinput":{"timestamp":"yesterday","state":true}}`,
+	} {
+		sp := SewagePumpingStationFactory("sps:1", "default")
+
+		changed, err := sp.Handle(ctx, digitalInputMessage(body), tc)
+		is.True(errors.Is(err, ErrInvalidMessage))
+		is.True(!changed)
+	}
+}
+
+func TestRetentionPolicyKeepsCumulativeRunningTime(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := NewSewagePumpingStationFactory(Config{Retention: RetentionPolicy{MaxCount: 2}})("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	for i := range 4 {
+		cycleStart := start.Add(time.Duration(i) * time.Hour)
+		sp.Handle(ctx, newDigitalInputMessage(true, cycleStart), tc)
+		sp.Handle(ctx, newDigitalInputMessage(false, cycleStart.Add(15*time.Minute)), tc)
+	}
+
+	is.Equal(2, len(sp.Cycles))
+	is.Equal(4, sp.CycleCount)
+	is.Equal(30*time.Minute, sp.HistoricalRunningTime)
+	is.Equal(time.Hour, sp.CumulativeRunningTime)
+}
+
+func TestLongRunningPumpRaisesAlarm(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := NewSewagePumpingStationFactory(Config{
+		Alarms: AlarmsConfig{RunningTime: alarms.Threshold{}.WithLimit(30)},
+	})("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start), tc)
+
+	changed, err := sp.Handle(ctx, newDigitalInputMessage(true, start.Add(20*time.Minute)), tc)
+	is.NoErr(err)
+	is.True(!changed) // running for 20 minutes is below the limit
+
+	changed, err = sp.Handle(ctx, newDigitalInputMessage(true, start.Add(40*time.Minute)), tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.True(sp.Alarms[LongRunningAlarm].Active)
+	is.Equal(start, *sp.ObservedAt) // the state itself is unchanged
+
+	is.Equal(1, len(sp.UpdatedAlarms()))
+	m := sp.UpdatedAlarms()[0]
+	is.Equal(LongRunningAlarm, m.Alarm)
+	is.Equal(40.0, m.Value)
+	is.Equal("application/vnd.diwise.sewagepumpingstation.alarm+json", m.ContentType())
+
+	changed, _ = sp.Handle(ctx, newDigitalInputMessage(false, start.Add(45*time.Minute)), tc)
+	is.True(changed)
+	is.True(!sp.Alarms[LongRunningAlarm].Active)
+	is.Equal(1, len(sp.UpdatedAlarms()))
+}
+
+func TestAlarmsAreRaisedWithoutMoreMessages(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := NewSewagePumpingStationFactory(Config{
+		Alarms: AlarmsConfig{
+			RunningTime:    alarms.Threshold{}.WithLimit(30),
+			StateUnchanged: alarms.Threshold{}.WithLimit(60),
+		},
+	})("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	sp.Handle(ctx, newDigitalInputMessage(true, start), tc)
+
+	is.True(!sp.Evaluate(start.Add(-time.Minute))) // evaluations before the current state are ignored
+	is.True(!sp.Evaluate(start.Add(20 * time.Minute)))
+
+	is.True(sp.Evaluate(start.Add(40 * time.Minute)))
+	is.True(sp.Alarms[LongRunningAlarm].Active)
+	is.True(!sp.Alarms[StateUnchangedAlarm].Active)
+	is.Equal(1, len(sp.UpdatedAlarms()))
+
+	is.True(sp.Evaluate(start.Add(90 * time.Minute)))
+	is.True(sp.Alarms[StateUnchangedAlarm].Active)
+	is.Equal(1, len(sp.UpdatedAlarms()))
+	is.Equal(StateUnchangedAlarm, sp.UpdatedAlarms()[0].Alarm)
+}
+
+func TestUnchangedStateRaisesAlarmAfterMinDuration(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := NewSewagePumpingStationFactory(Config{
+		Alarms: AlarmsConfig{StateUnchanged: alarms.Threshold{MinDuration: time.Hour}.WithLimit(6 * 60)},
+	})("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	sp.Handle(ctx, newDigitalInputMessage(false, start), tc)
+
+	changed, _ := sp.Handle(ctx, newDigitalInputMessage(false, start.Add(6*time.Hour)), tc)
+	is.True(changed) // the alarm is pending, which must be stored
+	is.True(!sp.Alarms[StateUnchangedAlarm].Active)
+
+	changed, _ = sp.Handle(ctx, newDigitalInputMessage(false, start.Add(6*time.Hour+30*time.Minute)), tc)
+	is.True(!changed)
+
+	changed, _ = sp.Handle(ctx, newDigitalInputMessage(false, start.Add(7*time.Hour)), tc)
+	is.True(changed)
+	is.True(sp.Alarms[StateUnchangedAlarm].Active)
+}
+
+func TestFrequentCyclesRaiseAlarm(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	sp := NewSewagePumpingStationFactory(Config{
+		Alarms: AlarmsConfig{CyclesPerHour: alarms.Threshold{}.WithLimit(10)},
+		Stations: map[string]AlarmsConfig{
+			"sps:1": {CyclesPerHour: alarms.Threshold{}.WithLimit(3)},
+		},
+	})("sps:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	for i := range 4 {
+		cycleStart := start.Add(time.Duration(i) * 10 * time.Minute)
+		sp.Handle(ctx, newDigitalInputMessage(true, cycleStart), tc)
+		sp.Handle(ctx, newDigitalInputMessage(false, cycleStart.Add(5*time.Minute)), tc)
+
+		// the alarm is raised when the pump has started more than 3 times within an hour
+		is.Equal(i == 3, sp.Alarms[FrequentCyclesAlarm].Active)
+	}
+
+	is.Equal(3.0, sp.Alarms[FrequentCyclesAlarm].Limit) // the limit is overridden for the station
+
+	sp.Handle(ctx, newDigitalInputMessage(false, start.Add(2*time.Hour)), tc)
+	is.True(!sp.Alarms[FrequentCyclesAlarm].Active)
+}
+
+func TestTimeSinceLastRunIsCountedFromLastRun(t *testing.T) {
+	is := is.New(t)
+
+	lastRun := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+	sp := SewagePumpingStation{LastRun: &lastRun}
+
+	is.Equal(90*time.Minute, sp.TimeSinceLastRun(lastRun.Add(90*time.Minute)))
+
+	sp.State = true
+	is.Equal(time.Duration(0), sp.TimeSinceLastRun(lastRun.Add(90*time.Minute))) // the pump is running
+
+	sp = SewagePumpingStation{}
+	is.Equal(time.Duration(0), sp.TimeSinceLastRun(lastRun))
+}
@@ -5,22 +5,61 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/senml"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 )
 
-var SewerFactory = func(id, tenant string) *Sewer {
-	return &Sewer{
-		ID:     id,
-		Type:   "Sewer",
-		Tenant: tenant,
+var SewerFactory = NewSewerFactory(Config{})
+
+func NewSewerFactory(cfg Config) func(id, tenant string) *Sewer {
+	return func(id, tenant string) *Sewer {
+		return &Sewer{
+			ID:          id,
+			Type:        "Sewer",
+			Tenant:      tenant,
+			alarmConfig: cfg.alarmsFor(id),
+		}
 	}
 }
 
+// Config contains the alarm thresholds for all sewers, and the thresholds that are overridden for specific sewers
+// by id. Limits can also be set on the related sewer thing with the properties maxLevel and alarmPercent.
+type Config struct {
+	Alarms AlarmsConfig            `json:"alarms" yaml:"alarms"`
+	Sewers map[string]AlarmsConfig `json:"sewers,omitempty" yaml:"sewers,omitempty"`
+}
+
+type AlarmsConfig struct {
+	Level   alarms.Threshold `json:"level" yaml:"level"`
+	Percent alarms.Threshold `json:"percent" yaml:"percent"`
+}
+
+func (cfg Config) alarmsFor(id string) AlarmsConfig {
+	a := cfg.Alarms
+
+	for sewerID, override := range cfg.Sewers {
+		if strings.EqualFold(sewerID, id) {
+			a.Level = a.Level.Merge(override.Level)
+			a.Percent = a.Percent.Merge(override.Percent)
+		}
+	}
+
+	return a
+}
+
+const (
+	HighLevelAlarm   string = "highLevel"
+	HighPercentAlarm string = "highPercent"
+)
+
 type Sewer struct {
 	ID               string        `json:"id"`
 	Type             string        `json:"type"`
@@ -33,7 +72,11 @@ type Sewer struct {
 	PercentObserved  *time.Time    `json:"percentObserved,omitempty"`
 	DateObserved     time.Time     `json:"dateObserved"`
 	Tenant           string        `json:"tenant"`
+	Alarms           alarms.Alarms `json:"alarms,omitempty"` // alarms by name, highLevel and highPercent
 	Sewer            *things.Thing `json:"sewer,omitempty"`
+
+	alarmConfig   AlarmsConfig
+	updatedAlarms []alarms.Message // alarms raised or cleared by the last handled message
 }
 
 func (s Sewer) TopicName() string {
@@ -84,10 +127,11 @@ func (s *Sewer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage,
 		return false, nil
 	}
 
-	if s.Sewer == nil {
-		if t, err := tc.FindByID(ctx, s.ID, "Sewer"); err == nil {
-			s.Sewer = &t
-		}
+	s.updatedAlarms = nil
+
+	// the related sewer is fetched for every message so that changes to its alarm limits are used
+	if t, err := tc.FindByID(ctx, s.ID, "Sewer"); err == nil {
+		s.Sewer = &t
 	}
 
 	// 1:1 device:sewer is a limitation
@@ -95,6 +139,9 @@ func (s *Sewer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage,
 		s.DeviceID = m.DeviceID
 	}
 
+	// time of the level observation that alarms should be evaluated for, if any
+	var alarmTime *time.Time
+
 	if m.Pack != nil {
 		sensorValue, recOk := m.Pack.GetRecord(senml.FindByName("5700"))
 		if recOk {
@@ -107,18 +154,34 @@ func (s *Sewer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage,
 				}
 			}
 
+			observed := time.Now().UTC()
+			if timeOk {
+				observed = ts
+			}
+
 			distance, valueOk := sensorValue.GetValue()
 			if valueOk {
 				if !eq(s.Distance, &distance) {
 					s.Distance = &distance
-					if timeOk {
-						s.DistanceObserved = &ts
-					} else {
-						now := time.Now().UTC()
-						s.DistanceObserved = &now
-					}
+					s.DistanceObserved = &observed
 					changed = true
 				}
+
+				if level, percent, ok := s.levelFromDistance(distance); ok {
+					if !eq(&s.Level, &level) {
+						s.Level = level
+						s.LevelObserved = &observed
+						changed = true
+					}
+
+					if percent != nil && !eq(s.Percent, percent) {
+						s.Percent = percent
+						s.PercentObserved = &observed
+						changed = true
+					}
+
+					alarmTime = &observed
+				}
 			}
 
 			if urn, ok := m.Pack.GetStringValue(senml.FindByName("0")); ok {
@@ -148,6 +211,14 @@ func (s *Sewer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage,
 			s.DateObserved = m.Timestamp
 			changed = true
 		}
+
+		alarmTime = &m.Timestamp
+	}
+
+	if alarmTime != nil {
+		if s.evaluateAlarms(*alarmTime) {
+			changed = true
+		}
 	}
 
 	if s.DateObserved.IsZero() {
@@ -163,3 +234,86 @@ func (s *Sewer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage,
 
 	return changed, nil
 }
+
+// levelFromDistance derives the level from a distance measured by a sensor that is mounted mountingHeight above
+// the bottom of the sewer, or at maxDepth if mountingHeight is not set. The percent is derived if overflowLevel,
+// which is 100%, or maxDepth is set. Properties are read from the related sewer thing.
+func (s *Sewer) levelFromDistance(distance float64) (float64, *float64, bool) {
+	if s.Sewer == nil {
+		return 0, nil, false
+	}
+
+	maxDepth, hasMaxDepth := floatProperty(s.Sewer.Properties, "maxDepth")
+
+	height, ok := floatProperty(s.Sewer.Properties, "mountingHeight")
+	if !ok {
+		if !hasMaxDepth {
+			return 0, nil, false
+		}
+		height = maxDepth
+	}
+
+	level := math.Max(height-distance, 0)
+
+	full, ok := floatProperty(s.Sewer.Properties, "overflowLevel")
+	if !ok {
+		full, ok = maxDepth, hasMaxDepth
+	}
+
+	if !ok || full <= 0 {
+		return level, nil, true
+	}
+
+	percent := level / full * 100
+
+	return level, &percent, true
+}
+
+// UpdatedAlarms returns messages about the alarms that were raised or cleared by the last call to Handle
+func (s Sewer) UpdatedAlarms() []alarms.Message {
+	return slices.Clone(s.updatedAlarms)
+}
+
+// evaluateAlarms evaluates the current level and percent against the configured thresholds,
+// using the limits set on the related sewer thing if there are any. Returns true if any alarm changed.
+func (s *Sewer) evaluateAlarms(ts time.Time) bool {
+	cfg := s.alarmConfig
+
+	if s.Sewer != nil {
+		if maxLevel, ok := floatProperty(s.Sewer.Properties, "maxLevel"); ok {
+			cfg.Level = cfg.Level.WithLimit(maxLevel)
+		}
+		if alarmPercent, ok := floatProperty(s.Sewer.Properties, "alarmPercent"); ok {
+			cfg.Percent = cfg.Percent.WithLimit(alarmPercent)
+		}
+	}
+
+	changed := s.evaluateAlarm(HighLevelAlarm, cfg.Level, s.Level, ts)
+
+	if s.Percent != nil {
+		changed = s.evaluateAlarm(HighPercentAlarm, cfg.Percent, *s.Percent, ts) || changed
+	}
+
+	return changed
+}
+
+func (s *Sewer) evaluateAlarm(name string, t alarms.Threshold, value float64, ts time.Time) bool {
+	transitioned, changed := s.Alarms.Evaluate(name, t, value, ts)
+	if transitioned {
+		s.updatedAlarms = append(s.updatedAlarms, alarms.NewMessage(s.ID, s.Type, s.Tenant, name, s.Alarms[name], ts))
+	}
+
+	return changed
+}
+
+func floatProperty(properties map[string]any, key string) (float64, bool) {
+	switch v := properties[key].(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,191 @@
+package sewer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/things"
+	"github.com/matryer/is"
+)
+
+type levelMessage struct {
+	ID    string `json:"id"`
+	Level struct {
+		Current float64  `json:"current"`
+		Percent *float64 `json:"percent,omitempty"`
+	} `json:"level"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (m levelMessage) Body() []byte {
+	b, _ := json.Marshal(m)
+	return b
+}
+func (m levelMessage) ContentType() string {
+	return "application/vnd.diwise.level+json"
+}
+func (m levelMessage) TopicName() string {
+	return "function.updated"
+}
+
+func newLevelMessage(current float64, ts time.Time) levelMessage {
+	m := levelMessage{ID: "level:1", Timestamp: ts}
+	m.Level.Current = current
+	return m
+}
+
+func testClient(properties map[string]any) *things.ClientMock {
+	return &things.ClientMock{
+		FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+			return things.Thing{ID: id, Type: "Sewer", Properties: properties}, nil
+		},
+	}
+}
+
+func TestLevelAlarmUsesThresholdFromConfig(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{
+		Alarms: AlarmsConfig{
+			Level: alarms.Threshold{Hysteresis: 0.2, MinDuration: 10 * time.Minute}.WithLimit(2.0),
+		},
+	}
+
+	s := NewSewerFactory(cfg)("sewer:1", "default")
+	tc := testClient(nil)
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	_, err := s.Handle(ctx, newLevelMessage(2.1, start), tc)
+	is.NoErr(err)
+	is.Equal(0, len(s.UpdatedAlarms()))
+
+	_, err = s.Handle(ctx, newLevelMessage(2.2, start.Add(10*time.Minute)), tc)
+	is.NoErr(err)
+	is.Equal(1, len(s.UpdatedAlarms()))
+	is.True(s.UpdatedAlarms()[0].Active)
+	is.Equal(HighLevelAlarm, s.UpdatedAlarms()[0].Alarm)
+	is.True(s.Alarms[HighLevelAlarm].Active)
+
+	_, err = s.Handle(ctx, newLevelMessage(1.7, start.Add(15*time.Minute)), tc)
+	is.NoErr(err)
+	is.Equal(0, len(s.UpdatedAlarms())) // should not be cleared before min duration
+
+	_, err = s.Handle(ctx, newLevelMessage(1.7, start.Add(25*time.Minute)), tc)
+	is.NoErr(err)
+	is.Equal(1, len(s.UpdatedAlarms()))
+	is.True(!s.UpdatedAlarms()[0].Active)
+}
+
+func TestThresholdsFromThingAndConfigOverrides(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{
+		Alarms: AlarmsConfig{
+			Level: alarms.Threshold{}.WithLimit(2.0),
+		},
+		Sewers: map[string]AlarmsConfig{
+			"sewer:1": {Level: alarms.Threshold{}.WithLimit(1.0)},
+		},
+	}
+
+	s := NewSewerFactory(cfg)("sewer:1", "default")
+	_, err := s.Handle(ctx, newLevelMessage(1.5, time.Now()), testClient(nil))
+	is.NoErr(err)
+	is.True(s.Alarms[HighLevelAlarm].Active) // the override for sewer:1 should be used
+
+	s = NewSewerFactory(cfg)("sewer:2", "default")
+	_, err = s.Handle(ctx, newLevelMessage(1.5, time.Now()), testClient(map[string]any{"maxLevel": 1.2}))
+	is.NoErr(err)
+	is.True(s.Alarms[HighLevelAlarm].Active) // maxLevel on the thing should be used
+	is.Equal(1.2, s.Alarms[HighLevelAlarm].Limit)
+}
+
+func TestNoAlarmsWithoutThresholds(t *testing.T) {
+	is := is.New(t)
+
+	s := SewerFactory("sewer:1", "default")
+	_, err := s.Handle(context.Background(), newLevelMessage(100, time.Now()), testClient(nil))
+	is.NoErr(err)
+	is.Equal(0, len(s.Alarms))
+	is.Equal(0, len(s.UpdatedAlarms()))
+}
+
+type rawMessage []byte
+
+func (m rawMessage) Body() []byte {
+	return m
+}
+func (m rawMessage) ContentType() string {
+	return "application/vnd.oma.lwm2m.ext.3330"
+}
+func (m rawMessage) TopicName() string {
+	return "message.accepted"
+}
+
+func newDistanceMessage(distance float64, ts time.Time) rawMessage {
+	return rawMessage(fmt.Sprintf(`{"pack":[{"bn":"dev:1/3330/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:3330"},{"n":"5700","v":%g}],"timestamp":"%s"}`, ts.Unix(), distance, ts.Format(time.RFC3339)))
+}
+
+func TestLevelAndPercentAreDerivedFromDistance(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	ts := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	s := SewerFactory("sewer:1", "default")
+	tc := testClient(map[string]any{"mountingHeight": 3.0, "maxDepth": 3.5, "overflowLevel": "2.0"})
+
+	_, err := s.Handle(ctx, newDistanceMessage(2.0, ts), tc)
+	is.NoErr(err)
+
+	is.Equal(2.0, *s.Distance)
+	is.Equal(1.0, s.Level)
+	is.Equal(ts, *s.LevelObserved)
+	is.Equal(50.0, *s.Percent)
+	is.Equal(ts, *s.PercentObserved)
+}
+
+func TestPercentIsDerivedFromMaxDepth(t *testing.T) {
+	is := is.New(t)
+
+	s := SewerFactory("sewer:1", "default")
+	tc := testClient(map[string]any{"maxDepth": 4.0})
+
+	_, err := s.Handle(context.Background(), newDistanceMessage(3.0, time.Now()), tc)
+	is.NoErr(err)
+
+	is.Equal(1.0, s.Level)
+	is.Equal(25.0, *s.Percent)
+}
+
+func TestDistanceWithoutGeometryOnlyStoresDistance(t *testing.T) {
+	is := is.New(t)
+
+	s := SewerFactory("sewer:1", "default")
+
+	_, err := s.Handle(context.Background(), newDistanceMessage(3.0, time.Now()), testClient(nil))
+	is.NoErr(err)
+
+	is.Equal(3.0, *s.Distance)
+	is.Equal(0.0, s.Level)
+	is.Equal(nil, s.Percent)
+}
+
+func TestAlarmIsRaisedForDerivedLevel(t *testing.T) {
+	is := is.New(t)
+
+	s := NewSewerFactory(Config{Alarms: AlarmsConfig{Percent: alarms.Threshold{}.WithLimit(90)}})("sewer:1", "default")
+	tc := testClient(map[string]any{"maxDepth": 2.0})
+
+	_, err := s.Handle(context.Background(), newDistanceMessage(0.1, time.Now()), tc)
+	is.NoErr(err)
+
+	is.Equal(1, len(s.UpdatedAlarms()))
+	is.Equal(HighPercentAlarm, s.UpdatedAlarms()[0].Alarm)
+}
@@ -1,61 +1,250 @@
 package things
 
 import (
+	"container/list"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultCacheMaxSize  int           = 1000
+	defaultCacheTTL      time.Duration = 1 * time.Minute
+	cacheCleanupInterval time.Duration = 1 * time.Minute
 )
 
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cip_functions_things_cache_hits_total",
+		Help: "Number of things found in cache",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cip_functions_things_cache_misses_total",
+		Help: "Number of things not found, or expired, in cache",
+	})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cip_functions_things_cache_evictions_total",
+		Help: "Number of things removed from cache, by reason (expired, capacity or invalidated)",
+	}, []string{"reason"})
+)
+
+// CacheConfig limits the number of cached things and for how long they are cached.
+// TTLs can be set per thing type (i.e. wastecontainer, sewer), DefaultTTL is used for all other types.
+type CacheConfig struct {
+	MaxSize    int                      `json:"maxSize" yaml:"maxSize"`
+	DefaultTTL time.Duration            `json:"defaultTTL" yaml:"defaultTTL"`
+	TTLs       map[string]time.Duration `json:"ttls,omitempty" yaml:"ttls,omitempty"`
+}
+
+// TTL returns the time a thing of thingType should be cached
+func (cfg CacheConfig) TTL(thingType string) time.Duration {
+	for t, ttl := range cfg.TTLs {
+		if strings.EqualFold(t, thingType) {
+			return ttl
+		}
+	}
+
+	if cfg.DefaultTTL > 0 {
+		return cfg.DefaultTTL
+	}
+
+	return defaultCacheTTL
+}
+
 type CacheItem struct {
+	Key        string
 	Value      any
 	ExpiryTime time.Time
 }
 
+// Cache is a size bounded LRU cache where each item expires after its own TTL.
+// Expired items are removed by a background goroutine that runs until Stop is called.
 type Cache struct {
-	items map[string]CacheItem
-	mutex sync.RWMutex
+	items   map[string]*list.Element
+	lru     *list.List
+	maxSize int
+	mutex   sync.Mutex
+
+	// generation is incremented each time items are invalidated, see SetIfGeneration
+	generation uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewCache() *Cache {
-	return &Cache{
-		items: make(map[string]CacheItem),
+func NewCache(maxSize int) *Cache {
+	if maxSize <= 0 {
+		maxSize = defaultCacheMaxSize
 	}
+
+	c := &Cache{
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		stop:    make(chan struct{}),
+	}
+
+	go c.cleanup(cacheCleanupInterval)
+
+	return c
 }
 
 func (c *Cache) Set(key string, value any, duration time.Duration) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.items[key] = CacheItem{
+	c.set(key, value, duration)
+}
+
+// Generation returns the current generation of the cache, that is changed each time items are invalidated
+func (c *Cache) Generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.generation
+}
+
+// SetIfGeneration sets key only if no items have been invalidated since generation was returned from Generation,
+// so that a value that was retrieved while it was invalidated is not cached. Returns true if the value was set.
+func (c *Cache) SetIfGeneration(key string, value any, duration time.Duration, generation uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation != generation {
+		return false
+	}
+
+	c.set(key, value, duration)
+
+	return true
+}
+
+// set must be called while holding the lock
+func (c *Cache) set(key string, value any, duration time.Duration) {
+	item := CacheItem{
+		Key:        key,
 		Value:      value,
 		ExpiryTime: time.Now().Add(duration),
 	}
+
+	if e, exists := c.items[key]; exists {
+		e.Value = item
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(item)
+
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back(), "capacity")
+	}
 }
 
 func (c *Cache) Get(key string) (any, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, exists := c.items[key]
+	if !exists {
+		cacheMisses.Inc()
+		return nil, false
+	}
 
-	item, exists := c.items[key]
-	if !exists || item.ExpiryTime.Before(time.Now()) {
+	item := e.Value.(CacheItem)
+	if item.ExpiryTime.Before(time.Now()) {
+		c.remove(e, "expired")
+		cacheMisses.Inc()
 		return nil, false
 	}
 
+	c.lru.MoveToFront(e)
+	cacheHits.Inc()
+
 	return item.Value, true
 }
 
-func (c *Cache) Cleanup(interval time.Duration) {
+// Remove removes key from the cache and reports whether it was cached
+func (c *Cache) Remove(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+
+	e, exists := c.items[key]
+	if exists {
+		c.remove(e, "invalidated")
+	}
+
+	return exists
+}
+
+// RemoveFunc removes all items for which match returns true and returns the number of removed items
+func (c *Cache) RemoveFunc(match func(key string, value any) bool) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+
+	removed := 0
+
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		item := e.Value.(CacheItem)
+		if match(item.Key, item.Value) {
+			c.remove(e, "invalidated")
+			removed++
+		}
+		e = prev
+	}
+
+	return removed
+}
+
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+// Stop stops the background cleanup of expired items. It is safe to call Stop more than once.
+func (c *Cache) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+func (c *Cache) cleanup(interval time.Duration) {
 	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			<-ticker.C
-			now := time.Now()
-			c.mutex.Lock()
-			for key, item := range c.items {
-				if item.ExpiryTime.Before(now) {
-					delete(c.items, key)
-				}
-			}
-			c.mutex.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.removeExpired(time.Now())
 		}
-	}()
+	}
+}
+
+func (c *Cache) removeExpired(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if e.Value.(CacheItem).ExpiryTime.Before(now) {
+			c.remove(e, "expired")
+		}
+		e = prev
+	}
+}
+
+// remove must be called while holding the lock
+func (c *Cache) remove(e *list.Element, reason string) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(CacheItem).Key)
+	cacheEvictions.WithLabelValues(reason).Inc()
 }
@@ -0,0 +1,82 @@
+package things
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	is := is.New(t)
+	c := NewCache(2)
+	defer c.Stop()
+
+	c.Set("a", 1, time.Minute)
+	c.Set("b", 2, time.Minute)
+
+	_, found := c.Get("a")
+	is.True(found)
+
+	c.Set("c", 3, time.Minute)
+
+	_, found = c.Get("b")
+	is.True(!found) // b is the least recently used item and should have been evicted
+
+	v, found := c.Get("a")
+	is.True(found)
+	is.Equal(1, v)
+	is.Equal(2, c.Len())
+}
+
+func TestCacheItemsExpire(t *testing.T) {
+	is := is.New(t)
+	c := NewCache(10)
+	defer c.Stop()
+
+	c.Set("a", 1, -time.Second)
+	c.Set("b", 2, time.Minute)
+
+	_, found := c.Get("a")
+	is.True(!found)
+
+	c.Set("c", 3, -time.Second)
+	c.removeExpired(time.Now())
+
+	is.Equal(1, c.Len())
+}
+
+func TestCacheTTLPerThingType(t *testing.T) {
+	is := is.New(t)
+
+	cfg := CacheConfig{
+		DefaultTTL: 2 * time.Minute,
+		TTLs:       map[string]time.Duration{"wastecontainer": 10 * time.Minute},
+	}
+
+	is.Equal(10*time.Minute, cfg.TTL("WasteContainer"))
+	is.Equal(2*time.Minute, cfg.TTL("sewer"))
+	is.Equal(defaultCacheTTL, CacheConfig{}.TTL("sewer"))
+}
+
+func TestCacheCanBeStoppedMoreThanOnce(t *testing.T) {
+	c := NewCache(10)
+	c.Stop()
+	c.Stop()
+}
+
+func TestCacheIsNotSetIfInvalidatedSinceGeneration(t *testing.T) {
+	is := is.New(t)
+
+	c := NewCache(10)
+	defer c.Stop()
+
+	generation := c.Generation()
+	c.Remove("other")
+
+	is.True(!c.SetIfGeneration("key", "value", time.Minute, generation))
+	is.Equal(0, c.Len())
+
+	is.True(c.SetIfGeneration("key", "value", time.Minute, c.Generation()))
+	is.Equal(1, c.Len())
+}
@@ -6,34 +6,57 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
 )
 
 var tracer = otel.Tracer("things-client")
 
 var ErrThingNotFound = fmt.Errorf("thing not found")
 
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cip_functions_things_request_duration_seconds",
+	Help:    "Duration of requests to iot-things, by status code (error if no response was received)",
+	Buckets: prometheus.ExponentialBuckets(0.005, 3, 8),
+}, []string{"status_code"})
+
 type ClientImpl struct {
 	url               string
 	clientCredentials *clientcredentials.Config
 	httpClient        http.Client
 	cache             *Cache
+	cacheConfig       CacheConfig
+	requests          *singleflight.Group
+	retry             RetryConfig
+	circuitBreaker    *circuitBreaker
+}
+
+// Config contains settings for the things client
+type Config struct {
+	Cache          CacheConfig          `json:"cache" yaml:"cache"`
+	Retry          RetryConfig          `json:"retry" yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker" yaml:"circuitBreaker"`
 }
 
 //go:generate moq -rm -out client_mock.go . Client
 type Client interface {
 	FindByID(ctx context.Context, id, thingType string) (Thing, error)
 	FindRelatedThings(ctx context.Context, id, thingType string) ([]Thing, error)
+	// Invalidate removes a thing, and every cached thing related to it, from the cache. Returns the number of removed entries.
+	Invalidate(id, thingType string) int
 }
 
-func NewClient(ctx context.Context, url, oauthTokenURL, oauthClientID, oauthClientSecret string) (*ClientImpl, error) {
+func NewClient(ctx context.Context, url, oauthTokenURL, oauthClientID, oauthClientSecret string, cfg Config) (*ClientImpl, error) {
 	oauthConfig := &clientcredentials.Config{
 		ClientID:     oauthClientID,
 		ClientSecret: oauthClientSecret,
@@ -49,17 +72,27 @@ func NewClient(ctx context.Context, url, oauthTokenURL, oauthClientID, oauthClie
 		return nil, fmt.Errorf("an invalid token was returned from %s", oauthTokenURL)
 	}
 
-	c := NewCache()
-	c.Cleanup(5 * time.Minute)
+	return newClient(url, oauthConfig, cfg), nil
+}
 
+func newClient(url string, clientCredentials *clientcredentials.Config, cfg Config) *ClientImpl {
 	return &ClientImpl{
 		url:               strings.TrimSuffix(url, "/"),
-		clientCredentials: oauthConfig,
+		clientCredentials: clientCredentials,
 		httpClient: http.Client{
 			Transport: otelhttp.NewTransport(http.DefaultTransport),
 		},
-		cache: c,
-	}, nil
+		cache:          NewCache(cfg.Cache.MaxSize),
+		cacheConfig:    cfg.Cache,
+		requests:       &singleflight.Group{},
+		retry:          cfg.Retry.withDefaults(),
+		circuitBreaker: newCircuitBreaker(cfg.CircuitBreaker),
+	}
+}
+
+// Stop stops the background work of the client, i.e. the cleanup of expired things in the cache
+func (tc ClientImpl) Stop() {
+	tc.cache.Stop()
 }
 
 func (tc ClientImpl) FindByID(ctx context.Context, id, thingType string) (Thing, error) {
@@ -86,6 +119,74 @@ func (tc ClientImpl) FindRelatedThings(ctx context.Context, id, thingType string
 	return jar.Included, nil
 }
 
+func (tc ClientImpl) Invalidate(id, thingType string) int {
+	url := tc.urlFor(id, thingType)
+
+	// a request for the thing that is in flight may return the thing as it was before it was changed, later
+	// callers should not share it
+	tc.requests.Forget(url)
+
+	return tc.cache.RemoveFunc(func(key string, value any) bool {
+		if key == url {
+			return true
+		}
+
+		jar, ok := value.(JsonApiResponse)
+		if !ok {
+			return false
+		}
+
+		for _, t := range jar.Included {
+			if strings.EqualFold(t.ID, id) || strings.EqualFold(t.ThingID, id) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// Health checks that a token can be retrieved from the token endpoint and that iot-things accepts it.
+// The request is not retried and bypasses the cache and the circuit breaker.
+func (tc ClientImpl) Health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tc.url+"/api/v0/things?limit=1", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create http request: %w", err)
+	}
+
+	req.Header.Add("Accept", "application/vnd.api+json")
+
+	if tc.clientCredentials != nil {
+		token, err := tc.clientCredentials.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get client credentials from %s: %w", tc.clientCredentials.TokenURL, err)
+		}
+
+		req.Header.Add("Authorization", fmt.Sprintf("%s %s", token.TokenType, token.AccessToken))
+	}
+
+	resp, err := tc.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to iot-things: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("request failed, not authorized (status code %d)", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (tc ClientImpl) urlFor(id, thingType string) string {
+	return fmt.Sprintf("%s/%s/urn:diwise:%s:%s", tc.url, "api/v0/things", strings.ToLower(thingType), strings.ToLower(id))
+}
+
 func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonApiResponse, error) {
 	var err error
 	ctx, span := tracer.Start(ctx, "find-thing-by-id")
@@ -93,7 +194,7 @@ func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonA
 
 	log := logging.GetFromContext(ctx)
 
-	url := fmt.Sprintf("%s/%s/urn:diwise:%s:%s", tc.url, "api/v0/things", strings.ToLower(thingType), strings.ToLower(id))
+	url := tc.urlFor(id, thingType)
 
 	cachedItem, found := tc.cache.Get(url)
 	if found {
@@ -105,6 +206,46 @@ func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonA
 		log.Warn(fmt.Sprintf("found response for %s in cache but could not cast to JsonApiResponse", url))
 	}
 
+	// concurrent requests for the same thing share a single request to iot-things. The shared request is not
+	// cancelled with the context of the caller that started it, since other callers may wait for it, but has a
+	// timeout of its own. Each caller stops waiting when its own context is done.
+	ch := tc.requests.DoChan(url, func() (any, error) {
+		generation := tc.cache.Generation()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tc.retry.Timeout)
+		defer cancel()
+
+		jar, err := withRetry(ctx, tc.retry, tc.circuitBreaker, func(ctx context.Context) (*JsonApiResponse, error) {
+			return tc.get(ctx, url)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// a thing that was invalidated during the request may have been changed after it was retrieved
+		if !tc.cache.SetIfGeneration(url, *jar, tc.cacheConfig.TTL(thingType), generation) {
+			log.Debug(fmt.Sprintf("%s was invalidated during the request and is not cached", url))
+		}
+
+		return jar, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return nil, err
+	case res := <-ch:
+		if res.Err != nil {
+			err = res.Err
+			return nil, err
+		}
+		return res.Val.(*JsonApiResponse), nil
+	}
+}
+
+func (tc ClientImpl) get(ctx context.Context, url string) (*JsonApiResponse, error) {
+	log := logging.GetFromContext(ctx)
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		err = fmt.Errorf("failed to create http request: %w", err)
@@ -123,13 +264,18 @@ func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonA
 		req.Header.Add("Authorization", fmt.Sprintf("%s %s", token.TokenType, token.AccessToken))
 	}
 
+	start := time.Now()
+
 	resp, err := tc.httpClient.Do(req)
 	if err != nil {
-		err = fmt.Errorf("failed to retrieve thing: %w", err)
+		requestDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		err = &requestError{err: fmt.Errorf("failed to retrieve thing: %w", err), retryable: ctx.Err() == nil}
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	requestDuration.WithLabelValues(strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+
 	if resp.StatusCode == http.StatusUnauthorized {
 		err = fmt.Errorf("request failed, not authorized")
 		return nil, err
@@ -140,7 +286,11 @@ func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonA
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("request failed with status code %d", resp.StatusCode)
+		err = &requestError{
+			err:        fmt.Errorf("request failed with status code %d", resp.StatusCode),
+			retryable:  isRetryableStatus(resp.StatusCode),
+			retryAfter: retryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 		return nil, err
 	}
 
@@ -159,8 +309,6 @@ func (tc ClientImpl) findByID(ctx context.Context, id, thingType string) (*JsonA
 		return nil, err
 	}
 
-	tc.cache.Set(url, jar, 1*time.Minute)
-
 	return &jar, nil
 }
 
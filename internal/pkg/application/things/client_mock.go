@@ -24,6 +24,9 @@ var _ Client = &ClientMock{}
 //			FindRelatedThingsFunc: func(ctx context.Context, id string, thingType string) ([]Thing, error) {
 //				panic("mock out the FindRelatedThings method")
 //			},
+//			InvalidateFunc: func(id string, thingType string) int {
+//				panic("mock out the Invalidate method")
+//			},
 //		}
 //
 //		// use mockedClient in code that requires Client
@@ -37,6 +40,9 @@ type ClientMock struct {
 	// FindRelatedThingsFunc mocks the FindRelatedThings method.
 	FindRelatedThingsFunc func(ctx context.Context, id string, thingType string) ([]Thing, error)
 
+	// InvalidateFunc mocks the Invalidate method.
+	InvalidateFunc func(id string, thingType string) int
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// FindByID holds details about calls to the FindByID method.
@@ -57,9 +63,17 @@ type ClientMock struct {
 			// ThingType is the thingType argument value.
 			ThingType string
 		}
+		// Invalidate holds details about calls to the Invalidate method.
+		Invalidate []struct {
+			// ID is the id argument value.
+			ID string
+			// ThingType is the thingType argument value.
+			ThingType string
+		}
 	}
 	lockFindByID          sync.RWMutex
 	lockFindRelatedThings sync.RWMutex
+	lockInvalidate        sync.RWMutex
 }
 
 // FindByID calls FindByIDFunc.
@@ -141,3 +155,39 @@ func (mock *ClientMock) FindRelatedThingsCalls() []struct {
 	mock.lockFindRelatedThings.RUnlock()
 	return calls
 }
+
+// Invalidate calls InvalidateFunc.
+func (mock *ClientMock) Invalidate(id string, thingType string) int {
+	if mock.InvalidateFunc == nil {
+		panic("ClientMock.InvalidateFunc: method is nil but Client.Invalidate was just called")
+	}
+	callInfo := struct {
+		ID        string
+		ThingType string
+	}{
+		ID:        id,
+		ThingType: thingType,
+	}
+	mock.lockInvalidate.Lock()
+	mock.calls.Invalidate = append(mock.calls.Invalidate, callInfo)
+	mock.lockInvalidate.Unlock()
+	return mock.InvalidateFunc(id, thingType)
+}
+
+// InvalidateCalls gets all the calls that were made to Invalidate.
+// Check the length with:
+//
+//	len(mockedClient.InvalidateCalls())
+func (mock *ClientMock) InvalidateCalls() []struct {
+	ID        string
+	ThingType string
+} {
+	var calls []struct {
+		ID        string
+		ThingType string
+	}
+	mock.lockInvalidate.RLock()
+	calls = mock.calls.Invalidate
+	mock.lockInvalidate.RUnlock()
+	return calls
+}
@@ -1,10 +1,18 @@
 package things
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 type thingWithProps struct {
@@ -37,3 +45,174 @@ func TestUnmarshalToThing(t *testing.T) {
 
 	is.True(t_.Properties != nil)
 }
+
+func TestConcurrentRequestsForSameThingAreCoalesced(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Header().Add("Content-Type", "application/vnd.api+json")
+		w.Write([]byte(`{"data":{"id":"sewer:1","type":"Sewer","tenant":"default"}}`))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{})
+	defer c.Stop()
+
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			thing, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+			is.NoErr(err)
+			is.Equal("sewer:1", thing.ID)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	is.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.NoErr(err)
+	is.Equal(int32(1), atomic.LoadInt32(&requests)) // should be found in cache
+}
+
+func TestInvalidateRemovesThingAndRelatedThings(t *testing.T) {
+	is := is.New(t)
+
+	c := newClient("http://iot-things", nil, Config{})
+	defer c.Stop()
+
+	c.cache.Set(c.urlFor("sewer:1", "Sewer"), JsonApiResponse{}, time.Minute)
+	c.cache.Set(c.urlFor("level:1", "Function"), JsonApiResponse{Included: []Thing{{ID: "sewer:1", Type: "Sewer"}}}, time.Minute)
+	c.cache.Set(c.urlFor("level:2", "Function"), JsonApiResponse{Included: []Thing{{ID: "sewer:2", Type: "Sewer"}}}, time.Minute)
+
+	is.Equal(2, c.Invalidate("sewer:1", "Sewer"))
+	is.Equal(1, c.cache.Len())
+
+	_, found := c.cache.Get(c.urlFor("level:2", "Function"))
+	is.True(found)
+}
+
+func TestSharedRequestIsNotCancelledWithTheCallerThatStartedIt(t *testing.T) {
+	is := is.New(t)
+
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.Header().Add("Content-Type", "application/vnd.api+json")
+		w.Write([]byte(`{"data":{"id":"sewer:1","type":"Sewer","tenant":"default"}}`))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{})
+	defer c.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	first := make(chan error)
+	go func() {
+		_, err := c.FindByID(ctx, "sewer:1", "Sewer")
+		first <- err
+	}()
+	<-received
+
+	second := make(chan error)
+	go func() {
+		_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+		second <- err
+	}()
+
+	cancel()
+	is.True(errors.Is(<-first, context.Canceled))
+
+	close(release)
+	is.NoErr(<-second)
+}
+
+func TestThingInvalidatedDuringRequestIsNotCached(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	received := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			received <- struct{}{}
+			<-release
+		}
+		w.Header().Add("Content-Type", "application/vnd.api+json")
+		w.Write([]byte(`{"data":{"id":"sewer:1","type":"Sewer","tenant":"default"}}`))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{})
+	defer c.Stop()
+
+	done := make(chan error)
+	go func() {
+		_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+		done <- err
+	}()
+	<-received
+
+	c.Invalidate("sewer:1", "Sewer")
+
+	// a caller after the invalidation does not share the request that is in flight
+	_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.NoErr(err)
+	is.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	close(release)
+	is.NoErr(<-done)
+
+	is.Equal(1, c.cache.Len()) // only the response from after the invalidation is cached
+}
+
+func TestHealth(t *testing.T) {
+	is := is.New(t)
+
+	statusCode := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Add("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+			return
+		}
+
+		if r.URL.Path != "/api/v0/things" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		is.Equal("Bearer token", r.Header.Get("Authorization"))
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, &clientcredentials.Config{ClientID: "id", ClientSecret: "secret", TokenURL: server.URL + "/token"}, Config{})
+	defer c.Stop()
+
+	is.NoErr(c.Health(context.Background()))
+
+	statusCode = http.StatusUnauthorized
+	is.True(c.Health(context.Background()) != nil)
+
+	c = newClient(server.URL, &clientcredentials.Config{ClientID: "id", ClientSecret: "secret", TokenURL: server.URL + "/missing"}, Config{})
+	defer c.Stop()
+
+	is.True(c.Health(context.Background()) != nil) // token endpoint should fail
+}
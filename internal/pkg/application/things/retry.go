@@ -0,0 +1,216 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, iot-things is unavailable")
+
+const (
+	defaultMaxAttempts      int           = 3
+	defaultInitialBackoff   time.Duration = 100 * time.Millisecond
+	defaultMaxBackoff       time.Duration = 5 * time.Second
+	defaultRequestTimeout   time.Duration = 30 * time.Second
+	defaultFailureThreshold int           = 5
+	defaultOpenTimeout      time.Duration = 30 * time.Second
+)
+
+// RetryConfig controls how failed requests to iot-things are retried. Requests are retried on network
+// errors, 5xx and 429 responses, with an exponential backoff between InitialBackoff and MaxBackoff.
+// A Retry-After header is honored, and a request is not retried if it asks for a wait longer than MaxBackoff.
+// Timeout limits the time a request, including its retries, may take.
+type RetryConfig struct {
+	MaxAttempts    int           `json:"maxAttempts" yaml:"maxAttempts"`
+	InitialBackoff time.Duration `json:"initialBackoff" yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `json:"maxBackoff" yaml:"maxBackoff"`
+	Timeout        time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (cfg RetryConfig) withDefaults() RetryConfig {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRequestTimeout
+	}
+	return cfg
+}
+
+// backoff returns the time to wait before the given retry (1 for the first retry) with jitter added
+func (cfg RetryConfig) backoff(retry int) time.Duration {
+	d := cfg.InitialBackoff << (retry - 1)
+	if d <= 0 || d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+
+	// wait between half and the full backoff so that clients do not retry in lockstep
+	return d/2 + rand.N(d/2+1)
+}
+
+// CircuitBreakerConfig controls when requests to iot-things should fail fast with ErrCircuitOpen. The circuit
+// opens after FailureThreshold consecutive failed requests and a new request is let through after OpenTimeout.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `json:"failureThreshold" yaml:"failureThreshold"`
+	OpenTimeout      time.Duration `json:"openTimeout" yaml:"openTimeout"`
+}
+
+// requestError is returned from a single request to iot-things
+type requestError struct {
+	err        error
+	retryable  bool
+	retryAfter time.Duration
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func isRetryable(err error) (bool, time.Duration) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.retryable, reqErr.retryAfter
+	}
+	return false, 0
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as a http date
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// withRetry calls fn until it succeeds, returns an error that should not be retried, or the attempts are exhausted
+func withRetry[T any](ctx context.Context, cfg RetryConfig, cb *circuitBreaker, fn func(ctx context.Context) (T, error)) (T, error) {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if err = cb.allow(); err != nil {
+			return *new(T), err
+		}
+
+		var result T
+		result, err = fn(ctx)
+
+		retryable, wait := isRetryable(err)
+		cb.done(retryable)
+
+		if err == nil || !retryable || attempt >= cfg.MaxAttempts {
+			return result, err
+		}
+
+		if wait > cfg.MaxBackoff {
+			return result, err
+		}
+
+		wait = max(wait, cfg.backoff(attempt))
+
+		select {
+		case <-ctx.Done():
+			return result, errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+
+	failureThreshold int
+	openTimeout      time.Duration
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = defaultOpenTimeout
+	}
+
+	return &circuitBreaker{
+		failureThreshold: cfg.FailureThreshold,
+		openTimeout:      cfg.OpenTimeout,
+	}
+}
+
+// allow returns ErrCircuitOpen if requests should fail fast. When the open timeout has passed a
+// single request is let through, and its result decides if the circuit should close or open again.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.openTimeout {
+			return ErrCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// done records the result of a request that was allowed. Only failures that indicate that
+// iot-things is unavailable, i.e. retryable errors, count as failures.
+func (cb *circuitBreaker) done(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !failed {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+
+	if cb.state == circuitHalfOpen || cb.failures >= cb.failureThreshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,125 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRequestIsRetriedOnServerError(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data":{"id":"sewer:1","type":"Sewer"}}`))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{Retry: RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}})
+	defer c.Stop()
+
+	thing, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.NoErr(err)
+	is.Equal("sewer:1", thing.ID)
+	is.Equal(int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestRequestIsNotRetriedOnNotFound(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{Retry: RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond}})
+	defer c.Stop()
+
+	_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.True(errors.Is(err, ErrThingNotFound))
+	is.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestRequestIsNotRetriedWhenRetryAfterIsTooLong(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Add("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{Retry: RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Second}})
+	defer c.Stop()
+
+	_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.True(err != nil)
+	is.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestCircuitOpensAfterConsecutiveFailures(t *testing.T) {
+	is := is.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, nil, Config{
+		Retry:          RetryConfig{MaxAttempts: 1},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour},
+	})
+	defer c.Stop()
+
+	for range 2 {
+		_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+		is.True(err != nil)
+		is.True(!errors.Is(err, ErrCircuitOpen))
+	}
+
+	_, err := c.FindByID(context.Background(), "sewer:1", "Sewer")
+	is.True(errors.Is(err, ErrCircuitOpen))
+	is.Equal(int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestCircuitClosesWhenTrialRequestSucceeds(t *testing.T) {
+	is := is.New(t)
+
+	cb := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Millisecond})
+
+	is.NoErr(cb.allow())
+	cb.done(true)
+	is.True(errors.Is(cb.allow(), ErrCircuitOpen))
+
+	time.Sleep(2 * time.Millisecond)
+
+	is.NoErr(cb.allow())                           // trial request
+	is.True(errors.Is(cb.allow(), ErrCircuitOpen)) // only one trial request at a time
+	cb.done(false)
+	is.NoErr(cb.allow())
+}
+
+func TestRetryAfter(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	is.Equal(30*time.Second, retryAfter("30", now))
+	is.Equal(time.Minute, retryAfter("Mon, 01 Jan 2024 12:01:00 GMT", now))
+	is.Equal(time.Duration(0), retryAfter("", now))
+}
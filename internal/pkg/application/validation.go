@@ -0,0 +1,144 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ErrUnknownValidationPolicy = errors.New("unknown validation policy")
+
+var validationOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cip_functions_validation_total",
+	Help: "Number of changed states that were validated, by outcome",
+}, []string{"handler_type", "outcome"})
+
+// ValidationPolicy decides what happens to a message that would give a cip function invalid values
+type ValidationPolicy string
+
+const (
+	// ValidationPolicyWarn stores the invalid values and logs a warning, this is the default
+	ValidationPolicyWarn ValidationPolicy = "warn"
+	// ValidationPolicyReject ignores the message
+	ValidationPolicyReject ValidationPolicy = "reject"
+	// ValidationPolicyClamp stores the values clamped to their valid range
+	ValidationPolicyClamp ValidationPolicy = "clamp"
+	// ValidationPolicyQuarantine ignores the message and stores it in quarantine together with the reason
+	ValidationPolicyQuarantine ValidationPolicy = "quarantine"
+)
+
+// ValidationConfig maps function types, i.e. WasteContainer, to the policy used when their values are invalid
+type ValidationConfig map[string]ValidationPolicy
+
+func (cfg ValidationConfig) validate() error {
+	var errs []error
+
+	for functionType, policy := range cfg {
+		switch policy {
+		case ValidationPolicyWarn, ValidationPolicyReject, ValidationPolicyClamp, ValidationPolicyQuarantine:
+		default:
+			errs = append(errs, fmt.Errorf("%w for %s: %s", ErrUnknownValidationPolicy, functionType, policy))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (cfg ValidationConfig) policyFor(thingType string) ValidationPolicy {
+	for functionType, policy := range cfg {
+		if strings.EqualFold(functionType, thingType) {
+			return policy
+		}
+	}
+	return ValidationPolicyWarn
+}
+
+// validator is implemented by cip functions whose values can be validated
+type validator interface {
+	Validate() (bool, error)
+}
+
+// clamper is implemented by cip functions whose invalid values can be clamped to their valid range
+type clamper interface {
+	Clamp()
+}
+
+type stateValidator struct {
+	store  storage.Storage
+	config ValidationConfig
+}
+
+func newStateValidator(s storage.Storage, cfg ValidationConfig) *stateValidator {
+	return &stateValidator{store: s, config: cfg}
+}
+
+// validate applies the validation policy of the thing type to state, that is the result of handling itm.
+// Returns false if the state should not be stored. A function that can not be clamped is rejected instead.
+func (v *stateValidator) validate(ctx context.Context, state any, itm messaging.IncomingTopicMessage, id, thingType, tenant string) (bool, error) {
+	s, ok := state.(validator)
+	if !ok {
+		return true, nil
+	}
+
+	handlerType := strings.ToLower(thingType)
+
+	valid, err := s.Validate()
+	if valid {
+		validationOutcomes.WithLabelValues(handlerType, "valid").Inc()
+		return true, nil
+	}
+
+	reason := "invalid values"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	log := logging.GetFromContext(ctx).With(slog.String("reason", reason))
+
+	policy := v.config.policyFor(thingType)
+
+	if policy == ValidationPolicyClamp {
+		if c, ok := state.(clamper); ok {
+			c.Clamp()
+			log.Warn("clamped invalid values")
+			validationOutcomes.WithLabelValues(handlerType, "clamped").Inc()
+			return true, nil
+		}
+		policy = ValidationPolicyReject
+	}
+
+	switch policy {
+	case ValidationPolicyReject:
+		log.Warn("rejected message that would give invalid values")
+		validationOutcomes.WithLabelValues(handlerType, "rejected").Inc()
+		return false, nil
+	case ValidationPolicyQuarantine:
+		err = v.store.StoreQuarantined(ctx, storage.QuarantinedReading{
+			ThingID:     id,
+			ThingType:   thingType,
+			Tenant:      tenant,
+			Topic:       itm.TopicName(),
+			ContentType: itm.ContentType(),
+			Body:        itm.Body(),
+			Reason:      reason,
+		})
+		if err != nil {
+			return false, fmt.Errorf("could not quarantine message: %w", err)
+		}
+		log.Warn("quarantined message that would give invalid values")
+		validationOutcomes.WithLabelValues(handlerType, "quarantined").Inc()
+		return false, nil
+	default:
+		log.Warn("stored invalid values")
+		validationOutcomes.WithLabelValues(handlerType, "invalid").Inc()
+		return true, nil
+	}
+}
@@ -6,31 +6,143 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/ids"
 	"github.com/diwise/cip-functions/internal/pkg/application/things"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/senml"
-	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 )
 
-var WasteContainerFactory = func(id, tenant string) *WasteContainer {
-	return &WasteContainer{
-		ID:     id,
-		Type:   "WasteContainer",
-		Tenant: tenant,
+var WasteContainerFactory = NewWasteContainerFactory(Config{})
+
+func NewWasteContainerFactory(cfg Config) func(id, tenant string) *WasteContainer {
+	return func(id, tenant string) *WasteContainer {
+		return &WasteContainer{
+			ID:       id,
+			Type:     "WasteContainer",
+			Tenant:   tenant,
+			config:   cfg.withDefaults(),
+			fireRisk: cfg.FireRisk.thresholdsFor(id, tenant),
+		}
+	}
+}
+
+const (
+	defaultFullThreshold   float64       = 100
+	defaultHistoryMaxAge   time.Duration = 72 * time.Hour
+	defaultHistoryMaxCount int           = 50
+)
+
+// defaultEmptyingDrop is the decrease in percentage points, between two observations, that is regarded as an emptying
+const defaultEmptyingDrop float64 = 30
+
+// Config controls the percent history that the fill rate is computed from, the percent at which a container
+// is predicted to be full, the decrease in percent that is regarded as an emptying and when fire risk alerts are raised
+type Config struct {
+	FullThreshold   float64        `json:"fullThreshold" yaml:"fullThreshold"`
+	HistoryMaxAge   time.Duration  `json:"historyMaxAge" yaml:"historyMaxAge"`
+	HistoryMaxCount int            `json:"historyMaxCount" yaml:"historyMaxCount"`
+	EmptyingDrop    float64        `json:"emptyingDrop" yaml:"emptyingDrop"`
+	FireRisk        FireRiskConfig `json:"fireRisk" yaml:"fireRisk"`
+}
+
+// FireRiskConfig contains the fire risk thresholds for all waste containers, and the thresholds that are
+// overridden for the containers of a tenant or for specific containers by id. A container specific threshold
+// takes precedence over a tenant specific one. No alert is raised for a threshold without a limit.
+type FireRiskConfig struct {
+	Temperature alarms.Threshold              `json:"temperature" yaml:"temperature"` // degrees celsius
+	RiseRate    alarms.Threshold              `json:"riseRate" yaml:"riseRate"`       // degrees celsius per hour
+	Tenants     map[string]FireRiskThresholds `json:"tenants,omitempty" yaml:"tenants,omitempty"`
+	Containers  map[string]FireRiskThresholds `json:"containers,omitempty" yaml:"containers,omitempty"`
+}
+
+type FireRiskThresholds struct {
+	Temperature alarms.Threshold `json:"temperature" yaml:"temperature"`
+	RiseRate    alarms.Threshold `json:"riseRate" yaml:"riseRate"`
+}
+
+func (t FireRiskThresholds) merge(o FireRiskThresholds) FireRiskThresholds {
+	t.Temperature = t.Temperature.Merge(o.Temperature)
+	t.RiseRate = t.RiseRate.Merge(o.RiseRate)
+	return t
+}
+
+func (cfg FireRiskConfig) thresholdsFor(id, tenant string) FireRiskThresholds {
+	t := FireRiskThresholds{Temperature: cfg.Temperature, RiseRate: cfg.RiseRate}
+
+	for tenantName, override := range cfg.Tenants {
+		if strings.EqualFold(tenantName, tenant) {
+			t = t.merge(override)
+		}
+	}
+
+	for containerID, override := range cfg.Containers {
+		if strings.EqualFold(containerID, id) {
+			t = t.merge(override)
+		}
 	}
+
+	return t
+}
+
+const (
+	HighTemperatureAlert      string = "highTemperature"
+	RapidTemperatureRiseAlert string = "rapidTemperatureRise"
+)
+
+// minRiseRateInterval is the shortest time between two temperature observations that a rise rate is computed for.
+// Observations from a sensor that reports more often are compared with an earlier observation that is old enough.
+const minRiseRateInterval time.Duration = 1 * time.Minute
+
+func (cfg Config) withDefaults() Config {
+	if cfg.EmptyingDrop <= 0 {
+		cfg.EmptyingDrop = defaultEmptyingDrop
+	}
+	if cfg.FullThreshold <= 0 {
+		cfg.FullThreshold = defaultFullThreshold
+	}
+	if cfg.HistoryMaxAge <= 0 {
+		cfg.HistoryMaxAge = defaultHistoryMaxAge
+	}
+	if cfg.HistoryMaxCount <= 0 {
+		cfg.HistoryMaxCount = defaultHistoryMaxCount
+	}
+	return cfg
 }
 
 type WasteContainer struct {
-	ID             string        `json:"id"`
-	Type           string        `json:"type"`
-	Level          *float64      `json:"level,omitempty"`
-	Percent        *float64      `json:"percent,omitempty"`
-	Temperature    *float64      `json:"temperature,omitempty"`
-	DateObserved   time.Time     `json:"dateObserved"`
-	Tenant         string        `json:"tenant"`
-	WasteContainer *things.Thing `json:"wastecontainer,omitempty"`
+	ID                  string        `json:"id"`
+	Type                string        `json:"type"`
+	Level               *float64      `json:"level,omitempty"`
+	Percent             *float64      `json:"percent,omitempty"`
+	PercentHistory      []Observation `json:"percentHistory,omitempty"` // percent observations since the container was last emptied
+	FillRate            *float64      `json:"fillRate,omitempty"`       // percent per hour
+	PredictedFull       *time.Time    `json:"predictedFull,omitempty"`  // estimated time when percent reaches the full threshold
+	LastEmptied         *time.Time    `json:"lastEmptied,omitempty"`
+	Temperature         *float64      `json:"temperature,omitempty"`
+	TemperatureObserved *time.Time    `json:"temperatureObserved,omitempty"`
+	TemperatureRise     *float64      `json:"temperatureRise,omitempty"`     // degrees celsius per hour
+	TemperatureRiseFrom *Observation  `json:"temperatureRiseFrom,omitempty"` // the observation the rise is computed from
+	FireRisk            bool          `json:"fireRisk"`                      // true while any fire risk alert is active
+	Alerts              alarms.Alarms `json:"alerts,omitempty"`
+	DateObserved        time.Time     `json:"dateObserved"`
+	Tenant              string        `json:"tenant"`
+	WasteContainer      *things.Thing `json:"wastecontainer,omitempty"`
+
+	config    Config
+	fireRisk  FireRiskThresholds
+	emptyings []Emptying      // emptyings detected by the last handled message
+	alerts    []FireRiskAlert // fire risk alerts raised or cleared by the last handled message
+	recorded  bool            // true if the last handled message was recorded in the percent history
+}
+
+type Observation struct {
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 func (wc WasteContainer) TopicName() string {
@@ -67,12 +179,36 @@ func (wc WasteContainer) Validate() (bool, error) {
 	return valid, errors.Join(errs...)
 }
 
+// Clamp limits percent to 0-100 and level to at least 0, and computes the fill rate from the clamped percent history
+func (wc *WasteContainer) Clamp() {
+	if wc.Percent != nil {
+		p := clamp(*wc.Percent, 0, 100)
+		wc.Percent = &p
+	}
+
+	if wc.Level != nil && *wc.Level < 0 {
+		l := 0.0
+		wc.Level = &l
+	}
+
+	if n := len(wc.PercentHistory); n > 0 {
+		for i := range wc.PercentHistory {
+			wc.PercentHistory[i].Value = clamp(wc.PercentHistory[i].Value, 0, 100)
+		}
+
+		latest := wc.PercentHistory[n-1]
+		wc.predictFull(latest.Value, latest.Timestamp)
+	}
+}
+
+func clamp(value, low, high float64) float64 {
+	return math.Min(math.Max(value, low), high)
+}
+
 func (wc *WasteContainer) Handle(ctx context.Context, itm messaging.IncomingTopicMessage, tc things.Client) (bool, error) {
 	var err error
 	changed := false
 
-	log := logging.GetFromContext(ctx)
-
 	m := struct {
 		ID     string      `json:"id,omitempty"`
 		Tenant *string     `json:"tenant,omitempty"`
@@ -95,7 +231,19 @@ func (wc *WasteContainer) Handle(ctx context.Context, itm messaging.IncomingTopi
 		}
 	}
 
+	wc.emptyings = nil
+	wc.alerts = nil
+	wc.recorded = false
+
 	if m.Level != nil {
+		levelBefore := wc.Level
+
+		// messages without a timestamp are regarded as observed when they are received
+		ts := time.Now().UTC()
+		if !m.Timestamp.IsZero() {
+			ts = m.Timestamp
+		}
+
 		if wc.Level != nil && *wc.Level != m.Level.Current {
 			wc.Level = &m.Level.Current
 			changed = true
@@ -109,6 +257,11 @@ func (wc *WasteContainer) Handle(ctx context.Context, itm messaging.IncomingTopi
 		if m.Level.Percent != nil {
 			incoming := math.Round(*m.Level.Percent)
 
+			// observations older than the current state, i.e. delivered out of order, are not regarded as emptyings
+			if wc.Percent != nil && *wc.Percent-incoming >= wc.config.withDefaults().EmptyingDrop && !ts.Before(wc.DateObserved) {
+				wc.emptied(*wc.Percent, incoming, levelBefore, m.Level.Current, ts)
+			}
+
 			if wc.Percent != nil && *wc.Percent != incoming {
 				wc.Percent = &incoming
 				changed = true
@@ -120,39 +273,37 @@ func (wc *WasteContainer) Handle(ctx context.Context, itm messaging.IncomingTopi
 			}
 		}
 
-		if changed {
-			ts := time.Now().UTC()
-			if !m.Timestamp.IsZero() {
-				ts = m.Timestamp
-			}
+		// every observation in order is recorded, also when the percent is unchanged, so that the fill rate
+		// and predicted full time are kept up to date when a container stops filling. It is only a change to
+		// publish if the fill rate or predicted full time changes.
+		if m.Level.Percent != nil && wc.observePercent(*wc.Percent, ts) {
+			changed = true
+		}
 
+		if changed {
 			wc.DateObserved = ts
 		}
 	}
 
-	if valid, err := wc.Validate(); !valid {
-		log.Warn("waste container has invalid values", "err", err.Error())
-	}
-
 	if m.Pack == nil {
 		return changed, nil
 	}
 
 	sensorValue, recOk := m.Pack.GetRecord(senml.FindByName("5700"))
 	if recOk {
-		t, valueOk := sensorValue.GetValue()
-		if valueOk {
-			if wc.Temperature != nil && *wc.Temperature != t {
-				wc.Temperature = &t
-			}
+		ts, timeOk := sensorValue.GetTime()
+		if !timeOk {
+			ts = time.Now().UTC()
+		}
 
-			if wc.Temperature == nil {
-				wc.Temperature = &t
+		t, valueOk := sensorValue.GetValue()
+		// temperatures observed before the current temperature, i.e. delivered out of order, are ignored
+		if valueOk && (wc.TemperatureObserved == nil || !ts.Before(*wc.TemperatureObserved)) {
+			if wc.observeTemperature(t, ts) {
 				changed = true
 			}
 		}
 
-		ts, timeOk := sensorValue.GetTime()
 		if changed && timeOk {
 			if ts.After(wc.DateObserved) {
 				wc.DateObserved = ts
@@ -165,9 +316,248 @@ func (wc *WasteContainer) Handle(ctx context.Context, itm messaging.IncomingTopi
 		changed = true
 	}
 
-	if valid, err := wc.Validate(); !valid {
-		log.Warn("waste container has invalid values", "err", err.Error())
+	return changed, nil
+}
+
+// observeTemperature updates the temperature and the rate at which it rises, and evaluates the fire risk
+// alerts. Returns true if the temperature or any alert changed.
+func (wc *WasteContainer) observeTemperature(t float64, ts time.Time) bool {
+	changed := wc.Temperature == nil || *wc.Temperature != t
+
+	if wc.TemperatureRiseFrom == nil {
+		wc.TemperatureRiseFrom = &Observation{Value: t, Timestamp: ts}
 	}
 
-	return changed, nil
+	// the rise is computed once the observation it is computed from is old enough, which is then
+	// replaced by the current observation so that the rise reflects the latest interval
+	if d := ts.Sub(wc.TemperatureRiseFrom.Timestamp); d >= minRiseRateInterval {
+		rise := (t - wc.TemperatureRiseFrom.Value) / d.Hours()
+		if wc.TemperatureRise == nil || *wc.TemperatureRise != rise {
+			wc.TemperatureRise = &rise
+			changed = true
+		}
+		wc.TemperatureRiseFrom = &Observation{Value: t, Timestamp: ts}
+	}
+
+	wc.Temperature = &t
+	wc.TemperatureObserved = &ts
+
+	if wc.evaluateAlert(HighTemperatureAlert, wc.fireRisk.Temperature, t, ts) {
+		changed = true
+	}
+
+	if wc.TemperatureRise != nil {
+		if wc.evaluateAlert(RapidTemperatureRiseAlert, wc.fireRisk.RiseRate, *wc.TemperatureRise, ts) {
+			changed = true
+		}
+	}
+
+	wc.FireRisk = wc.Alerts.Active()
+
+	return changed
+}
+
+func (wc *WasteContainer) evaluateAlert(name string, t alarms.Threshold, value float64, ts time.Time) bool {
+	transitioned, changed := wc.Alerts.Evaluate(name, t, value, ts)
+	if transitioned {
+		a := wc.Alerts[name]
+		wc.alerts = append(wc.alerts, FireRiskAlert{
+			ID:          wc.ID,
+			Tenant:      wc.Tenant,
+			Alert:       name,
+			Active:      a.Active,
+			FireRisk:    wc.Alerts.Active(),
+			Temperature: *wc.Temperature,
+			Value:       a.Value,
+			Limit:       a.Limit,
+			Timestamp:   ts,
+		})
+	}
+
+	return changed
+}
+
+// FireRiskAlert is published on cip-function.firerisk when a fire risk alert for a waste container is raised or
+// cleared. FireRisk is true as long as any alert for the container is active.
+type FireRiskAlert struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant"`
+	Alert       string    `json:"alert"`
+	Active      bool      `json:"active"`
+	FireRisk    bool      `json:"fireRisk"`
+	Temperature float64   `json:"temperature"`
+	Value       float64   `json:"value"`
+	Limit       float64   `json:"limit"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (a FireRiskAlert) TopicName() string {
+	return "cip-function.firerisk"
+}
+
+func (a FireRiskAlert) ContentType() string {
+	return "application/vnd.diwise.wastecontainer.firerisk+json"
+}
+
+func (a FireRiskAlert) Body() []byte {
+	b, _ := json.Marshal(a)
+	return b
+}
+
+// FireRiskAlerts returns the fire risk alerts that were raised or cleared by the last call to Handle
+func (wc WasteContainer) FireRiskAlerts() []FireRiskAlert {
+	return slices.Clone(wc.alerts)
+}
+
+// Emptying is detected when the percent of a waste container decreases by at least the configured emptying drop.
+// It is published on cip-function.emptied when detected.
+type Emptying struct {
+	ID               string    `json:"id"`
+	WasteContainerID string    `json:"wasteContainerID"`
+	Tenant           string    `json:"tenant"`
+	Timestamp        time.Time `json:"timestamp"`
+	PercentBefore    float64   `json:"percentBefore"`
+	PercentAfter     float64   `json:"percentAfter"`
+	LevelBefore      *float64  `json:"levelBefore,omitempty"`
+	LevelAfter       float64   `json:"levelAfter"`
+}
+
+func (e Emptying) TopicName() string {
+	return "cip-function.emptied"
+}
+
+func (e Emptying) ContentType() string {
+	return "application/vnd.diwise.wastecontainer.emptied+json"
+}
+
+func (e Emptying) Body() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// RecordedObservation returns true if the last call to Handle recorded an observation in the percent history,
+// which should be stored even if there is no change to publish
+func (wc WasteContainer) RecordedObservation() bool {
+	return wc.recorded
+}
+
+// DetectedEmptyings returns the emptyings that were detected by the last call to Handle
+func (wc WasteContainer) DetectedEmptyings() []Emptying {
+	return slices.Clone(wc.emptyings)
+}
+
+func (wc *WasteContainer) emptied(percentBefore, percentAfter float64, levelBefore *float64, levelAfter float64, ts time.Time) {
+	wc.LastEmptied = &ts
+	wc.emptyings = append(wc.emptyings, Emptying{
+		ID:               emptyingID(wc.ID, ts),
+		WasteContainerID: wc.ID,
+		Tenant:           wc.Tenant,
+		Timestamp:        ts,
+		PercentBefore:    percentBefore,
+		PercentAfter:     percentAfter,
+		LevelBefore:      levelBefore,
+		LevelAfter:       levelAfter,
+	})
+}
+
+// emptyingID is derived from the waste container and the time of the emptying so that
+// an emptying that is detected again, i.e. when a message is redelivered, gets the same id
+func emptyingID(id string, ts time.Time) string {
+	return ids.DeterministicUUID(fmt.Sprintf("%s:%d", id, ts.UnixNano()))
+}
+
+// observePercent adds an observation to the percent history and computes the fill rate and the time when the
+// container is predicted to be full. Returns true if the fill rate or the predicted full time changed. Observations
+// that are older than the latest observation are ignored.
+func (wc *WasteContainer) observePercent(percent float64, ts time.Time) bool {
+	cfg := wc.config.withDefaults()
+
+	if n := len(wc.PercentHistory); n > 0 {
+		latest := wc.PercentHistory[n-1]
+
+		if !ts.After(latest.Timestamp) {
+			return false
+		}
+
+		if latest.Value-percent >= cfg.EmptyingDrop {
+			wc.PercentHistory = nil
+		}
+	}
+
+	wc.PercentHistory = append(wc.PercentHistory, Observation{Value: percent, Timestamp: ts})
+
+	wc.PercentHistory = slices.DeleteFunc(wc.PercentHistory, func(o Observation) bool {
+		return ts.Sub(o.Timestamp) > cfg.HistoryMaxAge
+	})
+
+	if n := len(wc.PercentHistory); n > cfg.HistoryMaxCount {
+		wc.PercentHistory = slices.Clone(wc.PercentHistory[n-cfg.HistoryMaxCount:])
+	}
+
+	fillRate, predictedFull := wc.FillRate, wc.PredictedFull
+
+	wc.predictFull(percent, ts)
+	wc.recorded = true
+
+	return !equalPtr(fillRate, wc.FillRate) || !equalTime(predictedFull, wc.PredictedFull)
+}
+
+func equalPtr(a, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func equalTime(a, b *time.Time) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Equal(*b))
+}
+
+// predictFull computes the fill rate from the percent history and the time when the container is predicted to be full
+func (wc *WasteContainer) predictFull(percent float64, ts time.Time) {
+	cfg := wc.config.withDefaults()
+
+	wc.FillRate = fillRate(wc.PercentHistory)
+	wc.PredictedFull = nil
+
+	if wc.FillRate == nil {
+		return
+	}
+
+	if percent >= cfg.FullThreshold {
+		wc.PredictedFull = &ts
+		return
+	}
+
+	if *wc.FillRate > 0 {
+		hours := (cfg.FullThreshold - percent) / *wc.FillRate
+		predicted := ts.Add(time.Duration(hours * float64(time.Hour))).UTC()
+		wc.PredictedFull = &predicted
+	}
+}
+
+// fillRate returns the slope, in percent per hour, of the least squares fit of the observations.
+// Returns nil if there are less than two observations.
+func fillRate(observations []Observation) *float64 {
+	if len(observations) < 2 {
+		return nil
+	}
+
+	start := observations[0].Timestamp
+	n := float64(len(observations))
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, o := range observations {
+		x := o.Timestamp.Sub(start).Hours()
+		sumX += x
+		sumY += o.Value
+		sumXY += x * o.Value
+		sumXX += x * x
+	}
+
+	d := n*sumXX - sumX*sumX
+	if d == 0 {
+		return nil
+	}
+
+	rate := (n*sumXY - sumX*sumY) / d
+
+	return &rate
 }
@@ -1,3 +1,392 @@
 package wastecontainer
 
-//TODO: impl. tests for Handle
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application/alarms"
+	"github.com/diwise/cip-functions/internal/pkg/application/things"
+	"github.com/matryer/is"
+)
+
+type levelMessage struct {
+	ID    string `json:"id"`
+	Level struct {
+		Current float64  `json:"current"`
+		Percent *float64 `json:"percent,omitempty"`
+	} `json:"level"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (m levelMessage) Body() []byte {
+	b, _ := json.Marshal(m)
+	return b
+}
+func (m levelMessage) ContentType() string {
+	return "application/vnd.diwise.level+json"
+}
+func (m levelMessage) TopicName() string {
+	return "function.updated"
+}
+
+func newLevelMessage(percent float64, ts time.Time) levelMessage {
+	m := levelMessage{ID: "level:1", Timestamp: ts}
+	m.Level.Current = percent / 100
+	m.Level.Percent = &percent
+	return m
+}
+
+type temperatureMessage []byte
+
+func (m temperatureMessage) Body() []byte {
+	return m
+}
+func (m temperatureMessage) ContentType() string {
+	return "application/vnd.oma.lwm2m.ext.3303"
+}
+func (m temperatureMessage) TopicName() string {
+	return "message.accepted"
+}
+
+func newTemperatureMessage(temperature float64, ts time.Time) temperatureMessage {
+	return temperatureMessage(fmt.Sprintf(`{"pack":[{"bn":"dev:1/3303/","bt":%d,"n":"0","vs":"urn:oma:lwm2m:ext:3303"},{"n":"5700","v":%g}],"timestamp":"%s"}`, ts.Unix(), temperature, ts.Format(time.RFC3339)))
+}
+
+func limit(l float64) *float64 {
+	return &l
+}
+
+var tc = &things.ClientMock{
+	FindByIDFunc: func(ctx context.Context, id, thingType string) (things.Thing, error) {
+		return things.Thing{ID: id, Type: "WasteContainer"}, nil
+	},
+}
+
+func TestFillRateAndPredictedFull(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := NewWasteContainerFactory(Config{FullThreshold: 90})("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	_, err := wc.Handle(ctx, newLevelMessage(10, start), tc)
+	is.NoErr(err)
+	is.Equal(nil, wc.FillRate) // a single observation is not enough
+
+	for i, percent := range []float64{12, 14, 16} {
+		_, err = wc.Handle(ctx, newLevelMessage(percent, start.Add(time.Duration(i+1)*time.Hour)), tc)
+		is.NoErr(err)
+	}
+
+	is.Equal(4, len(wc.PercentHistory))
+	is.Equal(2.0, *wc.FillRate)
+	is.Equal(start.Add(3*time.Hour+37*time.Hour), *wc.PredictedFull) // (90-16)/2 = 37 hours after the last observation
+}
+
+func TestUnchangedPercentIsAddedToHistory(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := NewWasteContainerFactory(Config{FullThreshold: 90})("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(10, start), tc)
+	wc.Handle(ctx, newLevelMessage(20, start.Add(time.Hour)), tc)
+	is.Equal(10.0, *wc.FillRate)
+
+	// the container stops filling
+	for i := range 4 {
+		changed, err := wc.Handle(ctx, newLevelMessage(20, start.Add(time.Duration(i+2)*time.Hour)), tc)
+		is.NoErr(err)
+		is.True(changed)
+	}
+
+	is.Equal(6, len(wc.PercentHistory))
+	is.True(*wc.FillRate < 10.0)
+	is.Equal(start.Add(5*time.Hour), wc.DateObserved)
+}
+
+func TestUnchangedFillRateIsRecordedButNotAChange(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := NewWasteContainerFactory(Config{FullThreshold: 90})("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(20, start), tc)
+	changed, _ := wc.Handle(ctx, newLevelMessage(20, start.Add(time.Hour)), tc)
+	is.True(changed) // the first fill rate is computed
+	is.Equal(0.0, *wc.FillRate)
+
+	changed, err := wc.Handle(ctx, newLevelMessage(20, start.Add(2*time.Hour)), tc)
+	is.NoErr(err)
+	is.True(!changed)                 // neither level, fill rate nor predicted full time changed
+	is.True(wc.RecordedObservation()) // but the observation is recorded and should be stored
+	is.Equal(3, len(wc.PercentHistory))
+
+	changed, _ = wc.Handle(ctx, newLevelMessage(20, start), tc)
+	is.True(!changed)
+	is.True(!wc.RecordedObservation()) // out of order
+}
+
+func TestHistoryStartsOverWhenEmptied(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := WasteContainerFactory("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(70, start), tc)
+	wc.Handle(ctx, newLevelMessage(80, start.Add(time.Hour)), tc)
+	wc.Handle(ctx, newLevelMessage(5, start.Add(2*time.Hour)), tc)
+
+	is.Equal(1, len(wc.PercentHistory))
+	is.Equal(nil, wc.FillRate)
+	is.Equal(nil, wc.PredictedFull)
+}
+
+func TestHistoryIsLimited(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := NewWasteContainerFactory(Config{HistoryMaxCount: 3, HistoryMaxAge: 24 * time.Hour})("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	for i := range 5 {
+		wc.Handle(ctx, newLevelMessage(float64(10+i), start.Add(time.Duration(i)*time.Hour)), tc)
+	}
+	is.Equal(3, len(wc.PercentHistory))
+	is.Equal(12.0, wc.PercentHistory[0].Value)
+
+	wc.Handle(ctx, newLevelMessage(20, start.Add(30*time.Hour)), tc)
+	is.Equal(1, len(wc.PercentHistory)) // older observations are outside the max age
+}
+
+func TestOutOfOrderObservationIsNotAddedToHistory(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := WasteContainerFactory("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(10, start), tc)
+	wc.Handle(ctx, newLevelMessage(20, start.Add(time.Hour)), tc)
+	wc.Handle(ctx, newLevelMessage(15, start.Add(30*time.Minute)), tc)
+
+	is.Equal(2, len(wc.PercentHistory))
+	is.Equal(10.0, *wc.FillRate)
+}
+
+func TestEmptyingIsDetected(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := NewWasteContainerFactory(Config{EmptyingDrop: 50})("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(80, start), tc)
+	is.Equal(0, len(wc.DetectedEmptyings()))
+
+	wc.Handle(ctx, newLevelMessage(40, start.Add(time.Hour)), tc)
+	is.Equal(0, len(wc.DetectedEmptyings())) // a drop of 40 is less than the emptying drop
+
+	wc.Handle(ctx, newLevelMessage(90, start.Add(2*time.Hour)), tc)
+	wc.Handle(ctx, newLevelMessage(5, start.Add(3*time.Hour)), tc)
+
+	is.Equal(1, len(wc.DetectedEmptyings()))
+	e := wc.DetectedEmptyings()[0]
+	is.Equal("wc:1", e.WasteContainerID)
+	is.Equal(start.Add(3*time.Hour), e.Timestamp)
+	is.Equal(90.0, e.PercentBefore)
+	is.Equal(5.0, e.PercentAfter)
+	is.Equal(0.9, *e.LevelBefore)
+	is.Equal(0.05, e.LevelAfter)
+	is.Equal(start.Add(3*time.Hour), *wc.LastEmptied)
+
+	is.Equal("cip-function.emptied", e.TopicName())
+	is.Equal(e.ID, emptyingID("wc:1", start.Add(3*time.Hour))) // the id should be the same if detected again
+
+	wc.Handle(ctx, newLevelMessage(6, start.Add(4*time.Hour)), tc)
+	is.Equal(0, len(wc.DetectedEmptyings()))
+}
+
+func TestEmptyingWithoutTimestampIsDetectedWhenReceived(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := WasteContainerFactory("wc:1", "default")
+	before := time.Now().UTC()
+
+	wc.Handle(ctx, newLevelMessage(80, before.Add(-time.Hour)), tc)
+	wc.Handle(ctx, newLevelMessage(5, time.Time{}), tc)
+
+	is.Equal(1, len(wc.DetectedEmptyings()))
+	e := wc.DetectedEmptyings()[0]
+	is.True(!e.Timestamp.Before(before))
+	is.Equal(e.Timestamp, *wc.LastEmptied)
+	is.Equal(e.Timestamp, wc.DateObserved)
+}
+
+func TestOutOfOrderObservationIsNotAnEmptying(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := WasteContainerFactory("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(80, start), tc)
+	wc.Handle(ctx, newLevelMessage(10, start.Add(-time.Hour)), tc)
+
+	is.Equal(0, len(wc.DetectedEmptyings()))
+}
+
+func TestClamp(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	wc := WasteContainerFactory("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newLevelMessage(80, start), tc)
+	wc.Handle(ctx, newLevelMessage(120, start.Add(time.Hour)), tc)
+
+	valid, err := wc.Validate()
+	is.True(!valid)
+	is.True(err != nil)
+
+	wc.Clamp()
+
+	valid, _ = wc.Validate()
+	is.True(valid)
+	is.Equal(100.0, *wc.Percent)
+	is.Equal(100.0, wc.PercentHistory[1].Value)
+	is.Equal(20.0, *wc.FillRate) // computed from the clamped history
+}
+
+func TestHighTemperatureRaisesFireRiskAlert(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{FireRisk: FireRiskConfig{
+		Temperature: alarms.Threshold{Limit: limit(60), Hysteresis: 5},
+	}}
+
+	wc := NewWasteContainerFactory(cfg)("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	changed, err := wc.Handle(ctx, newTemperatureMessage(20, start), tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.True(!wc.FireRisk)
+	is.Equal(0, len(wc.FireRiskAlerts()))
+
+	changed, err = wc.Handle(ctx, newTemperatureMessage(70, start.Add(time.Hour)), tc)
+	is.NoErr(err)
+	is.True(changed)
+	is.True(wc.FireRisk)
+	is.Equal(1, len(wc.FireRiskAlerts()))
+
+	a := wc.FireRiskAlerts()[0]
+	is.Equal(HighTemperatureAlert, a.Alert)
+	is.True(a.Active)
+	is.True(a.FireRisk)
+	is.Equal(70.0, a.Temperature)
+	is.Equal(60.0, a.Limit)
+	is.Equal("cip-function.firerisk", a.TopicName())
+
+	wc.Handle(ctx, newTemperatureMessage(57, start.Add(2*time.Hour)), tc)
+	is.True(wc.FireRisk) // still within the hysteresis
+	is.Equal(0, len(wc.FireRiskAlerts()))
+
+	wc.Handle(ctx, newTemperatureMessage(50, start.Add(3*time.Hour)), tc)
+	is.True(!wc.FireRisk)
+	is.Equal(1, len(wc.FireRiskAlerts()))
+	is.True(!wc.FireRiskAlerts()[0].Active)
+}
+
+func TestRapidTemperatureRiseRaisesFireRiskAlert(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{FireRisk: FireRiskConfig{
+		Temperature: alarms.Threshold{Limit: limit(60)},
+		RiseRate:    alarms.Threshold{Limit: limit(20)},
+	}}
+
+	wc := NewWasteContainerFactory(cfg)("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newTemperatureMessage(20, start), tc)
+	wc.Handle(ctx, newTemperatureMessage(35, start.Add(30*time.Minute)), tc)
+
+	is.Equal(30.0, *wc.TemperatureRise)
+	is.True(wc.FireRisk)
+	is.Equal(1, len(wc.FireRiskAlerts()))
+	is.Equal(RapidTemperatureRiseAlert, wc.FireRiskAlerts()[0].Alert)
+	is.Equal(30.0, wc.FireRiskAlerts()[0].Value)
+}
+
+func TestTemperatureRiseIsComputedForFastReportingSensor(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{FireRisk: FireRiskConfig{
+		RiseRate: alarms.Threshold{Limit: limit(20)},
+	}}
+
+	wc := NewWasteContainerFactory(cfg)("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	// the temperature is reported every 10 seconds and rises by 1 degree each time, i.e. 360 degrees per hour
+	for i := range 13 {
+		wc.Handle(ctx, newTemperatureMessage(20+float64(i), start.Add(time.Duration(i)*10*time.Second)), tc)
+	}
+
+	is.True(wc.TemperatureRise != nil)
+	is.Equal(360.0, math.Round(*wc.TemperatureRise))
+	is.True(wc.FireRisk)
+}
+
+func TestOutOfOrderTemperatureIsIgnored(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	cfg := Config{FireRisk: FireRiskConfig{
+		Temperature: alarms.Threshold{Limit: limit(60)},
+	}}
+
+	wc := NewWasteContainerFactory(cfg)("wc:1", "default")
+	start := time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC)
+
+	wc.Handle(ctx, newTemperatureMessage(20, start), tc)
+	changed, _ := wc.Handle(ctx, newTemperatureMessage(80, start.Add(-time.Hour)), tc)
+
+	is.True(!changed)
+	is.Equal(20.0, *wc.Temperature)
+	is.True(!wc.FireRisk)
+}
+
+func TestFireRiskThresholdsCanBeOverridden(t *testing.T) {
+	is := is.New(t)
+
+	cfg := FireRiskConfig{
+		Temperature: alarms.Threshold{Limit: limit(60), Hysteresis: 5},
+		RiseRate:    alarms.Threshold{Limit: limit(20)},
+		Tenants: map[string]FireRiskThresholds{
+			"south": {Temperature: alarms.Threshold{Limit: limit(70)}},
+		},
+		Containers: map[string]FireRiskThresholds{
+			"wc:1": {Temperature: alarms.Threshold{Limit: limit(50)}},
+		},
+	}
+
+	is.Equal(60.0, *cfg.thresholdsFor("wc:2", "default").Temperature.Limit)
+	is.Equal(70.0, *cfg.thresholdsFor("wc:2", "south").Temperature.Limit)
+	is.Equal(5.0, cfg.thresholdsFor("wc:2", "south").Temperature.Hysteresis)
+	is.Equal(20.0, *cfg.thresholdsFor("wc:2", "south").RiseRate.Limit)
+	is.Equal(50.0, *cfg.thresholdsFor("wc:1", "south").Temperature.Limit) // the container takes precedence over the tenant
+}
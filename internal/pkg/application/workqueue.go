@@ -0,0 +1,128 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ErrQueueFull = errors.New("work queue is full")
+
+const defaultMaxQueueSize int = 100
+
+var (
+	workQueueKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cip_functions_workqueue_keys",
+		Help: "Number of things with queued or running work",
+	})
+	workQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cip_functions_workqueue_depth",
+		Help: "Number of queued work items, for all things, that are waiting to run",
+	})
+	workQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cip_functions_workqueue_wait_seconds",
+		Help:    "Time a work item spent in queue before it started to run",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	workQueueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cip_functions_workqueue_rejected_total",
+		Help: "Number of work items rejected because the queue for a thing was full",
+	})
+)
+
+// KeyedQueue serializes work per key, i.e. per thing, while work for different keys runs in parallel.
+// Each key has a goroutine that exits as soon as there is no more work queued for that key. Work is run in the
+// order it is queued, which is not necessarily the order in which messages were received since each message is
+// handled in its own goroutine.
+type KeyedQueue struct {
+	mu           sync.Mutex
+	workers      map[string]chan *work
+	maxQueueSize int
+}
+
+type work struct {
+	ctx      context.Context
+	fn       func(ctx context.Context) error
+	done     chan error
+	enqueued time.Time
+}
+
+func NewKeyedQueue(maxQueueSize int) *KeyedQueue {
+	if maxQueueSize <= 0 {
+		maxQueueSize = defaultMaxQueueSize
+	}
+
+	return &KeyedQueue{
+		workers:      map[string]chan *work{},
+		maxQueueSize: maxQueueSize,
+	}
+}
+
+// Do runs fn when all work queued before it for the same key has completed, and waits for it to return.
+// ErrQueueFull is returned if there are already maxQueueSize work items waiting for key.
+func (q *KeyedQueue) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	w := &work{
+		ctx:      ctx,
+		fn:       fn,
+		done:     make(chan error, 1),
+		enqueued: time.Now(),
+	}
+
+	q.mu.Lock()
+
+	queue, ok := q.workers[key]
+	if !ok {
+		queue = make(chan *work, q.maxQueueSize)
+		q.workers[key] = queue
+		workQueueKeys.Inc()
+
+		go q.run(key, queue)
+	}
+
+	select {
+	case queue <- w:
+		workQueueDepth.Inc()
+	default:
+		q.mu.Unlock()
+		workQueueRejected.Inc()
+		return ErrQueueFull
+	}
+
+	q.mu.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *KeyedQueue) run(key string, queue chan *work) {
+	for {
+		// work is only added while holding the lock, so an empty queue can safely be removed
+		q.mu.Lock()
+		if len(queue) == 0 {
+			delete(q.workers, key)
+			workQueueKeys.Dec()
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		w := <-queue
+		workQueueDepth.Dec()
+		workQueueWait.Observe(time.Since(w.enqueued).Seconds())
+
+		if err := w.ctx.Err(); err != nil {
+			w.done <- err
+			continue
+		}
+
+		w.done <- w.fn(w.ctx)
+	}
+}
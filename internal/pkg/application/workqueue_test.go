@@ -0,0 +1,121 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestWorkForSameKeyIsSerialized(t *testing.T) {
+	is := is.New(t)
+	q := NewKeyedQueue(100)
+
+	var running, maxRunning int32
+	order := []int{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.Do(context.Background(), "sewer:1", func(ctx context.Context) error {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+
+				mu.Lock()
+				if n > maxRunning {
+					maxRunning = n
+				}
+				order = append(order, i)
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+			is.NoErr(err)
+		}()
+	}
+
+	wg.Wait()
+
+	is.Equal(int32(1), maxRunning)
+	is.Equal(20, len(order))
+}
+
+func TestWorkForDifferentKeysRunsInParallel(t *testing.T) {
+	is := is.New(t)
+	q := NewKeyedQueue(100)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+
+	for i := range 2 {
+		go func() {
+			errs <- q.Do(context.Background(), fmt.Sprintf("sewer:%d", i), func(ctx context.Context) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("work for different keys did not run in parallel")
+		}
+	}
+
+	close(release)
+	is.NoErr(<-errs)
+	is.NoErr(<-errs)
+}
+
+func TestWorkIsRejectedWhenQueueIsFull(t *testing.T) {
+	is := is.New(t)
+	q := NewKeyedQueue(1)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 2)
+
+	go func() {
+		done <- q.Do(context.Background(), "sewer:1", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	go func() {
+		done <- q.Do(context.Background(), "sewer:1", func(ctx context.Context) error { return nil })
+	}()
+
+	// wait until the second work item is queued
+	for {
+		q.mu.Lock()
+		queued := len(q.workers["sewer:1"])
+		q.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := q.Do(context.Background(), "sewer:1", func(ctx context.Context) error { return nil })
+	is.True(errors.Is(err, ErrQueueFull))
+
+	close(release)
+	is.NoErr(<-done)
+	is.NoErr(<-done)
+}
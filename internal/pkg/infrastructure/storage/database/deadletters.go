@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/jackc/pgx/v5"
+)
+
+const deadLetterColumns string = "id, topic, content_type, body, handler_type, tenant, error, trace_id, attempts, created_on, updated_on"
+
+func (jds *JsonDataStore) StoreDeadLetter(ctx context.Context, dl storage.DeadLetter) error {
+	defer observeDuration("store_dead_letter")()
+
+	_, err := jds.db.Exec(ctx, `
+		insert into cip_fnct_deadletter (id, topic, content_type, body, handler_type, tenant, error, trace_id, attempts)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict (id) do update
+		set error = excluded.error, trace_id = excluded.trace_id, attempts = excluded.attempts, updated_on = CURRENT_TIMESTAMP`,
+		dl.ID, dl.Topic, dl.ContentType, dl.Body, strings.ToLower(dl.HandlerType), dl.Tenant, dl.Error, dl.TraceID, dl.Attempts)
+
+	return err
+}
+
+func (jds *JsonDataStore) GetDeadLetter(ctx context.Context, id string) (storage.DeadLetter, error) {
+	defer observeDuration("get_dead_letter")()
+
+	row := jds.db.QueryRow(ctx, `select `+deadLetterColumns+` from cip_fnct_deadletter where id = $1`, id)
+
+	dl, err := scanDeadLetter(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storage.DeadLetter{}, storage.ErrNotFound
+		}
+		return storage.DeadLetter{}, err
+	}
+
+	return dl, nil
+}
+
+func (jds *JsonDataStore) QueryDeadLetters(ctx context.Context, params storage.DeadLetterQuery) ([]storage.DeadLetter, int64, error) {
+	defer observeDuration("query_dead_letters")()
+
+	where, args := deadLetterQueryFilter(params)
+
+	var total int64
+	err := jds.db.QueryRow(ctx, `select count(*) from cip_fnct_deadletter `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `select ` + deadLetterColumns + ` from cip_fnct_deadletter ` + where + ` order by created_on asc, id asc`
+
+	if params.Offset > 0 {
+		args = append(args, params.Offset)
+		query += fmt.Sprintf(" offset $%d", len(args))
+	}
+
+	if params.Limit > 0 {
+		args = append(args, params.Limit)
+		query += fmt.Sprintf(" limit $%d", len(args))
+	}
+
+	rows, err := jds.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	deadLetters := []storage.DeadLetter{}
+
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+
+	return deadLetters, total, rows.Err()
+}
+
+func (jds *JsonDataStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	defer observeDuration("delete_dead_letter")()
+
+	tag, err := jds.db.Exec(ctx, `delete from cip_fnct_deadletter where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+func (jds *JsonDataStore) PurgeDeadLetters(ctx context.Context, params storage.DeadLetterQuery) (int64, error) {
+	defer observeDuration("purge_dead_letters")()
+
+	where, args := deadLetterQueryFilter(params)
+
+	tag, err := jds.db.Exec(ctx, `delete from cip_fnct_deadletter `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func scanDeadLetter(row pgx.Row) (storage.DeadLetter, error) {
+	var dl storage.DeadLetter
+	var updated *time.Time
+
+	err := row.Scan(&dl.ID, &dl.Topic, &dl.ContentType, &dl.Body, &dl.HandlerType, &dl.Tenant, &dl.Error, &dl.TraceID, &dl.Attempts, &dl.Created, &updated)
+	if err != nil {
+		return storage.DeadLetter{}, err
+	}
+
+	dl.Created = dl.Created.UTC()
+	dl.Updated = dl.Created
+	if updated != nil {
+		dl.Updated = updated.UTC()
+	}
+
+	return dl, nil
+}
+
+func deadLetterQueryFilter(params storage.DeadLetterQuery) (string, []any) {
+	args := []any{}
+	filters := []string{}
+
+	if params.Topic != "" {
+		args = append(args, params.Topic)
+		filters = append(filters, fmt.Sprintf("topic = $%d", len(args)))
+	}
+
+	if params.HandlerType != "" {
+		args = append(args, strings.ToLower(params.HandlerType))
+		filters = append(filters, fmt.Sprintf("handler_type = $%d", len(args)))
+	}
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		filters = append(filters, fmt.Sprintf("tenant = any($%d)", len(args)))
+	}
+
+	if params.Error != "" {
+		args = append(args, params.Error)
+		filters = append(filters, fmt.Sprintf("error = $%d", len(args)))
+	}
+
+	if !params.Before.IsZero() {
+		args = append(args, params.Before.UTC())
+		filters = append(filters, fmt.Sprintf("created_on < $%d", len(args)))
+	}
+
+	if len(filters) == 0 {
+		return "", args
+	}
+
+	return "where " + strings.Join(filters, " and "), args
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) IsMessageProcessed(ctx context.Context, hash, thingID, thingType string) (bool, error) {
+	defer observeDuration("is_message_processed")()
+
+	var n int32
+
+	err := jds.db.QueryRow(ctx, `
+		select count(*) from cip_fnct_processed
+		where hash = $1 and thing_id = $2 and thing_type = $3 and expires_on > CURRENT_TIMESTAMP`,
+		hash, strings.ToLower(thingID), strings.ToLower(thingType)).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (jds *JsonDataStore) MarkMessageProcessed(ctx context.Context, hash, thingID, thingType string, expires time.Time) error {
+	defer observeDuration("mark_message_processed")()
+
+	return markMessageProcessed(ctx, jds.db, storage.ProcessedMessage{Hash: hash, ThingID: thingID, ThingType: thingType, Expires: expires})
+}
+
+func markMessageProcessed(ctx context.Context, db execer, p storage.ProcessedMessage) error {
+	_, err := db.Exec(ctx, `
+		insert into cip_fnct_processed (hash, thing_id, thing_type, expires_on) values ($1, $2, $3, $4)
+		on conflict (hash, thing_id, thing_type) do update set expires_on = excluded.expires_on`,
+		p.Hash, strings.ToLower(p.ThingID), strings.ToLower(p.ThingType), p.Expires.UTC())
+
+	return err
+}
+
+func (jds *JsonDataStore) PurgeProcessedMessages(ctx context.Context, expiredBefore time.Time) (int64, error) {
+	defer observeDuration("purge_processed_messages")()
+
+	tag, err := jds.db.Exec(ctx, `delete from cip_fnct_processed where expires_on < $1`, expiredBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
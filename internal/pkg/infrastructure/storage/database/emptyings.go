@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) StoreEmptying(ctx context.Context, e storage.Emptying) error {
+	defer observeDuration("store_emptying")()
+
+	return storeEmptying(ctx, jds.db, e)
+}
+
+func storeEmptying(ctx context.Context, db execer, e storage.Emptying) error {
+	_, err := db.Exec(ctx, `
+		insert into cip_fnct_emptying (id, wastecontainer_id, tenant, emptied_on, percent_before, percent_after, level_before, level_after)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (wastecontainer_id, id) do nothing`,
+		e.ID, strings.ToLower(e.WasteContainerID), e.Tenant, e.Timestamp.UTC(), e.PercentBefore, e.PercentAfter, e.LevelBefore, e.LevelAfter)
+
+	return err
+}
+
+func (jds *JsonDataStore) QueryEmptyings(ctx context.Context, params storage.EmptyingQuery) ([]storage.Emptying, error) {
+	defer observeDuration("query_emptyings")()
+
+	where, args := emptyingQueryFilter(params)
+
+	query := `
+		select id, wastecontainer_id, tenant, emptied_on, percent_before, percent_after, level_before, level_after
+		from cip_fnct_emptying ` + where + ` order by emptied_on asc, id asc`
+
+	if params.Offset > 0 {
+		args = append(args, params.Offset)
+		query += fmt.Sprintf(" offset $%d", len(args))
+	}
+
+	if params.Limit > 0 {
+		args = append(args, params.Limit)
+		query += fmt.Sprintf(" limit $%d", len(args))
+	}
+
+	rows, err := jds.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emptyings := []storage.Emptying{}
+
+	for rows.Next() {
+		var e storage.Emptying
+
+		err = rows.Scan(&e.ID, &e.WasteContainerID, &e.Tenant, &e.Timestamp, &e.PercentBefore, &e.PercentAfter, &e.LevelBefore, &e.LevelAfter)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Timestamp = e.Timestamp.UTC()
+		emptyings = append(emptyings, e)
+	}
+
+	return emptyings, rows.Err()
+}
+
+func emptyingQueryFilter(params storage.EmptyingQuery) (string, []any) {
+	args := []any{}
+	conditions := []string{}
+
+	if params.WasteContainerID != "" {
+		args = append(args, strings.ToLower(params.WasteContainerID))
+		conditions = append(conditions, fmt.Sprintf("wastecontainer_id = $%d", len(args)))
+	}
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		conditions = append(conditions, fmt.Sprintf("tenant = any($%d)", len(args)))
+	}
+
+	if !params.From.IsZero() {
+		args = append(args, params.From.UTC())
+		conditions = append(conditions, fmt.Sprintf("emptied_on >= $%d", len(args)))
+	}
+
+	if !params.To.IsZero() {
+		args = append(args, params.To.UTC())
+		conditions = append(conditions, fmt.Sprintf("emptied_on < $%d", len(args)))
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+
+	return "where " + strings.Join(conditions, " and "), args
+}
@@ -3,10 +3,14 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -14,6 +18,11 @@ type JsonDataStore struct {
 	db *pgxpool.Pool
 }
 
+// execer is implemented by both the pool and a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
 type Config struct {
 	host     string
 	user     string
@@ -69,11 +78,17 @@ func (jds *JsonDataStore) Close() {
 	jds.db.Close()
 }
 
+func (jds *JsonDataStore) Ping(ctx context.Context) error {
+	return jds.db.Ping(ctx)
+}
+
 func (jds *JsonDataStore) Initialize(ctx context.Context) error {
 	return jds.createTables(ctx)
 }
 
 func (jds *JsonDataStore) Create(ctx context.Context, id, typeName string, value any) error {
+	defer observeDuration("create")()
+
 	b, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -92,6 +107,8 @@ func (jds *JsonDataStore) Create(ctx context.Context, id, typeName string, value
 }
 
 func (jds *JsonDataStore) Update(ctx context.Context, id, typeName string, value any) error {
+	defer observeDuration("update")()
+
 	b, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -100,7 +117,7 @@ func (jds *JsonDataStore) Update(ctx context.Context, id, typeName string, value
 	id = strings.ToLower(id)
 	typeName = strings.ToLower(typeName)
 
-	_, err = jds.db.Exec(ctx, `update cip_fnct set data = $3, updated_on=CURRENT_TIMESTAMP where id = $1 and type = $2`, id, typeName, string(b))
+	_, err = jds.db.Exec(ctx, `update cip_fnct set data = $3, updated_on=CURRENT_TIMESTAMP, version = version + 1 where id = $1 and type = $2`, id, typeName, string(b))
 	if err != nil {
 		return err
 	}
@@ -109,6 +126,8 @@ func (jds *JsonDataStore) Update(ctx context.Context, id, typeName string, value
 }
 
 func (jds *JsonDataStore) Read(ctx context.Context, id, typeName string) (any, error) {
+	defer observeDuration("read")()
+
 	var obj any
 
 	id = strings.ToLower(id)
@@ -116,13 +135,166 @@ func (jds *JsonDataStore) Read(ctx context.Context, id, typeName string) (any, e
 
 	err := jds.db.QueryRow(ctx, `select data from cip_fnct where id=$1 and type=$2`, id, typeName).Scan(&obj)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
 		return nil, err
 	}
 
 	return obj, nil
 }
 
+func (jds *JsonDataStore) ReadWithVersion(ctx context.Context, id, typeName string) (any, int64, error) {
+	defer observeDuration("read_with_version")()
+
+	var obj any
+	var version int64
+
+	id = strings.ToLower(id)
+	typeName = strings.ToLower(typeName)
+
+	err := jds.db.QueryRow(ctx, `select data, version from cip_fnct where id=$1 and type=$2`, id, typeName).Scan(&obj, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, 0, storage.ErrNotFound
+		}
+		return nil, 0, err
+	}
+
+	return obj, version, nil
+}
+
+func (jds *JsonDataStore) Upsert(ctx context.Context, id, typeName string, value any, version int64) (int64, error) {
+	return jds.UpsertWithOutbox(ctx, id, typeName, value, version, nil, storage.Events{})
+}
+
+func (jds *JsonDataStore) UpsertWithOutbox(ctx context.Context, id, typeName string, value any, version int64, messages []storage.OutboxMessage, events storage.Events) (int64, error) {
+	defer observeDuration("upsert")()
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+
+	id = strings.ToLower(id)
+	typeName = strings.ToLower(typeName)
+	cipID := fmt.Sprintf("urn:diwise:%s:%s", typeName, id)
+
+	tx, err := jds.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var newVersion int64
+
+	// the update is skipped, and no row is returned, if the stored version has changed since it was read
+	err = tx.QueryRow(ctx, `
+		insert into cip_fnct (cip_id, id, type, data, version) values ($1, $2, $3, $4, 1)
+		on conflict (id, type) do update
+		set data = excluded.data, updated_on = CURRENT_TIMESTAMP, version = cip_fnct.version + 1
+		where $5::bigint < 0 or cip_fnct.version = $5::bigint
+		returning version`, cipID, id, typeName, string(b), version).Scan(&newVersion)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, storage.ErrConcurrencyConflict
+		}
+		return 0, err
+	}
+
+	for _, m := range messages {
+		_, err = tx.Exec(ctx, `insert into cip_fnct_outbox (topic, content_type, body) values ($1, $2, $3)`, m.Topic, m.ContentType, m.Body)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, o := range events.Overflows {
+		if err = storeOverflow(ctx, tx, o); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, c := range events.PumpCycles {
+		if err = storePumpCycle(ctx, tx, c); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, e := range events.Emptyings {
+		if err = storeEmptying(ctx, tx, e); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, p := range events.Processed {
+		if err = markMessageProcessed(ctx, tx, p); err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return newVersion, nil
+}
+
+func (jds *JsonDataStore) ReadAll(ctx context.Context, typeName string, params storage.QueryParams) (storage.QueryResult, error) {
+	defer observeDuration("read_all")()
+
+	typeName = strings.ToLower(typeName)
+
+	args := []any{typeName}
+	where := "where type = $1"
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		where += fmt.Sprintf(" and data->>'tenant' = any($%d)", len(args))
+	}
+
+	var total int64
+	err := jds.db.QueryRow(ctx, `select count(*) from cip_fnct `+where, args...).Scan(&total)
+	if err != nil {
+		return storage.QueryResult{}, err
+	}
+
+	args = append(args, params.Offset, params.Limit)
+	query := fmt.Sprintf(`select data from cip_fnct %s order by id asc offset $%d limit $%d`, where, len(args)-1, len(args))
+
+	rows, err := jds.db.Query(ctx, query, args...)
+	if err != nil {
+		return storage.QueryResult{}, err
+	}
+	defer rows.Close()
+
+	data := make([]any, 0, params.Limit)
+
+	for rows.Next() {
+		var obj any
+		err = rows.Scan(&obj)
+		if err != nil {
+			return storage.QueryResult{}, err
+		}
+		data = append(data, obj)
+	}
+
+	if rows.Err() != nil {
+		return storage.QueryResult{}, rows.Err()
+	}
+
+	return storage.QueryResult{
+		Data:         data,
+		TotalRecords: total,
+		Offset:       params.Offset,
+		Limit:        params.Limit,
+	}, nil
+}
+
 func (jds *JsonDataStore) Exists(ctx context.Context, id, typeName string) bool {
+	defer observeDuration("exists")()
+
 	var n int32
 
 	id = strings.ToLower(id)
@@ -149,6 +321,118 @@ func (jds *JsonDataStore) createTables(ctx context.Context) error {
 		ALTER TABLE cip_fnct ADD COLUMN IF NOT EXISTS cip_id TEXT NOT NULL DEFAULT ''; 
 		ALTER TABLE cip_fnct ADD COLUMN IF NOT EXISTS created_on timestamp with time zone NULL DEFAULT CURRENT_TIMESTAMP;
 		ALTER TABLE cip_fnct ADD COLUMN IF NOT EXISTS updated_on timestamp with time zone NULL;
+		ALTER TABLE cip_fnct ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_overflow (
+			id          TEXT NOT NULL,
+			cso_id      TEXT NOT NULL,
+			tenant      TEXT NOT NULL,
+			state       BOOLEAN NOT NULL,
+			start_time  TIMESTAMP WITH TIME ZONE NOT NULL,
+			stop_time   TIMESTAMP WITH TIME ZONE NULL,
+			duration    BIGINT NOT NULL DEFAULT 0,
+			created_on  TIMESTAMP WITH TIME ZONE NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_on  TIMESTAMP WITH TIME ZONE NULL,
+			PRIMARY KEY(cso_id, id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_overflow_start_time_idx ON cip_fnct_overflow (cso_id, start_time);
+
+		-- overflows were only stored in the state of each CombinedSewageOverflow before the overflow table was added,
+		-- copy them to the table so that they are kept when the state is compacted. Already stored overflows are left as is.
+		INSERT INTO cip_fnct_overflow (id, cso_id, tenant, state, start_time, stop_time, duration)
+		SELECT o->>'id', f.id, coalesce(f.data->>'tenant', ''), coalesce((o->>'state')::boolean, false),
+			(o->>'startTime')::timestamptz, (o->>'stopTime')::timestamptz, coalesce((o->>'duration')::bigint, 0)
+		FROM cip_fnct f, jsonb_array_elements(CASE WHEN jsonb_typeof(f.data->'overflow') = 'array' THEN f.data->'overflow' ELSE '[]'::jsonb END) o
+		WHERE f.type = 'combinedsewageoverflow' AND o->>'id' IS NOT NULL AND o->>'startTime' IS NOT NULL
+		ON CONFLICT (cso_id, id) DO NOTHING;
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_pump_cycle (
+			id          TEXT NOT NULL,
+			sps_id      TEXT NOT NULL,
+			tenant      TEXT NOT NULL,
+			start_time  TIMESTAMP WITH TIME ZONE NOT NULL,
+			stop_time   TIMESTAMP WITH TIME ZONE NULL,
+			duration    BIGINT NOT NULL DEFAULT 0,
+			created_on  TIMESTAMP WITH TIME ZONE NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_on  TIMESTAMP WITH TIME ZONE NULL,
+			PRIMARY KEY(sps_id, id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_pump_cycle_start_time_idx ON cip_fnct_pump_cycle (sps_id, start_time);
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_emptying (
+			id                 TEXT NOT NULL,
+			wastecontainer_id  TEXT NOT NULL,
+			tenant             TEXT NOT NULL,
+			emptied_on         TIMESTAMP WITH TIME ZONE NOT NULL,
+			percent_before     NUMERIC NOT NULL,
+			percent_after      NUMERIC NOT NULL,
+			level_before       NUMERIC NULL,
+			level_after        NUMERIC NOT NULL,
+			created_on         TIMESTAMP WITH TIME ZONE NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY(wastecontainer_id, id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_emptying_emptied_on_idx ON cip_fnct_emptying (emptied_on);
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_quarantine (
+			id            BIGSERIAL,
+			thing_id      TEXT NOT NULL,
+			thing_type    TEXT NOT NULL,
+			tenant        TEXT NOT NULL,
+			topic         TEXT NOT NULL,
+			content_type  TEXT NOT NULL,
+			body          BYTEA NOT NULL,
+			reason        TEXT NOT NULL,
+			created_on    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY(id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_quarantine_thing_idx ON cip_fnct_quarantine (thing_type, thing_id, created_on);
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_deadletter (
+			id            TEXT NOT NULL,
+			topic         TEXT NOT NULL,
+			content_type  TEXT NOT NULL,
+			body          BYTEA NOT NULL,
+			handler_type  TEXT NOT NULL DEFAULT '',
+			error         TEXT NOT NULL,
+			trace_id      TEXT NOT NULL DEFAULT '',
+			attempts      INTEGER NOT NULL DEFAULT 1,
+			created_on    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_on    TIMESTAMP WITH TIME ZONE NULL,
+			PRIMARY KEY(id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_deadletter_created_on_idx ON cip_fnct_deadletter (created_on);
+
+		ALTER TABLE cip_fnct_deadletter ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_outbox (
+			id            BIGSERIAL,
+			topic         TEXT NOT NULL,
+			content_type  TEXT NOT NULL,
+			body          BYTEA NOT NULL,
+			attempts      INTEGER NOT NULL DEFAULT 0,
+			created_on    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			delivered_on  TIMESTAMP WITH TIME ZONE NULL,
+			PRIMARY KEY(id)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_outbox_undelivered_idx ON cip_fnct_outbox (id) WHERE delivered_on IS NULL;
+
+		ALTER TABLE cip_fnct_outbox ADD COLUMN IF NOT EXISTS failed_on TIMESTAMP WITH TIME ZONE NULL;
+
+		CREATE TABLE IF NOT EXISTS cip_fnct_processed (
+			hash        TEXT NOT NULL,
+			thing_id    TEXT NOT NULL,
+			thing_type  TEXT NOT NULL,
+			expires_on  TIMESTAMP WITH TIME ZONE NOT NULL,
+			PRIMARY KEY(hash, thing_id, thing_type)
+		);
+
+		CREATE INDEX IF NOT EXISTS cip_fnct_processed_expires_on_idx ON cip_fnct_processed (expires_on);
 		`
 
 	tx, err := jds.db.Begin(ctx)
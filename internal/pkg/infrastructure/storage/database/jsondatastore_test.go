@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -85,6 +86,347 @@ func TestSelect(t *testing.T) {
 	is.True(v != nil)
 }
 
+func TestUpsert(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	id := fmt.Sprintf("id:%d", time.Now().UnixNano())
+
+	version, err := s.Upsert(ctx, id, "person", person{Age: 30, Name: "John"}, 0)
+	is.NoErr(err)
+	is.Equal(int64(1), version)
+
+	_, err = s.Upsert(ctx, id, "person", person{Age: 31, Name: "John"}, 0)
+	is.True(errors.Is(err, storage.ErrConcurrencyConflict))
+
+	version, err = s.Upsert(ctx, id, "person", person{Age: 31, Name: "John"}, version)
+	is.NoErr(err)
+	is.Equal(int64(2), version)
+
+	p, v, err := storage.Load(ctx, s, id, person{})
+	is.NoErr(err)
+	is.Equal(31, p.Age)
+	is.Equal(version, v)
+}
+
+func TestOverflows(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	csoID := fmt.Sprintf("cso:%d", time.Now().UnixNano())
+	startTime := time.Date(2024, 4, 17, 15, 0, 0, 0, time.UTC)
+	stopTime := startTime.Add(15 * time.Minute)
+
+	overflow := storage.Overflow{ID: "overflow:1", CombinedSewageOverflowID: csoID, Tenant: "default", State: true, StartTime: startTime}
+	is.NoErr(s.StoreOverflow(ctx, overflow))
+
+	overflow.State = false
+	overflow.StopTime = &stopTime
+	overflow.Duration = 15 * time.Minute
+	is.NoErr(s.StoreOverflow(ctx, overflow))
+
+	is.NoErr(s.StoreOverflow(ctx, storage.Overflow{ID: "overflow:2", CombinedSewageOverflowID: csoID, Tenant: "default", StartTime: startTime.Add(24 * time.Hour)}))
+
+	overflows, err := s.QueryOverflows(ctx, storage.OverflowQuery{CombinedSewageOverflowID: csoID, From: startTime, To: startTime.Add(time.Hour)})
+	is.NoErr(err)
+	is.Equal(1, len(overflows))
+	is.Equal(15*time.Minute, overflows[0].Duration)
+
+	statistics, err := s.OverflowStatistics(ctx, storage.OverflowQuery{CombinedSewageOverflowID: csoID}, storage.PeriodDay)
+	is.NoErr(err)
+	is.Equal(2, len(statistics))
+	is.Equal(time.Date(2024, 4, 17, 0, 0, 0, 0, time.UTC), statistics[0].Period)
+
+	// overflow:2 is still ongoing and is counted in the first day of the time range
+	statistics, err = s.OverflowStatistics(ctx, storage.OverflowQuery{CombinedSewageOverflowID: csoID, From: startTime.Add(48 * time.Hour)}, storage.PeriodDay)
+	is.NoErr(err)
+	is.Equal(1, len(statistics))
+	is.Equal(time.Date(2024, 4, 19, 0, 0, 0, 0, time.UTC), statistics[0].Period)
+}
+
+func TestOverflowsAreCopiedFromStateOnInitialize(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	csoID := fmt.Sprintf("cso:%d", time.Now().UnixNano())
+	startTime := time.Date(2024, 4, 17, 15, 0, 0, 0, time.UTC)
+	stopTime := startTime.Add(15 * time.Minute)
+
+	state := map[string]any{
+		"id":     csoID,
+		"tenant": "default",
+		"overflow": []map[string]any{
+			{"id": "overflow:1", "state": false, "startTime": startTime, "stopTime": stopTime, "duration": 15 * time.Minute},
+			{"id": "overflow:2", "state": true, "startTime": startTime.Add(time.Hour), "stopTime": nil, "duration": 0},
+		},
+	}
+	is.NoErr(s.Create(ctx, csoID, "CombinedSewageOverflow", state))
+	is.NoErr(s.Initialize(ctx))
+
+	overflows, err := s.QueryOverflows(ctx, storage.OverflowQuery{CombinedSewageOverflowID: csoID})
+	is.NoErr(err)
+	is.Equal(2, len(overflows))
+	is.Equal(stopTime, *overflows[0].StopTime)
+	is.Equal(15*time.Minute, overflows[0].Duration)
+	is.True(overflows[1].State)
+}
+
+func TestPumpCycles(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	spsID := fmt.Sprintf("sps:%d", time.Now().UnixNano())
+	startTime := time.Date(2024, 4, 17, 15, 0, 0, 0, time.UTC)
+	stopTime := startTime.Add(10 * time.Minute)
+
+	cycle := storage.PumpCycle{ID: "cycle:1", SewagePumpingStationID: spsID, Tenant: "default", StartTime: startTime}
+	is.NoErr(s.StorePumpCycle(ctx, cycle))
+
+	cycle.StopTime = &stopTime
+	cycle.Duration = 10 * time.Minute
+	is.NoErr(s.StorePumpCycle(ctx, cycle))
+
+	is.NoErr(s.StorePumpCycle(ctx, storage.PumpCycle{ID: "cycle:2", SewagePumpingStationID: spsID, Tenant: "default", StartTime: startTime.Add(time.Hour)}))
+
+	cycles, err := s.QueryPumpCycles(ctx, storage.PumpCycleQuery{SewagePumpingStationID: spsID, To: startTime.Add(30 * time.Minute)})
+	is.NoErr(err)
+	is.Equal(1, len(cycles))
+	is.Equal(10*time.Minute, cycles[0].Duration)
+
+	statistics, err := s.PumpCycleStatistics(ctx, storage.PumpCycleQuery{SewagePumpingStationID: spsID}, storage.PeriodDay)
+	is.NoErr(err)
+	is.Equal(1, len(statistics))
+	is.Equal(int64(2), statistics[0].Count)
+}
+
+func TestEmptyings(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	wcID := fmt.Sprintf("wc:%d", time.Now().UnixNano())
+	ts := time.Date(2024, 4, 17, 15, 0, 0, 0, time.UTC)
+	levelBefore := 0.9
+
+	emptying := storage.Emptying{ID: "emptying:1", WasteContainerID: wcID, Tenant: "default", Timestamp: ts, PercentBefore: 90, PercentAfter: 5, LevelBefore: &levelBefore, LevelAfter: 0.05}
+	is.NoErr(s.StoreEmptying(ctx, emptying))
+	is.NoErr(s.StoreEmptying(ctx, emptying)) // storing the same emptying again should be ignored
+
+	is.NoErr(s.StoreEmptying(ctx, storage.Emptying{ID: "emptying:2", WasteContainerID: wcID, Tenant: "default", Timestamp: ts.Add(24 * time.Hour), PercentBefore: 80, PercentAfter: 0}))
+
+	emptyings, err := s.QueryEmptyings(ctx, storage.EmptyingQuery{WasteContainerID: wcID})
+	is.NoErr(err)
+	is.Equal(2, len(emptyings))
+	is.Equal(emptying, emptyings[0])
+
+	emptyings, err = s.QueryEmptyings(ctx, storage.EmptyingQuery{WasteContainerID: wcID, From: ts.Add(time.Hour)})
+	is.NoErr(err)
+	is.Equal(1, len(emptyings))
+	is.Equal("emptying:2", emptyings[0].ID)
+
+	emptyings, err = s.QueryEmptyings(ctx, storage.EmptyingQuery{WasteContainerID: wcID, Offset: 1, Limit: 1})
+	is.NoErr(err)
+	is.Equal(1, len(emptyings))
+	is.Equal("emptying:2", emptyings[0].ID)
+}
+
+func TestQuarantine(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	wcID := fmt.Sprintf("wc:%d", time.Now().UnixNano())
+
+	reading := storage.QuarantinedReading{ThingID: wcID, ThingType: "WasteContainer", Tenant: "default", Topic: "function.updated", ContentType: "application/vnd.diwise.level+json", Body: []byte(`{"id":"level:1"}`), Reason: "percent is invalid, 120.000000"}
+	is.NoErr(s.StoreQuarantined(ctx, reading))
+	is.NoErr(s.StoreQuarantined(ctx, storage.QuarantinedReading{ThingID: wcID, ThingType: "Sewer", Tenant: "default", Topic: "function.updated", ContentType: "application/vnd.diwise.level+json", Body: []byte(`{}`), Reason: "invalid"}))
+
+	readings, err := s.QueryQuarantined(ctx, storage.QuarantineQuery{ThingType: "WasteContainer", ThingID: wcID})
+	is.NoErr(err)
+	is.Equal(1, len(readings))
+	is.Equal(reading.Reason, readings[0].Reason)
+	is.Equal(reading.Body, readings[0].Body)
+	is.Equal("wastecontainer", readings[0].ThingType)
+}
+
+func TestDeadLetters(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	topic := fmt.Sprintf("test.%d", time.Now().UnixNano())
+
+	dl := storage.DeadLetter{ID: topic + ":1", Topic: topic, ContentType: "application/json", Body: []byte(`{"id":"1"}`), HandlerType: "Sewer", Error: "failed", Attempts: 1}
+	is.NoErr(s.StoreDeadLetter(ctx, dl))
+	is.NoErr(s.StoreDeadLetter(ctx, storage.DeadLetter{ID: topic + ":2", Topic: topic, ContentType: "application/json", Body: []byte(`{`), Error: "unmarshal error", Attempts: 1}))
+
+	dl.Attempts = 2
+	is.NoErr(s.StoreDeadLetter(ctx, dl))
+
+	stored, err := s.GetDeadLetter(ctx, topic+":1")
+	is.NoErr(err)
+	is.Equal(2, stored.Attempts)
+	is.Equal("sewer", stored.HandlerType)
+	is.Equal(`{"id":"1"}`, string(stored.Body))
+
+	deadLetters, total, err := s.QueryDeadLetters(ctx, storage.DeadLetterQuery{Topic: topic, HandlerType: "sewer"})
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+	is.Equal(1, len(deadLetters))
+
+	_, total, err = s.QueryDeadLetters(ctx, storage.DeadLetterQuery{Topic: topic, Error: "unmarshal error"})
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+
+	is.NoErr(s.DeleteDeadLetter(ctx, topic+":1"))
+	is.True(errors.Is(s.DeleteDeadLetter(ctx, topic+":1"), storage.ErrNotFound))
+
+	deleted, err := s.PurgeDeadLetters(ctx, storage.DeadLetterQuery{Topic: topic})
+	is.NoErr(err)
+	is.Equal(int64(1), deleted)
+}
+
+func TestOutbox(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	topic := fmt.Sprintf("test.%d", time.Now().UnixNano())
+	id := fmt.Sprintf("outbox:%d", time.Now().UnixNano())
+
+	_, err = s.UpsertWithOutbox(ctx, id, "Sewer", map[string]any{"id": id}, 0, []storage.OutboxMessage{{Topic: topic, ContentType: "application/json", Body: []byte(`{}`)}}, storage.Events{})
+	is.NoErr(err)
+
+	// the state is not stored, and no message is added to the outbox, if the version does not match
+	_, err = s.UpsertWithOutbox(ctx, id, "Sewer", map[string]any{"id": id}, 0, []storage.OutboxMessage{{Topic: topic, ContentType: "application/json", Body: []byte(`{}`)}}, storage.Events{})
+	is.True(errors.Is(err, storage.ErrConcurrencyConflict))
+
+	delivered := 0
+	for {
+		n, err := s.ProcessOutbox(ctx, 100, 10, func(ctx context.Context, m storage.OutboxMessage) error {
+			if m.Topic == topic {
+				delivered++
+			}
+			return nil
+		})
+		is.NoErr(err)
+		if n == 0 {
+			break
+		}
+	}
+
+	is.Equal(1, delivered)
+
+	// a message that can not be delivered is given up after maxAttempts so that it does not block the outbox
+	_, err = s.UpsertWithOutbox(ctx, id, "Sewer", map[string]any{"id": id}, -1, []storage.OutboxMessage{{Topic: topic, ContentType: "application/json", Body: []byte(`{}`)}}, storage.Events{})
+	is.NoErr(err)
+
+	attempts := 0
+	deliver := func(ctx context.Context, m storage.OutboxMessage) error {
+		if m.Topic == topic {
+			attempts++
+			return errors.New("message can not be published")
+		}
+		return nil
+	}
+
+	_, err = s.ProcessOutbox(ctx, 100, 2, deliver)
+	is.True(err != nil)
+	_, err = s.ProcessOutbox(ctx, 100, 2, deliver)
+	is.NoErr(err)
+	_, err = s.ProcessOutbox(ctx, 100, 2, deliver)
+	is.NoErr(err)
+
+	is.Equal(2, attempts)
+}
+
+func TestDeduplication(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	hash := fmt.Sprintf("hash:%d", time.Now().UnixNano())
+
+	processed, err := s.IsMessageProcessed(ctx, hash, "sewer:1", "Sewer")
+	is.NoErr(err)
+	is.True(!processed)
+
+	is.NoErr(s.MarkMessageProcessed(ctx, hash, "sewer:1", "Sewer", time.Now().Add(time.Hour)))
+	is.NoErr(s.MarkMessageProcessed(ctx, hash, "sewer:2", "Sewer", time.Now().Add(-time.Hour)))
+
+	processed, err = s.IsMessageProcessed(ctx, hash, "sewer:1", "Sewer")
+	is.NoErr(err)
+	is.True(processed)
+
+	processed, err = s.IsMessageProcessed(ctx, hash, "sewer:2", "Sewer")
+	is.NoErr(err)
+	is.True(!processed) // expired
+
+	_, err = s.PurgeProcessedMessages(ctx, time.Now())
+	is.NoErr(err)
+}
+
+func TestProcessedMessageIsStoredWithState(t *testing.T) {
+	is, s, ctx, connected, err := testSetup(t)
+	if !connected {
+		t.Skip("not connected")
+	}
+	is.NoErr(err)
+	defer s.Close()
+
+	hash := fmt.Sprintf("hash:%d", time.Now().UnixNano())
+	id := fmt.Sprintf("sewer:%d", time.Now().UnixNano())
+	events := storage.Events{Processed: []storage.ProcessedMessage{{Hash: hash, ThingID: id, ThingType: "Sewer", Expires: time.Now().Add(time.Hour)}}}
+
+	_, err = s.UpsertWithOutbox(ctx, id, "Sewer", map[string]any{"id": id}, 0, nil, events)
+	is.NoErr(err)
+
+	// nothing is stored if the version does not match
+	hash2 := hash + ":2"
+	events.Processed[0].Hash = hash2
+	_, err = s.UpsertWithOutbox(ctx, id, "Sewer", map[string]any{"id": id}, 0, nil, events)
+	is.True(errors.Is(err, storage.ErrConcurrencyConflict))
+
+	processed, err := s.IsMessageProcessed(ctx, hash, id, "Sewer")
+	is.NoErr(err)
+	is.True(processed)
+
+	processed, err = s.IsMessageProcessed(ctx, hash2, id, "Sewer")
+	is.NoErr(err)
+	is.True(!processed)
+}
+
 func testSetup(t *testing.T) (*is.I, *JsonDataStore, context.Context, bool, error) {
 	is := is.New(t)
 	ctx := context.Background()
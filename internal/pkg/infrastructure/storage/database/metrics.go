@@ -0,0 +1,24 @@
+package database
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cip_functions_store_duration_seconds",
+	Help:    "Duration of database operations, by operation",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+}, []string{"operation"})
+
+// observeDuration starts timing an operation and returns a func that records the duration when called, i.e.
+//
+//	defer observeDuration("read")()
+func observeDuration(operation string) func() {
+	start := time.Now()
+	return func() {
+		storeDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) ProcessOutbox(ctx context.Context, limit, maxAttempts int, deliver func(ctx context.Context, message storage.OutboxMessage) error) (int, error) {
+	defer observeDuration("process_outbox")()
+
+	tx, err := jds.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// locked messages are skipped so that other instances can deliver later messages meanwhile
+	rows, err := tx.Query(ctx, `
+		select id, topic, content_type, body, attempts, created_on
+		from cip_fnct_outbox
+		where delivered_on is null and failed_on is null
+		order by id asc
+		limit $1
+		for update skip locked`, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	messages := []storage.OutboxMessage{}
+
+	for rows.Next() {
+		var m storage.OutboxMessage
+		err = rows.Scan(&m.ID, &m.Topic, &m.ContentType, &m.Body, &m.Attempts, &m.Created)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var deliveryErr error
+
+	for _, m := range messages {
+		deliveryErr = deliver(ctx, m)
+		if deliveryErr != nil {
+			// a message that can never be delivered is marked as failed so that later messages are delivered
+			failed := maxAttempts > 0 && m.Attempts+1 >= maxAttempts
+
+			_, err = tx.Exec(ctx, `
+				update cip_fnct_outbox set attempts = attempts + 1, failed_on = case when $2 then CURRENT_TIMESTAMP end
+				where id = $1`, m.ID, failed)
+			if err != nil {
+				return 0, err
+			}
+
+			if failed {
+				deliveryErr = nil
+				continue
+			}
+
+			break
+		}
+
+		_, err = tx.Exec(ctx, `update cip_fnct_outbox set attempts = attempts + 1, delivered_on = CURRENT_TIMESTAMP where id = $1`, m.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		delivered++
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return delivered, deliveryErr
+}
+
+func (jds *JsonDataStore) PurgeOutbox(ctx context.Context, deliveredBefore time.Time) (int64, error) {
+	defer observeDuration("purge_outbox")()
+
+	tag, err := jds.db.Exec(ctx, `delete from cip_fnct_outbox where delivered_on < $1 or failed_on < $1`, deliveredBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) StoreOverflow(ctx context.Context, o storage.Overflow) error {
+	defer observeDuration("store_overflow")()
+
+	return storeOverflow(ctx, jds.db, o)
+}
+
+func storeOverflow(ctx context.Context, db execer, o storage.Overflow) error {
+	_, err := db.Exec(ctx, `
+		insert into cip_fnct_overflow (id, cso_id, tenant, state, start_time, stop_time, duration)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict (cso_id, id) do update
+		set state = excluded.state, stop_time = excluded.stop_time, duration = excluded.duration, updated_on = CURRENT_TIMESTAMP`,
+		o.ID, strings.ToLower(o.CombinedSewageOverflowID), o.Tenant, o.State, o.StartTime.UTC(), o.StopTime, int64(o.Duration))
+
+	return err
+}
+
+func (jds *JsonDataStore) QueryOverflows(ctx context.Context, params storage.OverflowQuery) ([]storage.Overflow, error) {
+	defer observeDuration("query_overflows")()
+
+	where, args := overflowQueryFilter(params)
+
+	rows, err := jds.db.Query(ctx, `select id, cso_id, tenant, state, start_time, stop_time, duration from cip_fnct_overflow `+where+` order by start_time asc`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overflows := []storage.Overflow{}
+
+	for rows.Next() {
+		var o storage.Overflow
+		var duration int64
+
+		err = rows.Scan(&o.ID, &o.CombinedSewageOverflowID, &o.Tenant, &o.State, &o.StartTime, &o.StopTime, &duration)
+		if err != nil {
+			return nil, err
+		}
+
+		o.StartTime = o.StartTime.UTC()
+		if o.StopTime != nil {
+			stopTime := o.StopTime.UTC()
+			o.StopTime = &stopTime
+		}
+		o.Duration = time.Duration(duration)
+		overflows = append(overflows, o)
+	}
+
+	return overflows, rows.Err()
+}
+
+// OverflowStatistics aggregates the overflows matching params per day, month or year (UTC) based on when they started
+func (jds *JsonDataStore) OverflowStatistics(ctx context.Context, params storage.OverflowQuery, period storage.Period) ([]storage.Statistics, error) {
+	defer observeDuration("overflow_statistics")()
+
+	where, args := overflowQueryFilter(params)
+
+	return jds.statistics(ctx, "cip_fnct_overflow", where, args, params.From, period)
+}
+
+// statistics aggregates the events in table matching where per day, month or year (UTC) based on when they started.
+// The filter includes events that started before from but are ongoing after it, they are counted in the period of from
+// so that no period before the requested time range is returned.
+func (jds *JsonDataStore) statistics(ctx context.Context, table, where string, args []any, from time.Time, period storage.Period) ([]storage.Statistics, error) {
+	period, err := storage.ParsePeriod(string(period))
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := "start_time"
+	if !from.IsZero() {
+		args = append(args, from.UTC())
+		startTime = fmt.Sprintf("greatest(start_time, $%d)", len(args))
+	}
+
+	args = append(args, string(period))
+
+	query := fmt.Sprintf(`
+		select date_trunc($%d::text, %s at time zone 'UTC') as bucket, count(*), coalesce(sum(duration), 0)
+		from %s %s
+		group by bucket
+		order by bucket asc`, len(args), startTime, table, where)
+
+	rows, err := jds.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statistics := []storage.Statistics{}
+
+	for rows.Next() {
+		var s storage.Statistics
+		var duration int64
+
+		err = rows.Scan(&s.Period, &s.Count, &duration)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Period = s.Period.UTC()
+		s.Duration = time.Duration(duration)
+		statistics = append(statistics, s)
+	}
+
+	return statistics, rows.Err()
+}
+
+func overflowQueryFilter(params storage.OverflowQuery) (string, []any) {
+	args := []any{strings.ToLower(params.CombinedSewageOverflowID)}
+	where := "where cso_id = $1"
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		where += fmt.Sprintf(" and tenant = any($%d)", len(args))
+	}
+
+	// an overflow is included if any part of it is within the time range
+	if !params.To.IsZero() {
+		args = append(args, params.To.UTC())
+		where += fmt.Sprintf(" and start_time < $%d", len(args))
+	}
+
+	if !params.From.IsZero() {
+		args = append(args, params.From.UTC())
+		where += fmt.Sprintf(" and (stop_time is null or stop_time >= $%d)", len(args))
+	}
+
+	return where, args
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) StorePumpCycle(ctx context.Context, c storage.PumpCycle) error {
+	defer observeDuration("store_pump_cycle")()
+
+	return storePumpCycle(ctx, jds.db, c)
+}
+
+func storePumpCycle(ctx context.Context, db execer, c storage.PumpCycle) error {
+	_, err := db.Exec(ctx, `
+		insert into cip_fnct_pump_cycle (id, sps_id, tenant, start_time, stop_time, duration)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (sps_id, id) do update
+		set stop_time = excluded.stop_time, duration = excluded.duration, updated_on = CURRENT_TIMESTAMP`,
+		c.ID, strings.ToLower(c.SewagePumpingStationID), c.Tenant, c.StartTime.UTC(), c.StopTime, int64(c.Duration))
+
+	return err
+}
+
+func (jds *JsonDataStore) QueryPumpCycles(ctx context.Context, params storage.PumpCycleQuery) ([]storage.PumpCycle, error) {
+	defer observeDuration("query_pump_cycles")()
+
+	where, args := pumpCycleQueryFilter(params)
+
+	rows, err := jds.db.Query(ctx, `select id, sps_id, tenant, start_time, stop_time, duration from cip_fnct_pump_cycle `+where+` order by start_time asc`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cycles := []storage.PumpCycle{}
+
+	for rows.Next() {
+		var c storage.PumpCycle
+		var duration int64
+
+		err = rows.Scan(&c.ID, &c.SewagePumpingStationID, &c.Tenant, &c.StartTime, &c.StopTime, &duration)
+		if err != nil {
+			return nil, err
+		}
+
+		c.StartTime = c.StartTime.UTC()
+		if c.StopTime != nil {
+			stopTime := c.StopTime.UTC()
+			c.StopTime = &stopTime
+		}
+		c.Duration = time.Duration(duration)
+		cycles = append(cycles, c)
+	}
+
+	return cycles, rows.Err()
+}
+
+// PumpCycleStatistics aggregates the pump cycles matching params per day, month or year (UTC) based on when they started
+func (jds *JsonDataStore) PumpCycleStatistics(ctx context.Context, params storage.PumpCycleQuery, period storage.Period) ([]storage.Statistics, error) {
+	defer observeDuration("pump_cycle_statistics")()
+
+	where, args := pumpCycleQueryFilter(params)
+
+	return jds.statistics(ctx, "cip_fnct_pump_cycle", where, args, params.From, period)
+}
+
+func pumpCycleQueryFilter(params storage.PumpCycleQuery) (string, []any) {
+	args := []any{strings.ToLower(params.SewagePumpingStationID)}
+	where := "where sps_id = $1"
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		where += fmt.Sprintf(" and tenant = any($%d)", len(args))
+	}
+
+	// a cycle is included if any part of it is within the time range
+	if !params.To.IsZero() {
+		args = append(args, params.To.UTC())
+		where += fmt.Sprintf(" and start_time < $%d", len(args))
+	}
+
+	if !params.From.IsZero() {
+		args = append(args, params.From.UTC())
+		where += fmt.Sprintf(" and (stop_time is null or stop_time >= $%d)", len(args))
+	}
+
+	return where, args
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+)
+
+func (jds *JsonDataStore) StoreQuarantined(ctx context.Context, q storage.QuarantinedReading) error {
+	defer observeDuration("store_quarantined")()
+
+	_, err := jds.db.Exec(ctx, `
+		insert into cip_fnct_quarantine (thing_id, thing_type, tenant, topic, content_type, body, reason)
+		values ($1, $2, $3, $4, $5, $6, $7)`,
+		strings.ToLower(q.ThingID), strings.ToLower(q.ThingType), q.Tenant, q.Topic, q.ContentType, q.Body, q.Reason)
+
+	return err
+}
+
+func (jds *JsonDataStore) QueryQuarantined(ctx context.Context, params storage.QuarantineQuery) ([]storage.QuarantinedReading, error) {
+	defer observeDuration("query_quarantined")()
+
+	where, args := quarantineQueryFilter(params)
+
+	rows, err := jds.db.Query(ctx, `
+		select id, thing_id, thing_type, tenant, topic, content_type, body, reason, created_on
+		from cip_fnct_quarantine `+where+` order by created_on asc, id asc`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := []storage.QuarantinedReading{}
+
+	for rows.Next() {
+		var q storage.QuarantinedReading
+
+		err = rows.Scan(&q.ID, &q.ThingID, &q.ThingType, &q.Tenant, &q.Topic, &q.ContentType, &q.Body, &q.Reason, &q.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		q.Created = q.Created.UTC()
+		readings = append(readings, q)
+	}
+
+	return readings, rows.Err()
+}
+
+func quarantineQueryFilter(params storage.QuarantineQuery) (string, []any) {
+	args := []any{}
+	conditions := []string{}
+
+	if params.ThingType != "" {
+		args = append(args, strings.ToLower(params.ThingType))
+		conditions = append(conditions, fmt.Sprintf("thing_type = $%d", len(args)))
+	}
+
+	if params.ThingID != "" {
+		args = append(args, strings.ToLower(params.ThingID))
+		conditions = append(conditions, fmt.Sprintf("thing_id = $%d", len(args)))
+	}
+
+	if len(params.Tenants) > 0 {
+		args = append(args, params.Tenants)
+		conditions = append(conditions, fmt.Sprintf("tenant = any($%d)", len(args)))
+	}
+
+	if !params.From.IsZero() {
+		args = append(args, params.From.UTC())
+		conditions = append(conditions, fmt.Sprintf("created_on >= $%d", len(args)))
+	}
+
+	if !params.To.IsZero() {
+		args = append(args, params.To.UTC())
+		conditions = append(conditions, fmt.Sprintf("created_on < $%d", len(args)))
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+
+	return "where " + strings.Join(conditions, " and "), args
+}
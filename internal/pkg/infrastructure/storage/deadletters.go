@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type DeadLetterStorage interface {
+	// StoreDeadLetter creates or replaces the dead letter with the same ID
+	StoreDeadLetter(ctx context.Context, deadLetter DeadLetter) error
+	GetDeadLetter(ctx context.Context, id string) (DeadLetter, error)
+	QueryDeadLetters(ctx context.Context, params DeadLetterQuery) ([]DeadLetter, int64, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+	// PurgeDeadLetters deletes all dead letters matching params, regardless of Offset and Limit, and returns the number of deleted dead letters
+	PurgeDeadLetters(ctx context.Context, params DeadLetterQuery) (int64, error)
+}
+
+// DeadLetter is an incoming message that could not be processed by a handler. HandlerType
+// is empty if the message failed before it was passed to a handler, e.g. if it could not be parsed.
+// Tenant is empty if the message does not contain a tenant.
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	HandlerType string    `json:"handlerType,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Error       string    `json:"error"`
+	TraceID     string    `json:"traceID,omitempty"`
+	Attempts    int       `json:"attempts"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// DeadLetterQuery selects dead letters by topic, handler type and tenant that were created before Before.
+// Empty or zero fields are not used to filter the result.
+type DeadLetterQuery struct {
+	Topic       string
+	HandlerType string
+	Tenants     []string
+	Error       string
+	Before      time.Time
+	Offset      int
+	Limit       int
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// DeduplicationStorage keeps track of which messages that have been processed for each thing, so that
+// redelivered or replayed messages are not applied more than once
+type DeduplicationStorage interface {
+	// IsMessageProcessed reports whether the message with hash has been processed for the thing, and has not expired
+	IsMessageProcessed(ctx context.Context, hash, thingID, thingType string) (bool, error)
+	MarkMessageProcessed(ctx context.Context, hash, thingID, thingType string, expires time.Time) error
+	// PurgeProcessedMessages deletes processed messages that expired before expiredBefore
+	PurgeProcessedMessages(ctx context.Context, expiredBefore time.Time) (int64, error)
+}
+
+// ProcessedMessage records that the message with Hash has been processed for a thing, until Expires
+type ProcessedMessage struct {
+	Hash      string
+	ThingID   string
+	ThingType string
+	Expires   time.Time
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type EmptyingStorage interface {
+	StoreEmptying(ctx context.Context, emptying Emptying) error
+	QueryEmptyings(ctx context.Context, params EmptyingQuery) ([]Emptying, error)
+}
+
+// Emptying is a single emptying of a WasteContainer, detected from a decrease in percent
+type Emptying struct {
+	ID               string    `json:"id"`
+	WasteContainerID string    `json:"wasteContainerID"`
+	Tenant           string    `json:"tenant"`
+	Timestamp        time.Time `json:"timestamp"`
+	PercentBefore    float64   `json:"percentBefore"`
+	PercentAfter     float64   `json:"percentAfter"`
+	LevelBefore      *float64  `json:"levelBefore,omitempty"`
+	LevelAfter       float64   `json:"levelAfter"`
+}
+
+// EmptyingQuery selects emptyings within [From, To), for a single WasteContainer if WasteContainerID is set.
+// A zero From or To leaves the range open in that direction, and a zero Limit returns all emptyings after Offset.
+type EmptyingQuery struct {
+	WasteContainerID string
+	Tenants          []string
+	From             time.Time
+	To               time.Time
+	Offset           int
+	Limit            int
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type OutboxStorage interface {
+	// UpsertWithOutbox works like Upsert, and adds messages to the outbox and stores events in the same transaction
+	// so that they are only published and stored if the value is stored
+	UpsertWithOutbox(ctx context.Context, id, typeName string, value any, version int64, messages []OutboxMessage, events Events) (int64, error)
+	// ProcessOutbox passes up to limit undelivered messages, oldest first, to deliver and marks them as delivered.
+	// Processing stops at the first message that could not be delivered, unless it has now been attempted maxAttempts
+	// times. Such a message is marked as failed and is not passed to deliver again, so that it does not block the outbox.
+	// Messages are locked while being processed so that each message is delivered by one instance at a time. Locked
+	// messages are skipped by other instances, so messages are not necessarily delivered in order.
+	// Returns the number of delivered messages.
+	ProcessOutbox(ctx context.Context, limit, maxAttempts int, deliver func(ctx context.Context, message OutboxMessage) error) (int, error)
+	// PurgeOutbox deletes messages that were delivered, or that failed, before deliveredBefore
+	PurgeOutbox(ctx context.Context, deliveredBefore time.Time) (int64, error)
+}
+
+// OutboxMessage is a message that should be published on Topic once the transaction it was added in is committed
+type OutboxMessage struct {
+	ID          int64
+	Topic       string
+	ContentType string
+	Body        []byte
+	Attempts    int // number of earlier attempts to deliver the message
+	Created     time.Time
+}
+
+// Events are stored apart from the state of a function, e.g. overflows, pump cycles and emptyings, together with
+// the messages that were processed to change the state
+type Events struct {
+	Overflows  []Overflow
+	PumpCycles []PumpCycle
+	Emptyings  []Emptying
+	Processed  []ProcessedMessage
+}
+
+// SaveWithOutbox stores value like Save, together with messages that should be published and events that should be stored
+func SaveWithOutbox[T any](ctx context.Context, storage Storage, id string, value T, version int64, messages []OutboxMessage, events Events) (int64, error) {
+	typeName := GetTypeName[T]()
+	return storage.UpsertWithOutbox(ctx, id, typeName, value, version, messages, events)
+}
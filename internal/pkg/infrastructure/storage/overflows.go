@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type OverflowStorage interface {
+	StoreOverflow(ctx context.Context, overflow Overflow) error
+	QueryOverflows(ctx context.Context, params OverflowQuery) ([]Overflow, error)
+	OverflowStatistics(ctx context.Context, params OverflowQuery, period Period) ([]Statistics, error)
+}
+
+// Overflow is a single overflow event for a CombinedSewageOverflow
+type Overflow struct {
+	ID                       string        `json:"id"`
+	CombinedSewageOverflowID string        `json:"combinedSewageOverflowID"`
+	Tenant                   string        `json:"tenant"`
+	State                    bool          `json:"state"`
+	StartTime                time.Time     `json:"startTime"`
+	StopTime                 *time.Time    `json:"stopTime,omitempty"`
+	Duration                 time.Duration `json:"duration"`
+}
+
+// OverflowQuery selects overflows for a CombinedSewageOverflow that are ongoing during [From, To).
+// A zero From or To leaves the range open in that direction.
+type OverflowQuery struct {
+	CombinedSewageOverflowID string
+	Tenants                  []string
+	From                     time.Time
+	To                       time.Time
+}
+
+// Statistics is the number and total duration of the events, e.g. overflows or pump cycles, that started within a period.
+// Events that started before the queried time range are counted in the period in which the range starts.
+type Statistics struct {
+	Period   time.Time     `json:"period"`
+	Count    int64         `json:"count"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Period string
+
+const (
+	PeriodDay   Period = "day"
+	PeriodMonth Period = "month"
+	PeriodYear  Period = "year"
+)
+
+func ParsePeriod(s string) (Period, error) {
+	switch Period(s) {
+	case PeriodDay, PeriodMonth, PeriodYear:
+		return Period(s), nil
+	}
+	return "", fmt.Errorf("invalid period %s, expected day, month or year", s)
+}
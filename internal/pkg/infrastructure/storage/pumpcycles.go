@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type PumpCycleStorage interface {
+	StorePumpCycle(ctx context.Context, cycle PumpCycle) error
+	QueryPumpCycles(ctx context.Context, params PumpCycleQuery) ([]PumpCycle, error)
+	PumpCycleStatistics(ctx context.Context, params PumpCycleQuery, period Period) ([]Statistics, error)
+}
+
+// PumpCycle is a single run of the pump in a SewagePumpingStation, from when it started until it stopped
+type PumpCycle struct {
+	ID                     string        `json:"id"`
+	SewagePumpingStationID string        `json:"sewagePumpingStationID"`
+	Tenant                 string        `json:"tenant"`
+	StartTime              time.Time     `json:"startTime"`
+	StopTime               *time.Time    `json:"stopTime,omitempty"`
+	Duration               time.Duration `json:"duration"`
+}
+
+// PumpCycleQuery selects pump cycles for a SewagePumpingStation that are ongoing during [From, To).
+// A zero From or To leaves the range open in that direction.
+type PumpCycleQuery struct {
+	SewagePumpingStationID string
+	Tenants                []string
+	From                   time.Time
+	To                     time.Time
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type QuarantineStorage interface {
+	StoreQuarantined(ctx context.Context, reading QuarantinedReading) error
+	QueryQuarantined(ctx context.Context, params QuarantineQuery) ([]QuarantinedReading, error)
+}
+
+// QuarantinedReading is an incoming message that would have given a thing invalid values. It is kept,
+// together with the reason it was quarantined, instead of being applied to the state of the thing.
+type QuarantinedReading struct {
+	ID          int64     `json:"id"`
+	ThingID     string    `json:"thingID"`
+	ThingType   string    `json:"thingType"`
+	Tenant      string    `json:"tenant"`
+	Topic       string    `json:"topic"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	Reason      string    `json:"reason"`
+	Created     time.Time `json:"created"`
+}
+
+// QuarantineQuery selects quarantined readings of things of ThingType that were quarantined within [From, To),
+// for a single thing if ThingID is set. A zero From or To leaves the range open in that direction.
+type QuarantineQuery struct {
+	ThingType string
+	ThingID   string
+	Tenants   []string
+	From      time.Time
+	To        time.Time
+}
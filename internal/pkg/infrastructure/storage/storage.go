@@ -3,16 +3,50 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 )
 
+var ErrNotFound = errors.New("not found")
+var ErrConcurrencyConflict = errors.New("value has been changed by someone else")
+
+// AnyVersion can be used with Upsert to store a value regardless of the currently stored version
+const AnyVersion int64 = -1
+
 //go:generate moq -rm -out storage_mock.go . Storage
 type Storage interface {
 	Create(ctx context.Context, id, typeName string, value any) error
 	Read(ctx context.Context, id, typeName string) (any, error)
+	ReadWithVersion(ctx context.Context, id, typeName string) (any, int64, error)
+	ReadAll(ctx context.Context, typeName string, params QueryParams) (QueryResult, error)
 	Update(ctx context.Context, id, typeName string, value any) error
+	// Upsert creates or updates the value if the stored version equals version, or if version is AnyVersion.
+	// Use version 0 for values that are expected not to exist. Returns the new version of the stored value,
+	// or ErrConcurrencyConflict if the stored version did not match.
+	Upsert(ctx context.Context, id, typeName string, value any, version int64) (int64, error)
 	Exists(ctx context.Context, id, typeName string) bool
+
+	OverflowStorage
+	EmptyingStorage
+	PumpCycleStorage
+	QuarantineStorage
+	DeadLetterStorage
+	OutboxStorage
+	DeduplicationStorage
+}
+
+type QueryParams struct {
+	Tenants []string
+	Offset  int
+	Limit   int
+}
+
+type QueryResult struct {
+	Data         []any
+	TotalRecords int64
+	Offset       int
+	Limit        int
 }
 
 func Get[T any](ctx context.Context, storage Storage, id string) (T, error) {
@@ -38,31 +72,49 @@ func Get[T any](ctx context.Context, storage Storage, id string) (T, error) {
 	return t, nil
 }
 
+// GetOrDefault returns the stored value for id, or defaultValue if there is no stored value. The stored value
+// is unmarshalled onto defaultValue so that any unexported settings of defaultValue are kept.
 func GetOrDefault[T any](ctx context.Context, storage Storage, id string, defaultValue T) (T, error) {
-	t, err := Get[T](ctx, storage, id)
-	if err != nil {
-		return defaultValue, nil
-	}
-
-	return t, nil
+	t, _, err := Load(ctx, storage, id, defaultValue)
+	return t, err
 }
 
-func CreateOrUpdate[T any](ctx context.Context, storage Storage, id string, value T) error {
-	var err error
-
+// Load works like GetOrDefault but also returns the version of the stored value, or 0 if there is no stored value
+func Load[T any](ctx context.Context, storage Storage, id string, defaultValue T) (T, int64, error) {
 	typeName := GetTypeName[T]()
 
-	if storage.Exists(ctx, id, typeName) {
-		err = storage.Update(ctx, id, typeName, value)
-	} else {
-		err = storage.Create(ctx, id, typeName, value)
+	t1, version, err := storage.ReadWithVersion(ctx, id, typeName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return defaultValue, 0, nil
+		}
+		return defaultValue, 0, err
 	}
 
+	b, err := json.Marshal(t1)
+	if err != nil {
+		return defaultValue, 0, err
+	}
+
+	t := defaultValue
+
+	err = json.Unmarshal(b, &t)
 	if err != nil {
-		return err
+		return defaultValue, 0, err
 	}
 
-	return nil
+	return t, version, nil
+}
+
+func CreateOrUpdate[T any](ctx context.Context, storage Storage, id string, value T) error {
+	_, err := Save(ctx, storage, id, value, AnyVersion)
+	return err
+}
+
+// Save stores value if the stored version is unchanged since it was loaded, see Storage.Upsert
+func Save[T any](ctx context.Context, storage Storage, id string, value T, version int64) (int64, error) {
+	typeName := GetTypeName[T]()
+	return storage.Upsert(ctx, id, typeName, value, version)
 }
 
 func GetTypeName[T any]() string {
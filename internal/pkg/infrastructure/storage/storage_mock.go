@@ -6,6 +6,7 @@ package storage
 import (
 	"context"
 	"sync"
+	"time"
 )
 
 // Ensure, that StorageMock does implement Storage.
@@ -21,15 +22,87 @@ var _ Storage = &StorageMock{}
 //			CreateFunc: func(ctx context.Context, id string, typeName string, value any) error {
 //				panic("mock out the Create method")
 //			},
+//			DeleteDeadLetterFunc: func(ctx context.Context, id string) error {
+//				panic("mock out the DeleteDeadLetter method")
+//			},
 //			ExistsFunc: func(ctx context.Context, id string, typeName string) bool {
 //				panic("mock out the Exists method")
 //			},
+//			GetDeadLetterFunc: func(ctx context.Context, id string) (DeadLetter, error) {
+//				panic("mock out the GetDeadLetter method")
+//			},
+//			IsMessageProcessedFunc: func(ctx context.Context, hash string, thingID string, thingType string) (bool, error) {
+//				panic("mock out the IsMessageProcessed method")
+//			},
+//			MarkMessageProcessedFunc: func(ctx context.Context, hash string, thingID string, thingType string, expires time.Time) error {
+//				panic("mock out the MarkMessageProcessed method")
+//			},
+//			OverflowStatisticsFunc: func(ctx context.Context, params OverflowQuery, period Period) ([]Statistics, error) {
+//				panic("mock out the OverflowStatistics method")
+//			},
+//			ProcessOutboxFunc: func(ctx context.Context, limit int, maxAttempts int, deliver func(ctx context.Context, message OutboxMessage) error) (int, error) {
+//				panic("mock out the ProcessOutbox method")
+//			},
+//			PumpCycleStatisticsFunc: func(ctx context.Context, params PumpCycleQuery, period Period) ([]Statistics, error) {
+//				panic("mock out the PumpCycleStatistics method")
+//			},
+//			PurgeDeadLettersFunc: func(ctx context.Context, params DeadLetterQuery) (int64, error) {
+//				panic("mock out the PurgeDeadLetters method")
+//			},
+//			PurgeOutboxFunc: func(ctx context.Context, deliveredBefore time.Time) (int64, error) {
+//				panic("mock out the PurgeOutbox method")
+//			},
+//			PurgeProcessedMessagesFunc: func(ctx context.Context, expiredBefore time.Time) (int64, error) {
+//				panic("mock out the PurgeProcessedMessages method")
+//			},
+//			QueryDeadLettersFunc: func(ctx context.Context, params DeadLetterQuery) ([]DeadLetter, int64, error) {
+//				panic("mock out the QueryDeadLetters method")
+//			},
+//			QueryEmptyingsFunc: func(ctx context.Context, params EmptyingQuery) ([]Emptying, error) {
+//				panic("mock out the QueryEmptyings method")
+//			},
+//			QueryOverflowsFunc: func(ctx context.Context, params OverflowQuery) ([]Overflow, error) {
+//				panic("mock out the QueryOverflows method")
+//			},
+//			QueryPumpCyclesFunc: func(ctx context.Context, params PumpCycleQuery) ([]PumpCycle, error) {
+//				panic("mock out the QueryPumpCycles method")
+//			},
+//			QueryQuarantinedFunc: func(ctx context.Context, params QuarantineQuery) ([]QuarantinedReading, error) {
+//				panic("mock out the QueryQuarantined method")
+//			},
 //			ReadFunc: func(ctx context.Context, id string, typeName string) (any, error) {
 //				panic("mock out the Read method")
 //			},
+//			ReadAllFunc: func(ctx context.Context, typeName string, params QueryParams) (QueryResult, error) {
+//				panic("mock out the ReadAll method")
+//			},
+//			ReadWithVersionFunc: func(ctx context.Context, id string, typeName string) (any, int64, error) {
+//				panic("mock out the ReadWithVersion method")
+//			},
+//			StoreDeadLetterFunc: func(ctx context.Context, deadLetter DeadLetter) error {
+//				panic("mock out the StoreDeadLetter method")
+//			},
+//			StoreEmptyingFunc: func(ctx context.Context, emptying Emptying) error {
+//				panic("mock out the StoreEmptying method")
+//			},
+//			StoreOverflowFunc: func(ctx context.Context, overflow Overflow) error {
+//				panic("mock out the StoreOverflow method")
+//			},
+//			StorePumpCycleFunc: func(ctx context.Context, cycle PumpCycle) error {
+//				panic("mock out the StorePumpCycle method")
+//			},
+//			StoreQuarantinedFunc: func(ctx context.Context, reading QuarantinedReading) error {
+//				panic("mock out the StoreQuarantined method")
+//			},
 //			UpdateFunc: func(ctx context.Context, id string, typeName string, value any) error {
 //				panic("mock out the Update method")
 //			},
+//			UpsertFunc: func(ctx context.Context, id string, typeName string, value any, version int64) (int64, error) {
+//				panic("mock out the Upsert method")
+//			},
+//			UpsertWithOutboxFunc: func(ctx context.Context, id string, typeName string, value any, version int64, messages []OutboxMessage, events Events) (int64, error) {
+//				panic("mock out the UpsertWithOutbox method")
+//			},
 //		}
 //
 //		// use mockedStorage in code that requires Storage
@@ -40,15 +113,87 @@ type StorageMock struct {
 	// CreateFunc mocks the Create method.
 	CreateFunc func(ctx context.Context, id string, typeName string, value any) error
 
+	// DeleteDeadLetterFunc mocks the DeleteDeadLetter method.
+	DeleteDeadLetterFunc func(ctx context.Context, id string) error
+
 	// ExistsFunc mocks the Exists method.
 	ExistsFunc func(ctx context.Context, id string, typeName string) bool
 
+	// GetDeadLetterFunc mocks the GetDeadLetter method.
+	GetDeadLetterFunc func(ctx context.Context, id string) (DeadLetter, error)
+
+	// IsMessageProcessedFunc mocks the IsMessageProcessed method.
+	IsMessageProcessedFunc func(ctx context.Context, hash string, thingID string, thingType string) (bool, error)
+
+	// MarkMessageProcessedFunc mocks the MarkMessageProcessed method.
+	MarkMessageProcessedFunc func(ctx context.Context, hash string, thingID string, thingType string, expires time.Time) error
+
+	// OverflowStatisticsFunc mocks the OverflowStatistics method.
+	OverflowStatisticsFunc func(ctx context.Context, params OverflowQuery, period Period) ([]Statistics, error)
+
+	// ProcessOutboxFunc mocks the ProcessOutbox method.
+	ProcessOutboxFunc func(ctx context.Context, limit int, maxAttempts int, deliver func(ctx context.Context, message OutboxMessage) error) (int, error)
+
+	// PumpCycleStatisticsFunc mocks the PumpCycleStatistics method.
+	PumpCycleStatisticsFunc func(ctx context.Context, params PumpCycleQuery, period Period) ([]Statistics, error)
+
+	// PurgeDeadLettersFunc mocks the PurgeDeadLetters method.
+	PurgeDeadLettersFunc func(ctx context.Context, params DeadLetterQuery) (int64, error)
+
+	// PurgeOutboxFunc mocks the PurgeOutbox method.
+	PurgeOutboxFunc func(ctx context.Context, deliveredBefore time.Time) (int64, error)
+
+	// PurgeProcessedMessagesFunc mocks the PurgeProcessedMessages method.
+	PurgeProcessedMessagesFunc func(ctx context.Context, expiredBefore time.Time) (int64, error)
+
+	// QueryDeadLettersFunc mocks the QueryDeadLetters method.
+	QueryDeadLettersFunc func(ctx context.Context, params DeadLetterQuery) ([]DeadLetter, int64, error)
+
+	// QueryEmptyingsFunc mocks the QueryEmptyings method.
+	QueryEmptyingsFunc func(ctx context.Context, params EmptyingQuery) ([]Emptying, error)
+
+	// QueryOverflowsFunc mocks the QueryOverflows method.
+	QueryOverflowsFunc func(ctx context.Context, params OverflowQuery) ([]Overflow, error)
+
+	// QueryPumpCyclesFunc mocks the QueryPumpCycles method.
+	QueryPumpCyclesFunc func(ctx context.Context, params PumpCycleQuery) ([]PumpCycle, error)
+
+	// QueryQuarantinedFunc mocks the QueryQuarantined method.
+	QueryQuarantinedFunc func(ctx context.Context, params QuarantineQuery) ([]QuarantinedReading, error)
+
 	// ReadFunc mocks the Read method.
 	ReadFunc func(ctx context.Context, id string, typeName string) (any, error)
 
+	// ReadAllFunc mocks the ReadAll method.
+	ReadAllFunc func(ctx context.Context, typeName string, params QueryParams) (QueryResult, error)
+
+	// ReadWithVersionFunc mocks the ReadWithVersion method.
+	ReadWithVersionFunc func(ctx context.Context, id string, typeName string) (any, int64, error)
+
+	// StoreDeadLetterFunc mocks the StoreDeadLetter method.
+	StoreDeadLetterFunc func(ctx context.Context, deadLetter DeadLetter) error
+
+	// StoreEmptyingFunc mocks the StoreEmptying method.
+	StoreEmptyingFunc func(ctx context.Context, emptying Emptying) error
+
+	// StoreOverflowFunc mocks the StoreOverflow method.
+	StoreOverflowFunc func(ctx context.Context, overflow Overflow) error
+
+	// StorePumpCycleFunc mocks the StorePumpCycle method.
+	StorePumpCycleFunc func(ctx context.Context, cycle PumpCycle) error
+
+	// StoreQuarantinedFunc mocks the StoreQuarantined method.
+	StoreQuarantinedFunc func(ctx context.Context, reading QuarantinedReading) error
+
 	// UpdateFunc mocks the Update method.
 	UpdateFunc func(ctx context.Context, id string, typeName string, value any) error
 
+	// UpsertFunc mocks the Upsert method.
+	UpsertFunc func(ctx context.Context, id string, typeName string, value any, version int64) (int64, error)
+
+	// UpsertWithOutboxFunc mocks the UpsertWithOutbox method.
+	UpsertWithOutboxFunc func(ctx context.Context, id string, typeName string, value any, version int64, messages []OutboxMessage, events Events) (int64, error)
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Create holds details about calls to the Create method.
@@ -62,6 +207,13 @@ type StorageMock struct {
 			// Value is the value argument value.
 			Value any
 		}
+		// DeleteDeadLetter holds details about calls to the DeleteDeadLetter method.
+		DeleteDeadLetter []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
 		// Exists holds details about calls to the Exists method.
 		Exists []struct {
 			// Ctx is the ctx argument value.
@@ -71,6 +223,122 @@ type StorageMock struct {
 			// TypeName is the typeName argument value.
 			TypeName string
 		}
+		// GetDeadLetter holds details about calls to the GetDeadLetter method.
+		GetDeadLetter []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+		}
+		// IsMessageProcessed holds details about calls to the IsMessageProcessed method.
+		IsMessageProcessed []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Hash is the hash argument value.
+			Hash string
+			// ThingID is the thingID argument value.
+			ThingID string
+			// ThingType is the thingType argument value.
+			ThingType string
+		}
+		// MarkMessageProcessed holds details about calls to the MarkMessageProcessed method.
+		MarkMessageProcessed []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Hash is the hash argument value.
+			Hash string
+			// ThingID is the thingID argument value.
+			ThingID string
+			// ThingType is the thingType argument value.
+			ThingType string
+			// Expires is the expires argument value.
+			Expires time.Time
+		}
+		// OverflowStatistics holds details about calls to the OverflowStatistics method.
+		OverflowStatistics []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params OverflowQuery
+			// Period is the period argument value.
+			Period Period
+		}
+		// ProcessOutbox holds details about calls to the ProcessOutbox method.
+		ProcessOutbox []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Limit is the limit argument value.
+			Limit int
+			// MaxAttempts is the maxAttempts argument value.
+			MaxAttempts int
+			// Deliver is the deliver argument value.
+			Deliver func(ctx context.Context, message OutboxMessage) error
+		}
+		// PumpCycleStatistics holds details about calls to the PumpCycleStatistics method.
+		PumpCycleStatistics []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params PumpCycleQuery
+			// Period is the period argument value.
+			Period Period
+		}
+		// PurgeDeadLetters holds details about calls to the PurgeDeadLetters method.
+		PurgeDeadLetters []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params DeadLetterQuery
+		}
+		// PurgeOutbox holds details about calls to the PurgeOutbox method.
+		PurgeOutbox []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// DeliveredBefore is the deliveredBefore argument value.
+			DeliveredBefore time.Time
+		}
+		// PurgeProcessedMessages holds details about calls to the PurgeProcessedMessages method.
+		PurgeProcessedMessages []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ExpiredBefore is the expiredBefore argument value.
+			ExpiredBefore time.Time
+		}
+		// QueryDeadLetters holds details about calls to the QueryDeadLetters method.
+		QueryDeadLetters []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params DeadLetterQuery
+		}
+		// QueryEmptyings holds details about calls to the QueryEmptyings method.
+		QueryEmptyings []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params EmptyingQuery
+		}
+		// QueryOverflows holds details about calls to the QueryOverflows method.
+		QueryOverflows []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params OverflowQuery
+		}
+		// QueryPumpCycles holds details about calls to the QueryPumpCycles method.
+		QueryPumpCycles []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params PumpCycleQuery
+		}
+		// QueryQuarantined holds details about calls to the QueryQuarantined method.
+		QueryQuarantined []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Params is the params argument value.
+			Params QuarantineQuery
+		}
 		// Read holds details about calls to the Read method.
 		Read []struct {
 			// Ctx is the ctx argument value.
@@ -80,6 +348,59 @@ type StorageMock struct {
 			// TypeName is the typeName argument value.
 			TypeName string
 		}
+		// ReadAll holds details about calls to the ReadAll method.
+		ReadAll []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// TypeName is the typeName argument value.
+			TypeName string
+			// Params is the params argument value.
+			Params QueryParams
+		}
+		// ReadWithVersion holds details about calls to the ReadWithVersion method.
+		ReadWithVersion []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// TypeName is the typeName argument value.
+			TypeName string
+		}
+		// StoreDeadLetter holds details about calls to the StoreDeadLetter method.
+		StoreDeadLetter []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// DeadLetter is the deadLetter argument value.
+			DeadLetter DeadLetter
+		}
+		// StoreEmptying holds details about calls to the StoreEmptying method.
+		StoreEmptying []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Emptying is the emptying argument value.
+			Emptying Emptying
+		}
+		// StoreOverflow holds details about calls to the StoreOverflow method.
+		StoreOverflow []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Overflow is the overflow argument value.
+			Overflow Overflow
+		}
+		// StorePumpCycle holds details about calls to the StorePumpCycle method.
+		StorePumpCycle []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Cycle is the cycle argument value.
+			Cycle PumpCycle
+		}
+		// StoreQuarantined holds details about calls to the StoreQuarantined method.
+		StoreQuarantined []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Reading is the reading argument value.
+			Reading QuarantinedReading
+		}
 		// Update holds details about calls to the Update method.
 		Update []struct {
 			// Ctx is the ctx argument value.
@@ -91,11 +412,65 @@ type StorageMock struct {
 			// Value is the value argument value.
 			Value any
 		}
+		// Upsert holds details about calls to the Upsert method.
+		Upsert []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// TypeName is the typeName argument value.
+			TypeName string
+			// Value is the value argument value.
+			Value any
+			// Version is the version argument value.
+			Version int64
+		}
+		// UpsertWithOutbox holds details about calls to the UpsertWithOutbox method.
+		UpsertWithOutbox []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// ID is the id argument value.
+			ID string
+			// TypeName is the typeName argument value.
+			TypeName string
+			// Value is the value argument value.
+			Value any
+			// Version is the version argument value.
+			Version int64
+			// Messages is the messages argument value.
+			Messages []OutboxMessage
+			// Events is the events argument value.
+			Events Events
+		}
 	}
-	lockCreate sync.RWMutex
-	lockExists sync.RWMutex
-	lockRead   sync.RWMutex
-	lockUpdate sync.RWMutex
+	lockCreate                 sync.RWMutex
+	lockDeleteDeadLetter       sync.RWMutex
+	lockExists                 sync.RWMutex
+	lockGetDeadLetter          sync.RWMutex
+	lockIsMessageProcessed     sync.RWMutex
+	lockMarkMessageProcessed   sync.RWMutex
+	lockOverflowStatistics     sync.RWMutex
+	lockProcessOutbox          sync.RWMutex
+	lockPumpCycleStatistics    sync.RWMutex
+	lockPurgeDeadLetters       sync.RWMutex
+	lockPurgeOutbox            sync.RWMutex
+	lockPurgeProcessedMessages sync.RWMutex
+	lockQueryDeadLetters       sync.RWMutex
+	lockQueryEmptyings         sync.RWMutex
+	lockQueryOverflows         sync.RWMutex
+	lockQueryPumpCycles        sync.RWMutex
+	lockQueryQuarantined       sync.RWMutex
+	lockRead                   sync.RWMutex
+	lockReadAll                sync.RWMutex
+	lockReadWithVersion        sync.RWMutex
+	lockStoreDeadLetter        sync.RWMutex
+	lockStoreEmptying          sync.RWMutex
+	lockStoreOverflow          sync.RWMutex
+	lockStorePumpCycle         sync.RWMutex
+	lockStoreQuarantined       sync.RWMutex
+	lockUpdate                 sync.RWMutex
+	lockUpsert                 sync.RWMutex
+	lockUpsertWithOutbox       sync.RWMutex
 }
 
 // Create calls CreateFunc.
@@ -142,6 +517,42 @@ func (mock *StorageMock) CreateCalls() []struct {
 	return calls
 }
 
+// DeleteDeadLetter calls DeleteDeadLetterFunc.
+func (mock *StorageMock) DeleteDeadLetter(ctx context.Context, id string) error {
+	if mock.DeleteDeadLetterFunc == nil {
+		panic("StorageMock.DeleteDeadLetterFunc: method is nil but Storage.DeleteDeadLetter was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		ID  string
+	}{
+		Ctx: ctx,
+		ID:  id,
+	}
+	mock.lockDeleteDeadLetter.Lock()
+	mock.calls.DeleteDeadLetter = append(mock.calls.DeleteDeadLetter, callInfo)
+	mock.lockDeleteDeadLetter.Unlock()
+	return mock.DeleteDeadLetterFunc(ctx, id)
+}
+
+// DeleteDeadLetterCalls gets all the calls that were made to DeleteDeadLetter.
+// Check the length with:
+//
+//	len(mockedStorage.DeleteDeadLetterCalls())
+func (mock *StorageMock) DeleteDeadLetterCalls() []struct {
+	Ctx context.Context
+	ID  string
+} {
+	var calls []struct {
+		Ctx context.Context
+		ID  string
+	}
+	mock.lockDeleteDeadLetter.RLock()
+	calls = mock.calls.DeleteDeadLetter
+	mock.lockDeleteDeadLetter.RUnlock()
+	return calls
+}
+
 // Exists calls ExistsFunc.
 func (mock *StorageMock) Exists(ctx context.Context, id string, typeName string) bool {
 	if mock.ExistsFunc == nil {
@@ -182,86 +593,990 @@ func (mock *StorageMock) ExistsCalls() []struct {
 	return calls
 }
 
-// Read calls ReadFunc.
-func (mock *StorageMock) Read(ctx context.Context, id string, typeName string) (any, error) {
-	if mock.ReadFunc == nil {
-		panic("StorageMock.ReadFunc: method is nil but Storage.Read was just called")
+// GetDeadLetter calls GetDeadLetterFunc.
+func (mock *StorageMock) GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	if mock.GetDeadLetterFunc == nil {
+		panic("StorageMock.GetDeadLetterFunc: method is nil but Storage.GetDeadLetter was just called")
 	}
 	callInfo := struct {
-		Ctx      context.Context
-		ID       string
-		TypeName string
+		Ctx context.Context
+		ID  string
 	}{
-		Ctx:      ctx,
-		ID:       id,
-		TypeName: typeName,
+		Ctx: ctx,
+		ID:  id,
 	}
-	mock.lockRead.Lock()
-	mock.calls.Read = append(mock.calls.Read, callInfo)
-	mock.lockRead.Unlock()
-	return mock.ReadFunc(ctx, id, typeName)
+	mock.lockGetDeadLetter.Lock()
+	mock.calls.GetDeadLetter = append(mock.calls.GetDeadLetter, callInfo)
+	mock.lockGetDeadLetter.Unlock()
+	return mock.GetDeadLetterFunc(ctx, id)
 }
 
-// ReadCalls gets all the calls that were made to Read.
+// GetDeadLetterCalls gets all the calls that were made to GetDeadLetter.
 // Check the length with:
 //
-//	len(mockedStorage.ReadCalls())
-func (mock *StorageMock) ReadCalls() []struct {
-	Ctx      context.Context
-	ID       string
-	TypeName string
+//	len(mockedStorage.GetDeadLetterCalls())
+func (mock *StorageMock) GetDeadLetterCalls() []struct {
+	Ctx context.Context
+	ID  string
 } {
 	var calls []struct {
-		Ctx      context.Context
-		ID       string
-		TypeName string
+		Ctx context.Context
+		ID  string
 	}
-	mock.lockRead.RLock()
-	calls = mock.calls.Read
-	mock.lockRead.RUnlock()
+	mock.lockGetDeadLetter.RLock()
+	calls = mock.calls.GetDeadLetter
+	mock.lockGetDeadLetter.RUnlock()
 	return calls
 }
 
-// Update calls UpdateFunc.
-func (mock *StorageMock) Update(ctx context.Context, id string, typeName string, value any) error {
-	if mock.UpdateFunc == nil {
-		panic("StorageMock.UpdateFunc: method is nil but Storage.Update was just called")
+// IsMessageProcessed calls IsMessageProcessedFunc.
+func (mock *StorageMock) IsMessageProcessed(ctx context.Context, hash string, thingID string, thingType string) (bool, error) {
+	if mock.IsMessageProcessedFunc == nil {
+		panic("StorageMock.IsMessageProcessedFunc: method is nil but Storage.IsMessageProcessed was just called")
 	}
 	callInfo := struct {
-		Ctx      context.Context
-		ID       string
-		TypeName string
-		Value    any
+		Ctx       context.Context
+		Hash      string
+		ThingID   string
+		ThingType string
 	}{
-		Ctx:      ctx,
-		ID:       id,
-		TypeName: typeName,
-		Value:    value,
+		Ctx:       ctx,
+		Hash:      hash,
+		ThingID:   thingID,
+		ThingType: thingType,
 	}
-	mock.lockUpdate.Lock()
-	mock.calls.Update = append(mock.calls.Update, callInfo)
-	mock.lockUpdate.Unlock()
-	return mock.UpdateFunc(ctx, id, typeName, value)
+	mock.lockIsMessageProcessed.Lock()
+	mock.calls.IsMessageProcessed = append(mock.calls.IsMessageProcessed, callInfo)
+	mock.lockIsMessageProcessed.Unlock()
+	return mock.IsMessageProcessedFunc(ctx, hash, thingID, thingType)
 }
 
-// UpdateCalls gets all the calls that were made to Update.
+// IsMessageProcessedCalls gets all the calls that were made to IsMessageProcessed.
 // Check the length with:
 //
-//	len(mockedStorage.UpdateCalls())
-func (mock *StorageMock) UpdateCalls() []struct {
-	Ctx      context.Context
-	ID       string
-	TypeName string
-	Value    any
+//	len(mockedStorage.IsMessageProcessedCalls())
+func (mock *StorageMock) IsMessageProcessedCalls() []struct {
+	Ctx       context.Context
+	Hash      string
+	ThingID   string
+	ThingType string
 } {
 	var calls []struct {
-		Ctx      context.Context
-		ID       string
-		TypeName string
-		Value    any
+		Ctx       context.Context
+		Hash      string
+		ThingID   string
+		ThingType string
 	}
-	mock.lockUpdate.RLock()
-	calls = mock.calls.Update
-	mock.lockUpdate.RUnlock()
+	mock.lockIsMessageProcessed.RLock()
+	calls = mock.calls.IsMessageProcessed
+	mock.lockIsMessageProcessed.RUnlock()
+	return calls
+}
+
+// MarkMessageProcessed calls MarkMessageProcessedFunc.
+func (mock *StorageMock) MarkMessageProcessed(ctx context.Context, hash string, thingID string, thingType string, expires time.Time) error {
+	if mock.MarkMessageProcessedFunc == nil {
+		panic("StorageMock.MarkMessageProcessedFunc: method is nil but Storage.MarkMessageProcessed was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		Hash      string
+		ThingID   string
+		ThingType string
+		Expires   time.Time
+	}{
+		Ctx:       ctx,
+		Hash:      hash,
+		ThingID:   thingID,
+		ThingType: thingType,
+		Expires:   expires,
+	}
+	mock.lockMarkMessageProcessed.Lock()
+	mock.calls.MarkMessageProcessed = append(mock.calls.MarkMessageProcessed, callInfo)
+	mock.lockMarkMessageProcessed.Unlock()
+	return mock.MarkMessageProcessedFunc(ctx, hash, thingID, thingType, expires)
+}
+
+// MarkMessageProcessedCalls gets all the calls that were made to MarkMessageProcessed.
+// Check the length with:
+//
+//	len(mockedStorage.MarkMessageProcessedCalls())
+func (mock *StorageMock) MarkMessageProcessedCalls() []struct {
+	Ctx       context.Context
+	Hash      string
+	ThingID   string
+	ThingType string
+	Expires   time.Time
+} {
+	var calls []struct {
+		Ctx       context.Context
+		Hash      string
+		ThingID   string
+		ThingType string
+		Expires   time.Time
+	}
+	mock.lockMarkMessageProcessed.RLock()
+	calls = mock.calls.MarkMessageProcessed
+	mock.lockMarkMessageProcessed.RUnlock()
+	return calls
+}
+
+// OverflowStatistics calls OverflowStatisticsFunc.
+func (mock *StorageMock) OverflowStatistics(ctx context.Context, params OverflowQuery, period Period) ([]Statistics, error) {
+	if mock.OverflowStatisticsFunc == nil {
+		panic("StorageMock.OverflowStatisticsFunc: method is nil but Storage.OverflowStatistics was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params OverflowQuery
+		Period Period
+	}{
+		Ctx:    ctx,
+		Params: params,
+		Period: period,
+	}
+	mock.lockOverflowStatistics.Lock()
+	mock.calls.OverflowStatistics = append(mock.calls.OverflowStatistics, callInfo)
+	mock.lockOverflowStatistics.Unlock()
+	return mock.OverflowStatisticsFunc(ctx, params, period)
+}
+
+// OverflowStatisticsCalls gets all the calls that were made to OverflowStatistics.
+// Check the length with:
+//
+//	len(mockedStorage.OverflowStatisticsCalls())
+func (mock *StorageMock) OverflowStatisticsCalls() []struct {
+	Ctx    context.Context
+	Params OverflowQuery
+	Period Period
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params OverflowQuery
+		Period Period
+	}
+	mock.lockOverflowStatistics.RLock()
+	calls = mock.calls.OverflowStatistics
+	mock.lockOverflowStatistics.RUnlock()
+	return calls
+}
+
+// ProcessOutbox calls ProcessOutboxFunc.
+func (mock *StorageMock) ProcessOutbox(ctx context.Context, limit int, maxAttempts int, deliver func(ctx context.Context, message OutboxMessage) error) (int, error) {
+	if mock.ProcessOutboxFunc == nil {
+		panic("StorageMock.ProcessOutboxFunc: method is nil but Storage.ProcessOutbox was just called")
+	}
+	callInfo := struct {
+		Ctx         context.Context
+		Limit       int
+		MaxAttempts int
+		Deliver     func(ctx context.Context, message OutboxMessage) error
+	}{
+		Ctx:         ctx,
+		Limit:       limit,
+		MaxAttempts: maxAttempts,
+		Deliver:     deliver,
+	}
+	mock.lockProcessOutbox.Lock()
+	mock.calls.ProcessOutbox = append(mock.calls.ProcessOutbox, callInfo)
+	mock.lockProcessOutbox.Unlock()
+	return mock.ProcessOutboxFunc(ctx, limit, maxAttempts, deliver)
+}
+
+// ProcessOutboxCalls gets all the calls that were made to ProcessOutbox.
+// Check the length with:
+//
+//	len(mockedStorage.ProcessOutboxCalls())
+func (mock *StorageMock) ProcessOutboxCalls() []struct {
+	Ctx         context.Context
+	Limit       int
+	MaxAttempts int
+	Deliver     func(ctx context.Context, message OutboxMessage) error
+} {
+	var calls []struct {
+		Ctx         context.Context
+		Limit       int
+		MaxAttempts int
+		Deliver     func(ctx context.Context, message OutboxMessage) error
+	}
+	mock.lockProcessOutbox.RLock()
+	calls = mock.calls.ProcessOutbox
+	mock.lockProcessOutbox.RUnlock()
+	return calls
+}
+
+// PumpCycleStatistics calls PumpCycleStatisticsFunc.
+func (mock *StorageMock) PumpCycleStatistics(ctx context.Context, params PumpCycleQuery, period Period) ([]Statistics, error) {
+	if mock.PumpCycleStatisticsFunc == nil {
+		panic("StorageMock.PumpCycleStatisticsFunc: method is nil but Storage.PumpCycleStatistics was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params PumpCycleQuery
+		Period Period
+	}{
+		Ctx:    ctx,
+		Params: params,
+		Period: period,
+	}
+	mock.lockPumpCycleStatistics.Lock()
+	mock.calls.PumpCycleStatistics = append(mock.calls.PumpCycleStatistics, callInfo)
+	mock.lockPumpCycleStatistics.Unlock()
+	return mock.PumpCycleStatisticsFunc(ctx, params, period)
+}
+
+// PumpCycleStatisticsCalls gets all the calls that were made to PumpCycleStatistics.
+// Check the length with:
+//
+//	len(mockedStorage.PumpCycleStatisticsCalls())
+func (mock *StorageMock) PumpCycleStatisticsCalls() []struct {
+	Ctx    context.Context
+	Params PumpCycleQuery
+	Period Period
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params PumpCycleQuery
+		Period Period
+	}
+	mock.lockPumpCycleStatistics.RLock()
+	calls = mock.calls.PumpCycleStatistics
+	mock.lockPumpCycleStatistics.RUnlock()
+	return calls
+}
+
+// PurgeDeadLetters calls PurgeDeadLettersFunc.
+func (mock *StorageMock) PurgeDeadLetters(ctx context.Context, params DeadLetterQuery) (int64, error) {
+	if mock.PurgeDeadLettersFunc == nil {
+		panic("StorageMock.PurgeDeadLettersFunc: method is nil but Storage.PurgeDeadLetters was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params DeadLetterQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockPurgeDeadLetters.Lock()
+	mock.calls.PurgeDeadLetters = append(mock.calls.PurgeDeadLetters, callInfo)
+	mock.lockPurgeDeadLetters.Unlock()
+	return mock.PurgeDeadLettersFunc(ctx, params)
+}
+
+// PurgeDeadLettersCalls gets all the calls that were made to PurgeDeadLetters.
+// Check the length with:
+//
+//	len(mockedStorage.PurgeDeadLettersCalls())
+func (mock *StorageMock) PurgeDeadLettersCalls() []struct {
+	Ctx    context.Context
+	Params DeadLetterQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params DeadLetterQuery
+	}
+	mock.lockPurgeDeadLetters.RLock()
+	calls = mock.calls.PurgeDeadLetters
+	mock.lockPurgeDeadLetters.RUnlock()
+	return calls
+}
+
+// PurgeOutbox calls PurgeOutboxFunc.
+func (mock *StorageMock) PurgeOutbox(ctx context.Context, deliveredBefore time.Time) (int64, error) {
+	if mock.PurgeOutboxFunc == nil {
+		panic("StorageMock.PurgeOutboxFunc: method is nil but Storage.PurgeOutbox was just called")
+	}
+	callInfo := struct {
+		Ctx             context.Context
+		DeliveredBefore time.Time
+	}{
+		Ctx:             ctx,
+		DeliveredBefore: deliveredBefore,
+	}
+	mock.lockPurgeOutbox.Lock()
+	mock.calls.PurgeOutbox = append(mock.calls.PurgeOutbox, callInfo)
+	mock.lockPurgeOutbox.Unlock()
+	return mock.PurgeOutboxFunc(ctx, deliveredBefore)
+}
+
+// PurgeOutboxCalls gets all the calls that were made to PurgeOutbox.
+// Check the length with:
+//
+//	len(mockedStorage.PurgeOutboxCalls())
+func (mock *StorageMock) PurgeOutboxCalls() []struct {
+	Ctx             context.Context
+	DeliveredBefore time.Time
+} {
+	var calls []struct {
+		Ctx             context.Context
+		DeliveredBefore time.Time
+	}
+	mock.lockPurgeOutbox.RLock()
+	calls = mock.calls.PurgeOutbox
+	mock.lockPurgeOutbox.RUnlock()
+	return calls
+}
+
+// PurgeProcessedMessages calls PurgeProcessedMessagesFunc.
+func (mock *StorageMock) PurgeProcessedMessages(ctx context.Context, expiredBefore time.Time) (int64, error) {
+	if mock.PurgeProcessedMessagesFunc == nil {
+		panic("StorageMock.PurgeProcessedMessagesFunc: method is nil but Storage.PurgeProcessedMessages was just called")
+	}
+	callInfo := struct {
+		Ctx           context.Context
+		ExpiredBefore time.Time
+	}{
+		Ctx:           ctx,
+		ExpiredBefore: expiredBefore,
+	}
+	mock.lockPurgeProcessedMessages.Lock()
+	mock.calls.PurgeProcessedMessages = append(mock.calls.PurgeProcessedMessages, callInfo)
+	mock.lockPurgeProcessedMessages.Unlock()
+	return mock.PurgeProcessedMessagesFunc(ctx, expiredBefore)
+}
+
+// PurgeProcessedMessagesCalls gets all the calls that were made to PurgeProcessedMessages.
+// Check the length with:
+//
+//	len(mockedStorage.PurgeProcessedMessagesCalls())
+func (mock *StorageMock) PurgeProcessedMessagesCalls() []struct {
+	Ctx           context.Context
+	ExpiredBefore time.Time
+} {
+	var calls []struct {
+		Ctx           context.Context
+		ExpiredBefore time.Time
+	}
+	mock.lockPurgeProcessedMessages.RLock()
+	calls = mock.calls.PurgeProcessedMessages
+	mock.lockPurgeProcessedMessages.RUnlock()
+	return calls
+}
+
+// QueryDeadLetters calls QueryDeadLettersFunc.
+func (mock *StorageMock) QueryDeadLetters(ctx context.Context, params DeadLetterQuery) ([]DeadLetter, int64, error) {
+	if mock.QueryDeadLettersFunc == nil {
+		panic("StorageMock.QueryDeadLettersFunc: method is nil but Storage.QueryDeadLetters was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params DeadLetterQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockQueryDeadLetters.Lock()
+	mock.calls.QueryDeadLetters = append(mock.calls.QueryDeadLetters, callInfo)
+	mock.lockQueryDeadLetters.Unlock()
+	return mock.QueryDeadLettersFunc(ctx, params)
+}
+
+// QueryDeadLettersCalls gets all the calls that were made to QueryDeadLetters.
+// Check the length with:
+//
+//	len(mockedStorage.QueryDeadLettersCalls())
+func (mock *StorageMock) QueryDeadLettersCalls() []struct {
+	Ctx    context.Context
+	Params DeadLetterQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params DeadLetterQuery
+	}
+	mock.lockQueryDeadLetters.RLock()
+	calls = mock.calls.QueryDeadLetters
+	mock.lockQueryDeadLetters.RUnlock()
+	return calls
+}
+
+// QueryEmptyings calls QueryEmptyingsFunc.
+func (mock *StorageMock) QueryEmptyings(ctx context.Context, params EmptyingQuery) ([]Emptying, error) {
+	if mock.QueryEmptyingsFunc == nil {
+		panic("StorageMock.QueryEmptyingsFunc: method is nil but Storage.QueryEmptyings was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params EmptyingQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockQueryEmptyings.Lock()
+	mock.calls.QueryEmptyings = append(mock.calls.QueryEmptyings, callInfo)
+	mock.lockQueryEmptyings.Unlock()
+	return mock.QueryEmptyingsFunc(ctx, params)
+}
+
+// QueryEmptyingsCalls gets all the calls that were made to QueryEmptyings.
+// Check the length with:
+//
+//	len(mockedStorage.QueryEmptyingsCalls())
+func (mock *StorageMock) QueryEmptyingsCalls() []struct {
+	Ctx    context.Context
+	Params EmptyingQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params EmptyingQuery
+	}
+	mock.lockQueryEmptyings.RLock()
+	calls = mock.calls.QueryEmptyings
+	mock.lockQueryEmptyings.RUnlock()
+	return calls
+}
+
+// QueryOverflows calls QueryOverflowsFunc.
+func (mock *StorageMock) QueryOverflows(ctx context.Context, params OverflowQuery) ([]Overflow, error) {
+	if mock.QueryOverflowsFunc == nil {
+		panic("StorageMock.QueryOverflowsFunc: method is nil but Storage.QueryOverflows was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params OverflowQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockQueryOverflows.Lock()
+	mock.calls.QueryOverflows = append(mock.calls.QueryOverflows, callInfo)
+	mock.lockQueryOverflows.Unlock()
+	return mock.QueryOverflowsFunc(ctx, params)
+}
+
+// QueryOverflowsCalls gets all the calls that were made to QueryOverflows.
+// Check the length with:
+//
+//	len(mockedStorage.QueryOverflowsCalls())
+func (mock *StorageMock) QueryOverflowsCalls() []struct {
+	Ctx    context.Context
+	Params OverflowQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params OverflowQuery
+	}
+	mock.lockQueryOverflows.RLock()
+	calls = mock.calls.QueryOverflows
+	mock.lockQueryOverflows.RUnlock()
+	return calls
+}
+
+// QueryPumpCycles calls QueryPumpCyclesFunc.
+func (mock *StorageMock) QueryPumpCycles(ctx context.Context, params PumpCycleQuery) ([]PumpCycle, error) {
+	if mock.QueryPumpCyclesFunc == nil {
+		panic("StorageMock.QueryPumpCyclesFunc: method is nil but Storage.QueryPumpCycles was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params PumpCycleQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockQueryPumpCycles.Lock()
+	mock.calls.QueryPumpCycles = append(mock.calls.QueryPumpCycles, callInfo)
+	mock.lockQueryPumpCycles.Unlock()
+	return mock.QueryPumpCyclesFunc(ctx, params)
+}
+
+// QueryPumpCyclesCalls gets all the calls that were made to QueryPumpCycles.
+// Check the length with:
+//
+//	len(mockedStorage.QueryPumpCyclesCalls())
+func (mock *StorageMock) QueryPumpCyclesCalls() []struct {
+	Ctx    context.Context
+	Params PumpCycleQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params PumpCycleQuery
+	}
+	mock.lockQueryPumpCycles.RLock()
+	calls = mock.calls.QueryPumpCycles
+	mock.lockQueryPumpCycles.RUnlock()
+	return calls
+}
+
+// QueryQuarantined calls QueryQuarantinedFunc.
+func (mock *StorageMock) QueryQuarantined(ctx context.Context, params QuarantineQuery) ([]QuarantinedReading, error) {
+	if mock.QueryQuarantinedFunc == nil {
+		panic("StorageMock.QueryQuarantinedFunc: method is nil but Storage.QueryQuarantined was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Params QuarantineQuery
+	}{
+		Ctx:    ctx,
+		Params: params,
+	}
+	mock.lockQueryQuarantined.Lock()
+	mock.calls.QueryQuarantined = append(mock.calls.QueryQuarantined, callInfo)
+	mock.lockQueryQuarantined.Unlock()
+	return mock.QueryQuarantinedFunc(ctx, params)
+}
+
+// QueryQuarantinedCalls gets all the calls that were made to QueryQuarantined.
+// Check the length with:
+//
+//	len(mockedStorage.QueryQuarantinedCalls())
+func (mock *StorageMock) QueryQuarantinedCalls() []struct {
+	Ctx    context.Context
+	Params QuarantineQuery
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Params QuarantineQuery
+	}
+	mock.lockQueryQuarantined.RLock()
+	calls = mock.calls.QueryQuarantined
+	mock.lockQueryQuarantined.RUnlock()
+	return calls
+}
+
+// Read calls ReadFunc.
+func (mock *StorageMock) Read(ctx context.Context, id string, typeName string) (any, error) {
+	if mock.ReadFunc == nil {
+		panic("StorageMock.ReadFunc: method is nil but Storage.Read was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+	}{
+		Ctx:      ctx,
+		ID:       id,
+		TypeName: typeName,
+	}
+	mock.lockRead.Lock()
+	mock.calls.Read = append(mock.calls.Read, callInfo)
+	mock.lockRead.Unlock()
+	return mock.ReadFunc(ctx, id, typeName)
+}
+
+// ReadCalls gets all the calls that were made to Read.
+// Check the length with:
+//
+//	len(mockedStorage.ReadCalls())
+func (mock *StorageMock) ReadCalls() []struct {
+	Ctx      context.Context
+	ID       string
+	TypeName string
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+	}
+	mock.lockRead.RLock()
+	calls = mock.calls.Read
+	mock.lockRead.RUnlock()
+	return calls
+}
+
+// ReadAll calls ReadAllFunc.
+func (mock *StorageMock) ReadAll(ctx context.Context, typeName string, params QueryParams) (QueryResult, error) {
+	if mock.ReadAllFunc == nil {
+		panic("StorageMock.ReadAllFunc: method is nil but Storage.ReadAll was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		TypeName string
+		Params   QueryParams
+	}{
+		Ctx:      ctx,
+		TypeName: typeName,
+		Params:   params,
+	}
+	mock.lockReadAll.Lock()
+	mock.calls.ReadAll = append(mock.calls.ReadAll, callInfo)
+	mock.lockReadAll.Unlock()
+	return mock.ReadAllFunc(ctx, typeName, params)
+}
+
+// ReadAllCalls gets all the calls that were made to ReadAll.
+// Check the length with:
+//
+//	len(mockedStorage.ReadAllCalls())
+func (mock *StorageMock) ReadAllCalls() []struct {
+	Ctx      context.Context
+	TypeName string
+	Params   QueryParams
+} {
+	var calls []struct {
+		Ctx      context.Context
+		TypeName string
+		Params   QueryParams
+	}
+	mock.lockReadAll.RLock()
+	calls = mock.calls.ReadAll
+	mock.lockReadAll.RUnlock()
+	return calls
+}
+
+// ReadWithVersion calls ReadWithVersionFunc.
+func (mock *StorageMock) ReadWithVersion(ctx context.Context, id string, typeName string) (any, int64, error) {
+	if mock.ReadWithVersionFunc == nil {
+		panic("StorageMock.ReadWithVersionFunc: method is nil but Storage.ReadWithVersion was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+	}{
+		Ctx:      ctx,
+		ID:       id,
+		TypeName: typeName,
+	}
+	mock.lockReadWithVersion.Lock()
+	mock.calls.ReadWithVersion = append(mock.calls.ReadWithVersion, callInfo)
+	mock.lockReadWithVersion.Unlock()
+	return mock.ReadWithVersionFunc(ctx, id, typeName)
+}
+
+// ReadWithVersionCalls gets all the calls that were made to ReadWithVersion.
+// Check the length with:
+//
+//	len(mockedStorage.ReadWithVersionCalls())
+func (mock *StorageMock) ReadWithVersionCalls() []struct {
+	Ctx      context.Context
+	ID       string
+	TypeName string
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+	}
+	mock.lockReadWithVersion.RLock()
+	calls = mock.calls.ReadWithVersion
+	mock.lockReadWithVersion.RUnlock()
+	return calls
+}
+
+// StoreDeadLetter calls StoreDeadLetterFunc.
+func (mock *StorageMock) StoreDeadLetter(ctx context.Context, deadLetter DeadLetter) error {
+	if mock.StoreDeadLetterFunc == nil {
+		panic("StorageMock.StoreDeadLetterFunc: method is nil but Storage.StoreDeadLetter was just called")
+	}
+	callInfo := struct {
+		Ctx        context.Context
+		DeadLetter DeadLetter
+	}{
+		Ctx:        ctx,
+		DeadLetter: deadLetter,
+	}
+	mock.lockStoreDeadLetter.Lock()
+	mock.calls.StoreDeadLetter = append(mock.calls.StoreDeadLetter, callInfo)
+	mock.lockStoreDeadLetter.Unlock()
+	return mock.StoreDeadLetterFunc(ctx, deadLetter)
+}
+
+// StoreDeadLetterCalls gets all the calls that were made to StoreDeadLetter.
+// Check the length with:
+//
+//	len(mockedStorage.StoreDeadLetterCalls())
+func (mock *StorageMock) StoreDeadLetterCalls() []struct {
+	Ctx        context.Context
+	DeadLetter DeadLetter
+} {
+	var calls []struct {
+		Ctx        context.Context
+		DeadLetter DeadLetter
+	}
+	mock.lockStoreDeadLetter.RLock()
+	calls = mock.calls.StoreDeadLetter
+	mock.lockStoreDeadLetter.RUnlock()
+	return calls
+}
+
+// StoreEmptying calls StoreEmptyingFunc.
+func (mock *StorageMock) StoreEmptying(ctx context.Context, emptying Emptying) error {
+	if mock.StoreEmptyingFunc == nil {
+		panic("StorageMock.StoreEmptyingFunc: method is nil but Storage.StoreEmptying was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		Emptying Emptying
+	}{
+		Ctx:      ctx,
+		Emptying: emptying,
+	}
+	mock.lockStoreEmptying.Lock()
+	mock.calls.StoreEmptying = append(mock.calls.StoreEmptying, callInfo)
+	mock.lockStoreEmptying.Unlock()
+	return mock.StoreEmptyingFunc(ctx, emptying)
+}
+
+// StoreEmptyingCalls gets all the calls that were made to StoreEmptying.
+// Check the length with:
+//
+//	len(mockedStorage.StoreEmptyingCalls())
+func (mock *StorageMock) StoreEmptyingCalls() []struct {
+	Ctx      context.Context
+	Emptying Emptying
+} {
+	var calls []struct {
+		Ctx      context.Context
+		Emptying Emptying
+	}
+	mock.lockStoreEmptying.RLock()
+	calls = mock.calls.StoreEmptying
+	mock.lockStoreEmptying.RUnlock()
+	return calls
+}
+
+// StoreOverflow calls StoreOverflowFunc.
+func (mock *StorageMock) StoreOverflow(ctx context.Context, overflow Overflow) error {
+	if mock.StoreOverflowFunc == nil {
+		panic("StorageMock.StoreOverflowFunc: method is nil but Storage.StoreOverflow was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		Overflow Overflow
+	}{
+		Ctx:      ctx,
+		Overflow: overflow,
+	}
+	mock.lockStoreOverflow.Lock()
+	mock.calls.StoreOverflow = append(mock.calls.StoreOverflow, callInfo)
+	mock.lockStoreOverflow.Unlock()
+	return mock.StoreOverflowFunc(ctx, overflow)
+}
+
+// StoreOverflowCalls gets all the calls that were made to StoreOverflow.
+// Check the length with:
+//
+//	len(mockedStorage.StoreOverflowCalls())
+func (mock *StorageMock) StoreOverflowCalls() []struct {
+	Ctx      context.Context
+	Overflow Overflow
+} {
+	var calls []struct {
+		Ctx      context.Context
+		Overflow Overflow
+	}
+	mock.lockStoreOverflow.RLock()
+	calls = mock.calls.StoreOverflow
+	mock.lockStoreOverflow.RUnlock()
+	return calls
+}
+
+// StorePumpCycle calls StorePumpCycleFunc.
+func (mock *StorageMock) StorePumpCycle(ctx context.Context, cycle PumpCycle) error {
+	if mock.StorePumpCycleFunc == nil {
+		panic("StorageMock.StorePumpCycleFunc: method is nil but Storage.StorePumpCycle was just called")
+	}
+	callInfo := struct {
+		Ctx   context.Context
+		Cycle PumpCycle
+	}{
+		Ctx:   ctx,
+		Cycle: cycle,
+	}
+	mock.lockStorePumpCycle.Lock()
+	mock.calls.StorePumpCycle = append(mock.calls.StorePumpCycle, callInfo)
+	mock.lockStorePumpCycle.Unlock()
+	return mock.StorePumpCycleFunc(ctx, cycle)
+}
+
+// StorePumpCycleCalls gets all the calls that were made to StorePumpCycle.
+// Check the length with:
+//
+//	len(mockedStorage.StorePumpCycleCalls())
+func (mock *StorageMock) StorePumpCycleCalls() []struct {
+	Ctx   context.Context
+	Cycle PumpCycle
+} {
+	var calls []struct {
+		Ctx   context.Context
+		Cycle PumpCycle
+	}
+	mock.lockStorePumpCycle.RLock()
+	calls = mock.calls.StorePumpCycle
+	mock.lockStorePumpCycle.RUnlock()
+	return calls
+}
+
+// StoreQuarantined calls StoreQuarantinedFunc.
+func (mock *StorageMock) StoreQuarantined(ctx context.Context, reading QuarantinedReading) error {
+	if mock.StoreQuarantinedFunc == nil {
+		panic("StorageMock.StoreQuarantinedFunc: method is nil but Storage.StoreQuarantined was just called")
+	}
+	callInfo := struct {
+		Ctx     context.Context
+		Reading QuarantinedReading
+	}{
+		Ctx:     ctx,
+		Reading: reading,
+	}
+	mock.lockStoreQuarantined.Lock()
+	mock.calls.StoreQuarantined = append(mock.calls.StoreQuarantined, callInfo)
+	mock.lockStoreQuarantined.Unlock()
+	return mock.StoreQuarantinedFunc(ctx, reading)
+}
+
+// StoreQuarantinedCalls gets all the calls that were made to StoreQuarantined.
+// Check the length with:
+//
+//	len(mockedStorage.StoreQuarantinedCalls())
+func (mock *StorageMock) StoreQuarantinedCalls() []struct {
+	Ctx     context.Context
+	Reading QuarantinedReading
+} {
+	var calls []struct {
+		Ctx     context.Context
+		Reading QuarantinedReading
+	}
+	mock.lockStoreQuarantined.RLock()
+	calls = mock.calls.StoreQuarantined
+	mock.lockStoreQuarantined.RUnlock()
+	return calls
+}
+
+// Update calls UpdateFunc.
+func (mock *StorageMock) Update(ctx context.Context, id string, typeName string, value any) error {
+	if mock.UpdateFunc == nil {
+		panic("StorageMock.UpdateFunc: method is nil but Storage.Update was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+	}{
+		Ctx:      ctx,
+		ID:       id,
+		TypeName: typeName,
+		Value:    value,
+	}
+	mock.lockUpdate.Lock()
+	mock.calls.Update = append(mock.calls.Update, callInfo)
+	mock.lockUpdate.Unlock()
+	return mock.UpdateFunc(ctx, id, typeName, value)
+}
+
+// UpdateCalls gets all the calls that were made to Update.
+// Check the length with:
+//
+//	len(mockedStorage.UpdateCalls())
+func (mock *StorageMock) UpdateCalls() []struct {
+	Ctx      context.Context
+	ID       string
+	TypeName string
+	Value    any
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+	}
+	mock.lockUpdate.RLock()
+	calls = mock.calls.Update
+	mock.lockUpdate.RUnlock()
+	return calls
+}
+
+// Upsert calls UpsertFunc.
+func (mock *StorageMock) Upsert(ctx context.Context, id string, typeName string, value any, version int64) (int64, error) {
+	if mock.UpsertFunc == nil {
+		panic("StorageMock.UpsertFunc: method is nil but Storage.Upsert was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+		Version  int64
+	}{
+		Ctx:      ctx,
+		ID:       id,
+		TypeName: typeName,
+		Value:    value,
+		Version:  version,
+	}
+	mock.lockUpsert.Lock()
+	mock.calls.Upsert = append(mock.calls.Upsert, callInfo)
+	mock.lockUpsert.Unlock()
+	return mock.UpsertFunc(ctx, id, typeName, value, version)
+}
+
+// UpsertCalls gets all the calls that were made to Upsert.
+// Check the length with:
+//
+//	len(mockedStorage.UpsertCalls())
+func (mock *StorageMock) UpsertCalls() []struct {
+	Ctx      context.Context
+	ID       string
+	TypeName string
+	Value    any
+	Version  int64
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+		Version  int64
+	}
+	mock.lockUpsert.RLock()
+	calls = mock.calls.Upsert
+	mock.lockUpsert.RUnlock()
+	return calls
+}
+
+// UpsertWithOutbox calls UpsertWithOutboxFunc.
+func (mock *StorageMock) UpsertWithOutbox(ctx context.Context, id string, typeName string, value any, version int64, messages []OutboxMessage, events Events) (int64, error) {
+	if mock.UpsertWithOutboxFunc == nil {
+		panic("StorageMock.UpsertWithOutboxFunc: method is nil but Storage.UpsertWithOutbox was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+		Version  int64
+		Messages []OutboxMessage
+		Events   Events
+	}{
+		Ctx:      ctx,
+		ID:       id,
+		TypeName: typeName,
+		Value:    value,
+		Version:  version,
+		Messages: messages,
+		Events:   events,
+	}
+	mock.lockUpsertWithOutbox.Lock()
+	mock.calls.UpsertWithOutbox = append(mock.calls.UpsertWithOutbox, callInfo)
+	mock.lockUpsertWithOutbox.Unlock()
+	return mock.UpsertWithOutboxFunc(ctx, id, typeName, value, version, messages, events)
+}
+
+// UpsertWithOutboxCalls gets all the calls that were made to UpsertWithOutbox.
+// Check the length with:
+//
+//	len(mockedStorage.UpsertWithOutboxCalls())
+func (mock *StorageMock) UpsertWithOutboxCalls() []struct {
+	Ctx      context.Context
+	ID       string
+	TypeName string
+	Value    any
+	Version  int64
+	Messages []OutboxMessage
+	Events   Events
+} {
+	var calls []struct {
+		Ctx      context.Context
+		ID       string
+		TypeName string
+		Value    any
+		Version  int64
+		Messages []OutboxMessage
+		Events   Events
+	}
+	mock.lockUpsertWithOutbox.RLock()
+	calls = mock.calls.UpsertWithOutbox
+	mock.lockUpsertWithOutbox.RUnlock()
 	return calls
 }
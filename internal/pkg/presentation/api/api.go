@@ -1,24 +1,548 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/diwise/cip-functions/internal/pkg/application/sewagepumpingstation"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel"
 )
 
-func New() http.Handler {
+var tracer = otel.Tracer("cip-functions/api")
+
+const (
+	defaultLimit int = 100
+	maxLimit     int = 1000
+)
+
+// New creates the api. The dead letter routes, that expose and change incoming messages, require a token from auth and
+// only give access to the dead letters of the tenants the token is valid for.
+func New(s storage.Storage, replayer DeadLetterReplayer, auth *Authenticator, checks ...HealthCheck) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	mux.HandleFunc("GET /health", livenessHandler())
+	mux.HandleFunc("GET /health/live", livenessHandler())
+	mux.HandleFunc("GET /health/ready", readinessHandler(checks))
+	mux.HandleFunc("GET /ready", readinessHandler(checks))
+
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	mux.HandleFunc("GET /api/v0/cip-functions/{type}", queryFunctionsHandler(s))
+	mux.HandleFunc("GET /api/v0/cip-functions/{type}/{id}", getFunctionHandler(s))
+
+	mux.HandleFunc("GET /api/v0/cip-functions/combinedsewageoverflow/{id}/overflows", queryOverflowsHandler(s))
+	mux.HandleFunc("GET /api/v0/cip-functions/combinedsewageoverflow/{id}/overflows/statistics", overflowStatisticsHandler(s))
+
+	mux.HandleFunc("GET /api/v0/cip-functions/sewagepumpingstation/{id}/cycles", queryPumpCyclesHandler(s))
+	mux.HandleFunc("GET /api/v0/cip-functions/sewagepumpingstation/{id}/cycles/statistics", pumpCycleStatisticsHandler(s))
 
+	mux.HandleFunc("GET /api/v0/cip-functions/wastecontainer/emptyings", queryEmptyingsHandler(s))
+	mux.HandleFunc("GET /api/v0/cip-functions/wastecontainer/{id}/emptyings", queryEmptyingsHandler(s))
+
+	mux.HandleFunc("GET /api/v0/cip-functions/quarantine", queryQuarantineHandler(s))
+
+	mux.HandleFunc("GET /api/v0/cip-functions/deadletters", authenticated(auth, queryDeadLettersHandler(s)))
+	mux.HandleFunc("DELETE /api/v0/cip-functions/deadletters", authenticated(auth, purgeDeadLettersHandler(s)))
+	mux.HandleFunc("GET /api/v0/cip-functions/deadletters/{id}", authenticated(auth, getDeadLetterHandler(s)))
+	mux.HandleFunc("DELETE /api/v0/cip-functions/deadletters/{id}", authenticated(auth, deleteDeadLetterHandler(s)))
+	mux.HandleFunc("POST /api/v0/cip-functions/deadletters/{id}/replay", authenticated(auth, replayDeadLetterHandler(s, replayer)))
+
+	// credentials, i.e. cookies, are not allowed from any origin, tokens are sent in the Authorization header
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowCredentials: true,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodHead},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowCredentials: false,
 		Debug:            false,
 	})
 
 	handler := c.Handler(mux)
 	return handler
 }
+
+type meta struct {
+	TotalRecords int64 `json:"totalRecords"`
+	Offset       int   `json:"offset"`
+	Limit        int   `json:"limit"`
+	Count        int   `json:"count"`
+}
+
+type collectionResponse struct {
+	Meta meta  `json:"meta"`
+	Data []any `json:"data"`
+}
+
+type dataResponse struct {
+	Data any `json:"data"`
+}
+
+func queryFunctionsHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-functions")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		typeName := r.PathValue("type")
+		log := logging.GetFromContext(ctx).With(slog.String("type", typeName))
+
+		var params storage.QueryParams
+		params, err = queryParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var result storage.QueryResult
+		result, err = s.ReadAll(ctx, typeName, params)
+		if err != nil {
+			log.Error("failed to query functions", "err", err.Error())
+			http.Error(w, "failed to query functions", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC()
+		for i := range result.Data {
+			result.Data[i] = withComputedFields(typeName, result.Data[i], now)
+		}
+
+		writeJSON(w, http.StatusOK, collectionResponse{
+			Meta: meta{
+				TotalRecords: result.TotalRecords,
+				Offset:       result.Offset,
+				Limit:        result.Limit,
+				Count:        len(result.Data),
+			},
+			Data: result.Data,
+		})
+	}
+}
+
+func getFunctionHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-function")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		typeName := r.PathValue("type")
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("type", typeName), slog.String("id", id))
+
+		var obj any
+		obj, err = s.Read(ctx, id, typeName)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Error("failed to read function", "err", err.Error())
+			http.Error(w, "failed to read function", http.StatusInternalServerError)
+			return
+		}
+
+		tenants := tenantsFromQuery(r)
+		if len(tenants) > 0 && !slices.Contains(tenants, tenantOf(obj)) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, withComputedFields(typeName, obj, time.Now().UTC()))
+	}
+}
+
+func queryOverflowsHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-overflows")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var params storage.OverflowQuery
+		params, err = overflowQueryParams(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var overflows []storage.Overflow
+		overflows, err = s.QueryOverflows(ctx, params)
+		if err != nil {
+			log.Error("failed to query overflows", "err", err.Error())
+			http.Error(w, "failed to query overflows", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: overflows})
+	}
+}
+
+func overflowStatisticsHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "overflow-statistics")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var params storage.OverflowQuery
+		params, err = overflowQueryParams(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var period storage.Period
+		period, err = periodFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var statistics []storage.Statistics
+		statistics, err = s.OverflowStatistics(ctx, params, period)
+		if err != nil {
+			log.Error("failed to aggregate overflows", "err", err.Error())
+			http.Error(w, "failed to aggregate overflows", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: statistics})
+	}
+}
+
+func queryPumpCyclesHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-pump-cycles")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var params storage.PumpCycleQuery
+		params, err = pumpCycleQueryParams(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var cycles []storage.PumpCycle
+		cycles, err = s.QueryPumpCycles(ctx, params)
+		if err != nil {
+			log.Error("failed to query pump cycles", "err", err.Error())
+			http.Error(w, "failed to query pump cycles", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: cycles})
+	}
+}
+
+func pumpCycleStatisticsHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "pump-cycle-statistics")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var params storage.PumpCycleQuery
+		params, err = pumpCycleQueryParams(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var period storage.Period
+		period, err = periodFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var statistics []storage.Statistics
+		statistics, err = s.PumpCycleStatistics(ctx, params, period)
+		if err != nil {
+			log.Error("failed to aggregate pump cycles", "err", err.Error())
+			http.Error(w, "failed to aggregate pump cycles", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: statistics})
+	}
+}
+
+// queryEmptyingsHandler returns the emptyings of a single waste container, or of all waste containers if no id is given
+func queryEmptyingsHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-emptyings")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var p storage.QueryParams
+		p, err = queryParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		params := storage.EmptyingQuery{
+			WasteContainerID: id,
+			Tenants:          p.Tenants,
+			Offset:           p.Offset,
+			Limit:            p.Limit,
+		}
+
+		params.From, params.To, err = timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var emptyings []storage.Emptying
+		emptyings, err = s.QueryEmptyings(ctx, params)
+		if err != nil {
+			log.Error("failed to query emptyings", "err", err.Error())
+			http.Error(w, "failed to query emptyings", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: emptyings})
+	}
+}
+
+// quarantinedResponse shows the body of a quarantined reading as JSON if possible, or as a string if not
+type quarantinedResponse struct {
+	storage.QuarantinedReading
+	Body any `json:"body"`
+}
+
+func queryQuarantineHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-quarantine")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		log := logging.GetFromContext(ctx)
+
+		params := storage.QuarantineQuery{
+			ThingType: r.URL.Query().Get("type"),
+			ThingID:   r.URL.Query().Get("id"),
+			Tenants:   tenantsFromQuery(r),
+		}
+
+		params.From, params.To, err = timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var readings []storage.QuarantinedReading
+		readings, err = s.QueryQuarantined(ctx, params)
+		if err != nil {
+			log.Error("failed to query quarantined readings", "err", err.Error())
+			http.Error(w, "failed to query quarantined readings", http.StatusInternalServerError)
+			return
+		}
+
+		data := []quarantinedResponse{}
+		for _, q := range readings {
+			var body any = string(q.Body)
+			if json.Valid(q.Body) {
+				body = json.RawMessage(q.Body)
+			}
+			data = append(data, quarantinedResponse{QuarantinedReading: q, Body: body})
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: data})
+	}
+}
+
+func overflowQueryParams(r *http.Request, id string) (storage.OverflowQuery, error) {
+	var err error
+
+	params := storage.OverflowQuery{
+		CombinedSewageOverflowID: id,
+		Tenants:                  tenantsFromQuery(r),
+	}
+
+	params.From, params.To, err = timeRangeFromQuery(r)
+	if err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+func pumpCycleQueryParams(r *http.Request, id string) (storage.PumpCycleQuery, error) {
+	var err error
+
+	params := storage.PumpCycleQuery{
+		SewagePumpingStationID: id,
+		Tenants:                tenantsFromQuery(r),
+	}
+
+	params.From, params.To, err = timeRangeFromQuery(r)
+	if err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+// timeRangeFromQuery returns the optional from and to parameters, from must be before to if both are set
+func timeRangeFromQuery(r *http.Request) (time.Time, time.Time, error) {
+	from, err := timeFromQuery(r, "from")
+	if err != nil {
+		return from, time.Time{}, err
+	}
+
+	to, err := timeFromQuery(r, "to")
+	if err != nil {
+		return from, to, err
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+// periodFromQuery returns the optional period parameter, day if it is not set
+func periodFromQuery(r *http.Request) (storage.Period, error) {
+	p := r.URL.Query().Get("period")
+	if p == "" {
+		return storage.PeriodDay, nil
+	}
+
+	return storage.ParsePeriod(p)
+}
+
+func timeFromQuery(r *http.Request, key string) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s, expected RFC3339 timestamp: %s", key, value)
+	}
+
+	return t.UTC(), nil
+}
+
+func queryParams(r *http.Request) (storage.QueryParams, error) {
+	params := storage.QueryParams{
+		Tenants: tenantsFromQuery(r),
+		Offset:  0,
+		Limit:   defaultLimit,
+	}
+
+	q := r.URL.Query()
+
+	if offset := q.Get("offset"); offset != "" {
+		i, err := strconv.Atoi(offset)
+		if err != nil || i < 0 {
+			return params, fmt.Errorf("invalid offset %s", offset)
+		}
+		params.Offset = i
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i < 1 {
+			return params, fmt.Errorf("invalid limit %s", limit)
+		}
+		params.Limit = min(i, maxLimit)
+	}
+
+	return params, nil
+}
+
+// tenantsFromQuery supports both repeated (?tenant=a&tenant=b) and comma separated (?tenant=a,b) tenant parameters
+func tenantsFromQuery(r *http.Request) []string {
+	tenants := []string{}
+
+	for _, t := range r.URL.Query()["tenant"] {
+		for _, tenant := range strings.Split(t, ",") {
+			tenant = strings.TrimSpace(tenant)
+			if tenant != "" {
+				tenants = append(tenants, tenant)
+			}
+		}
+	}
+
+	return tenants
+}
+
+// withComputedFields adds the fields of a stored function that depend on the current time, and therefore are not stored,
+// i.e. timeSinceLastRun of a sewage pumping station
+func withComputedFields(typeName string, obj any, now time.Time) any {
+	m, ok := obj.(map[string]any)
+	if !ok || !strings.EqualFold(typeName, storage.GetTypeName[sewagepumpingstation.SewagePumpingStation]()) {
+		return obj
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return obj
+	}
+
+	var sp sewagepumpingstation.SewagePumpingStation
+	if err = json.Unmarshal(b, &sp); err != nil {
+		return obj
+	}
+
+	m["timeSinceLastRun"] = sp.TimeSinceLastRun(now)
+
+	return m
+}
+
+func tenantOf(obj any) string {
+	if m, ok := obj.(map[string]any); ok {
+		if tenant, ok := m["tenant"].(string); ok {
+			return tenant
+		}
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body any) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
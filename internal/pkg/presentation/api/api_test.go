@@ -0,0 +1,456 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/cip-functions/internal/pkg/application"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/matryer/is"
+)
+
+func TestHealth(t *testing.T) {
+	is, s := testSetup(t)
+
+	var dbErr error
+	server := httptest.NewServer(New(s, nil, nil,
+		HealthCheck{Name: "database", Check: func(ctx context.Context) error { return dbErr }},
+		HealthCheck{Name: "messaging", Check: func(ctx context.Context) error { return nil }},
+	))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/health/ready")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	health := healthResponse{}
+	is.NoErr(json.Unmarshal(body, &health))
+	is.Equal("up", health.Status)
+	is.Equal(2, len(health.Components))
+	is.Equal("up", health.Components["database"].Status)
+
+	dbErr = errors.New("connection refused")
+
+	for _, path := range []string{"/health/ready", "/ready"} {
+		resp, body = get(is, server.URL+path)
+		is.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+		health = healthResponse{}
+		is.NoErr(json.Unmarshal(body, &health))
+		is.Equal("down", health.Status)
+		is.Equal("down", health.Components["database"].Status)
+		is.Equal("connection refused", health.Components["database"].Error)
+		is.Equal("up", health.Components["messaging"].Status)
+	}
+
+	for _, path := range []string{"/health", "/health/live"} {
+		resp, body = get(is, server.URL+path)
+		is.Equal(http.StatusOK, resp.StatusCode) // liveness should not depend on other components
+		is.Equal(`{"status":"up"}`, string(body))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	is, s := testSetup(t)
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/metrics")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.True(strings.Contains(string(body), "cip_functions_workqueue_keys"))
+}
+
+func TestQueryFunctions(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.ReadAllFunc = func(ctx context.Context, typeName string, params storage.QueryParams) (storage.QueryResult, error) {
+		return storage.QueryResult{
+			Data:         []any{map[string]any{"id": "sewer:1", "type": "Sewer", "tenant": "default"}},
+			TotalRecords: 11,
+			Offset:       params.Offset,
+			Limit:        params.Limit,
+		}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/sewer?tenant=default,other&offset=10&limit=5")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := collectionResponse{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(int64(11), response.Meta.TotalRecords)
+	is.Equal(1, response.Meta.Count)
+
+	is.Equal(1, len(s.ReadAllCalls()))
+	is.Equal("sewer", s.ReadAllCalls()[0].TypeName)
+	is.Equal([]string{"default", "other"}, s.ReadAllCalls()[0].Params.Tenants)
+	is.Equal(10, s.ReadAllCalls()[0].Params.Offset)
+	is.Equal(5, s.ReadAllCalls()[0].Params.Limit)
+}
+
+func TestQueryFunctionsWithInvalidLimit(t *testing.T) {
+	is, s := testSetup(t)
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, _ := get(is, server.URL+"/api/v0/cip-functions/sewer?limit=abc")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+	is.Equal(0, len(s.ReadAllCalls()))
+}
+
+func TestGetFunction(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.ReadFunc = func(ctx context.Context, id, typeName string) (any, error) {
+		if id == "sewer:1" {
+			return map[string]any{"id": "sewer:1", "type": "Sewer", "tenant": "default"}, nil
+		}
+		return nil, storage.ErrNotFound
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/sewer/sewer:1")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	sewer := map[string]any{}
+	is.NoErr(json.Unmarshal(body, &sewer))
+	is.Equal("sewer:1", sewer["id"])
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/sewer/sewer:1?tenant=other")
+	is.Equal(http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/sewer/sewer:2")
+	is.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetSewagePumpingStationComputesTimeSinceLastRun(t *testing.T) {
+	is, s := testSetup(t)
+
+	lastRun := time.Now().UTC().Add(-2 * time.Hour)
+
+	s.ReadFunc = func(ctx context.Context, id, typeName string) (any, error) {
+		return map[string]any{"id": "sps:1", "type": "SewagePumpingStation", "state": false, "lastRun": lastRun.Format(time.RFC3339Nano)}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/sewagepumpingstation/sps:1")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	sps := struct {
+		TimeSinceLastRun time.Duration `json:"timeSinceLastRun"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &sps))
+	is.True(sps.TimeSinceLastRun >= 2*time.Hour)
+	is.True(sps.TimeSinceLastRun < 2*time.Hour+time.Minute)
+}
+
+func TestQueryOverflows(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryOverflowsFunc = func(ctx context.Context, params storage.OverflowQuery) ([]storage.Overflow, error) {
+		return []storage.Overflow{{ID: "overflow:1", CombinedSewageOverflowID: params.CombinedSewageOverflowID, StartTime: params.From}}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/combinedsewageoverflow/cso:1/overflows?from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := struct {
+		Data []storage.Overflow `json:"data"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(1, len(response.Data))
+
+	params := s.QueryOverflowsCalls()[0].Params
+	is.Equal("cso:1", params.CombinedSewageOverflowID)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), params.From)
+	is.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), params.To)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/combinedsewageoverflow/cso:1/overflows?from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestQueryEmptyings(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryEmptyingsFunc = func(ctx context.Context, params storage.EmptyingQuery) ([]storage.Emptying, error) {
+		return []storage.Emptying{{ID: "emptying:1", WasteContainerID: params.WasteContainerID, Timestamp: params.From}}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/wastecontainer/wc:1/emptyings?from=2024-01-01T00:00:00Z&tenant=default")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := struct {
+		Data []storage.Emptying `json:"data"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(1, len(response.Data))
+
+	params := s.QueryEmptyingsCalls()[0].Params
+	is.Equal("wc:1", params.WasteContainerID)
+	is.Equal([]string{"default"}, params.Tenants)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), params.From)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/wastecontainer/emptyings?to=2024-02-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal("", s.QueryEmptyingsCalls()[1].Params.WasteContainerID) // emptyings for all waste containers
+	is.Equal(defaultLimit, s.QueryEmptyingsCalls()[1].Params.Limit)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/wastecontainer/emptyings?offset=10&limit=5000")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal(10, s.QueryEmptyingsCalls()[2].Params.Offset)
+	is.Equal(maxLimit, s.QueryEmptyingsCalls()[2].Params.Limit)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/wastecontainer/emptyings?from=yesterday")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/wastecontainer/emptyings?limit=0")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestQueryQuarantine(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryQuarantinedFunc = func(ctx context.Context, params storage.QuarantineQuery) ([]storage.QuarantinedReading, error) {
+		return []storage.QuarantinedReading{{ID: 1, ThingID: "wc:1", ThingType: params.ThingType, Body: []byte(`{"id":"level:1"}`), Reason: "percent is invalid"}}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/quarantine?type=wastecontainer&id=wc:1&tenant=default")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := struct {
+		Data []struct {
+			ThingID string          `json:"thingID"`
+			Reason  string          `json:"reason"`
+			Body    json.RawMessage `json:"body"`
+		} `json:"data"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(1, len(response.Data))
+	is.Equal(`{"id":"level:1"}`, string(response.Data[0].Body)) // the body is shown as json
+
+	params := s.QueryQuarantinedCalls()[0].Params
+	is.Equal("wastecontainer", params.ThingType)
+	is.Equal("wc:1", params.ThingID)
+	is.Equal([]string{"default"}, params.Tenants)
+}
+
+func TestOverflowStatistics(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.OverflowStatisticsFunc = func(ctx context.Context, params storage.OverflowQuery, period storage.Period) ([]storage.Statistics, error) {
+		return []storage.Statistics{{Period: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Count: 3, Duration: 90 * time.Minute}}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, _ := get(is, server.URL+"/api/v0/cip-functions/combinedsewageoverflow/cso:1/overflows/statistics?period=month")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal(storage.PeriodMonth, s.OverflowStatisticsCalls()[0].Period)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/combinedsewageoverflow/cso:1/overflows/statistics?period=week")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPumpCycles(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryPumpCyclesFunc = func(ctx context.Context, params storage.PumpCycleQuery) ([]storage.PumpCycle, error) {
+		return []storage.PumpCycle{{ID: "cycle:1", SewagePumpingStationID: params.SewagePumpingStationID, Duration: 10 * time.Minute}}, nil
+	}
+	s.PumpCycleStatisticsFunc = func(ctx context.Context, params storage.PumpCycleQuery, period storage.Period) ([]storage.Statistics, error) {
+		return []storage.Statistics{{Period: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Count: 12, Duration: 2 * time.Hour}}, nil
+	}
+
+	server := httptest.NewServer(New(s, nil, nil))
+	defer server.Close()
+
+	resp, body := get(is, server.URL+"/api/v0/cip-functions/sewagepumpingstation/sps:1/cycles?from=2024-01-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := struct {
+		Data []storage.PumpCycle `json:"data"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(1, len(response.Data))
+	is.Equal("sps:1", s.QueryPumpCyclesCalls()[0].Params.SewagePumpingStationID)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/sewagepumpingstation/sps:1/cycles/statistics")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal(storage.PeriodDay, s.PumpCycleStatisticsCalls()[0].Period)
+
+	resp, _ = get(is, server.URL+"/api/v0/cip-functions/sewagepumpingstation/sps:1/cycles/statistics?period=week")
+	is.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestDeadLetters(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryDeadLettersFunc = func(ctx context.Context, params storage.DeadLetterQuery) ([]storage.DeadLetter, int64, error) {
+		return []storage.DeadLetter{
+			{ID: "deadletter:1", Topic: "function.updated", Body: []byte(`{"id":"level:1"}`), HandlerType: "sewer"},
+			{ID: "deadletter:2", Topic: "function.updated", Body: []byte(`{"id":`)},
+		}, 2, nil
+	}
+	s.GetDeadLetterFunc = func(ctx context.Context, id string) (storage.DeadLetter, error) {
+		return storage.DeadLetter{ID: id}, nil
+	}
+	s.PurgeDeadLettersFunc = func(ctx context.Context, params storage.DeadLetterQuery) (int64, error) {
+		return 2, nil
+	}
+
+	auth, err := NewAuthenticator([]Token{{Token: "secret", Tenants: []string{"*"}}})
+	is.NoErr(err)
+
+	replayer := &replayerMock{err: application.ErrReplayFailed}
+
+	server := httptest.NewServer(New(s, replayer, auth))
+	defer server.Close()
+
+	resp, body := sendAs(is, "secret", http.MethodGet, server.URL+"/api/v0/cip-functions/deadletters?handlerType=sewer&before=2024-01-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	response := struct {
+		Data []map[string]any `json:"data"`
+	}{}
+	is.NoErr(json.Unmarshal(body, &response))
+	is.Equal(2, len(response.Data))
+	is.Equal("level:1", response.Data[0]["body"].(map[string]any)["id"]) // valid json is shown as json
+	is.Equal(`{"id":`, response.Data[1]["body"])                         // invalid json is shown as a string
+
+	params := s.QueryDeadLettersCalls()[0].Params
+	is.Equal("sewer", params.HandlerType)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), params.Before)
+
+	resp, _ = sendAs(is, "secret", http.MethodPost, server.URL+"/api/v0/cip-functions/deadletters/deadletter:1/replay")
+	is.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	is.Equal("deadletter:1", replayer.id)
+
+	replayer.err = nil
+	resp, _ = sendAs(is, "secret", http.MethodPost, server.URL+"/api/v0/cip-functions/deadletters/deadletter:1/replay")
+	is.Equal(http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = sendAs(is, "secret", http.MethodDelete, server.URL+"/api/v0/cip-functions/deadletters?topic=function.updated")
+	is.Equal(http.StatusBadRequest, resp.StatusCode) // before is required to purge dead letters
+	is.Equal(0, len(s.PurgeDeadLettersCalls()))
+
+	resp, _ = sendAs(is, "secret", http.MethodDelete, server.URL+"/api/v0/cip-functions/deadletters?topic=function.updated&before=2024-01-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal("function.updated", s.PurgeDeadLettersCalls()[0].Params.Topic)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), s.PurgeDeadLettersCalls()[0].Params.Before)
+}
+
+func TestDeadLettersRequireTokenForTenant(t *testing.T) {
+	is, s := testSetup(t)
+
+	s.QueryDeadLettersFunc = func(ctx context.Context, params storage.DeadLetterQuery) ([]storage.DeadLetter, int64, error) {
+		return []storage.DeadLetter{}, 0, nil
+	}
+	s.GetDeadLetterFunc = func(ctx context.Context, id string) (storage.DeadLetter, error) {
+		return storage.DeadLetter{ID: id, Tenant: "north"}, nil
+	}
+
+	auth, err := NewAuthenticator([]Token{{Token: "south-secret", Tenants: []string{"south"}}})
+	is.NoErr(err)
+
+	server := httptest.NewServer(New(s, &replayerMock{}, auth))
+	defer server.Close()
+
+	url := server.URL + "/api/v0/cip-functions/deadletters"
+
+	for _, r := range []struct{ method, url string }{
+		{http.MethodGet, url},
+		{http.MethodDelete, url + "?before=2024-01-01T00:00:00Z"},
+		{http.MethodGet, url + "/deadletter:1"},
+		{http.MethodDelete, url + "/deadletter:1"},
+		{http.MethodPost, url + "/deadletter:1/replay"},
+	} {
+		resp, _ := send(is, r.method, r.url)
+		is.Equal(http.StatusUnauthorized, resp.StatusCode) // a token is required
+
+		resp, _ = sendAs(is, "wrong", r.method, r.url)
+		is.Equal(http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, _ := sendAs(is, "south-secret", http.MethodGet, url+"?tenant=south,north")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.Equal([]string{"south"}, s.QueryDeadLettersCalls()[0].Params.Tenants) // only the tenants of the token are queried
+
+	// the dead letters of other tenants are not found
+	resp, _ = sendAs(is, "south-secret", http.MethodGet, url+"/deadletter:1")
+	is.Equal(http.StatusNotFound, resp.StatusCode)
+	resp, _ = sendAs(is, "south-secret", http.MethodDelete, url+"/deadletter:1")
+	is.Equal(http.StatusNotFound, resp.StatusCode)
+	resp, _ = sendAs(is, "south-secret", http.MethodPost, url+"/deadletter:1/replay")
+	is.Equal(http.StatusNotFound, resp.StatusCode)
+
+	resp, body := sendAs(is, "south-secret", http.MethodDelete, url+"?tenant=north&before=2024-01-01T00:00:00Z")
+	is.Equal(http.StatusOK, resp.StatusCode)
+	is.True(strings.Contains(string(body), `"deleted":0`))
+	is.Equal(0, len(s.PurgeDeadLettersCalls()))
+}
+
+type replayerMock struct {
+	id  string
+	err error
+}
+
+func (r *replayerMock) ReplayDeadLetter(ctx context.Context, id string) error {
+	r.id = id
+	return r.err
+}
+
+func get(is *is.I, url string) (*http.Response, []byte) {
+	return send(is, http.MethodGet, url)
+}
+
+func send(is *is.I, method, url string) (*http.Response, []byte) {
+	return sendAs(is, "", method, url)
+}
+
+func sendAs(is *is.I, token, method, url string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	is.NoErr(err)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	is.NoErr(err)
+
+	return resp, body
+}
+
+func testSetup(t *testing.T) (*is.I, *storage.StorageMock) {
+	is := is.New(t)
+	s := &storage.StorageMock{}
+	return is, s
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const allTenants string = "*"
+
+// Token is a bearer token that gives access to the messages of the listed tenants, or of all tenants with "*"
+type Token struct {
+	Token   string   `json:"token" yaml:"token"`
+	Tenants []string `json:"tenants" yaml:"tenants"`
+}
+
+// Authenticator protects the routes that expose or change incoming messages, e.g. dead letters, using bearer tokens.
+// A nil Authenticator, or one without tokens, denies all requests to these routes.
+type Authenticator struct {
+	tokens []Token
+}
+
+func NewAuthenticator(tokens []Token) (*Authenticator, error) {
+	var errs []error
+
+	for i, t := range tokens {
+		if t.Token == "" {
+			errs = append(errs, fmt.Errorf("token %d is empty", i))
+		}
+		if len(t.Tenants) == 0 {
+			errs = append(errs, fmt.Errorf("token %d has no tenants", i))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{tokens: slices.Clone(tokens)}, nil
+}
+
+// LoadAuthenticator reads the tokens from a YAML or JSON file, e.g.
+//
+//	tokens:
+//	  - token: <secret>
+//	    tenants: [default, south]
+//
+// An empty path gives an Authenticator that denies all requests.
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	if path == "" {
+		return &Authenticator{}, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := struct {
+		Tokens []Token `yaml:"tokens"`
+	}{}
+
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tokens: %w", err)
+	}
+
+	return NewAuthenticator(cfg.Tokens)
+}
+
+// access is the tenants that an authenticated request may access
+type access struct {
+	all     bool
+	tenants []string
+}
+
+type accessKey struct{}
+
+func (a *Authenticator) authenticate(r *http.Request) (access, bool) {
+	if a == nil {
+		return access{}, false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return access{}, false
+	}
+
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return access{all: slices.Contains(t.Tenants, allTenants), tenants: t.Tenants}, true
+		}
+	}
+
+	return access{}, false
+}
+
+// authenticated only passes requests with a valid token to next, the tenants the token gives access to are added to the context
+func authenticated(auth *Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, ok := auth.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), accessKey{}, a)))
+	}
+}
+
+func accessFromContext(ctx context.Context) access {
+	a, _ := ctx.Value(accessKey{}).(access)
+	return a
+}
+
+// allows returns true if the tenant may be accessed. Messages without a tenant can only be accessed with access to all tenants.
+func (a access) allows(tenant string) bool {
+	return a.all || (tenant != "" && slices.Contains(a.tenants, tenant))
+}
+
+// filter returns the requested tenants that may be accessed, or all tenants that may be accessed if none are requested.
+// An empty result with access to all tenants means that the result should not be filtered by tenant, false is returned
+// if none of the requested tenants may be accessed.
+func (a access) filter(requested []string) ([]string, bool) {
+	if a.all {
+		return requested, true
+	}
+
+	if len(requested) == 0 {
+		return slices.Clone(a.tenants), len(a.tenants) > 0
+	}
+
+	tenants := []string{}
+	for _, t := range requested {
+		if a.allows(t) {
+			tenants = append(tenants, t)
+		}
+	}
+
+	return tenants, len(tenants) > 0
+}
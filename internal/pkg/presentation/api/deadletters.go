@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/diwise/cip-functions/internal/pkg/application"
+	"github.com/diwise/cip-functions/internal/pkg/infrastructure/storage"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+// DeadLetterReplayer passes a stored dead letter to its handler again
+type DeadLetterReplayer interface {
+	ReplayDeadLetter(ctx context.Context, id string) error
+}
+
+// deadLetterResponse shows the body of a dead letter as JSON if possible, or as a string if not
+type deadLetterResponse struct {
+	storage.DeadLetter
+	Body any `json:"body"`
+}
+
+func newDeadLetterResponse(dl storage.DeadLetter) deadLetterResponse {
+	var body any = string(dl.Body)
+	if json.Valid(dl.Body) {
+		body = json.RawMessage(dl.Body)
+	}
+
+	return deadLetterResponse{DeadLetter: dl, Body: body}
+}
+
+func queryDeadLettersHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-dead-letters")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		log := logging.GetFromContext(ctx)
+
+		var params storage.DeadLetterQuery
+		params, err = deadLetterQueryParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var deadLetters []storage.DeadLetter
+		var total int64
+
+		var ok bool
+		params.Tenants, ok = accessFromContext(ctx).filter(tenantsFromQuery(r))
+		if ok {
+			deadLetters, total, err = s.QueryDeadLetters(ctx, params)
+			if err != nil {
+				log.Error("failed to query dead letters", "err", err.Error())
+				http.Error(w, "failed to query dead letters", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		data := []any{}
+		for _, dl := range deadLetters {
+			data = append(data, newDeadLetterResponse(dl))
+		}
+
+		writeJSON(w, http.StatusOK, collectionResponse{
+			Meta: meta{
+				TotalRecords: total,
+				Offset:       params.Offset,
+				Limit:        params.Limit,
+				Count:        len(data),
+			},
+			Data: data,
+		})
+	}
+}
+
+func getDeadLetterHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-dead-letter")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		var dl storage.DeadLetter
+		dl, err = getDeadLetter(ctx, s, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Error("failed to read dead letter", "err", err.Error())
+			http.Error(w, "failed to read dead letter", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: newDeadLetterResponse(dl)})
+	}
+}
+
+func replayDeadLetterHandler(s storage.Storage, replayer DeadLetterReplayer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "replay-dead-letter")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		_, err = getDeadLetter(ctx, s, id)
+		if err == nil {
+			err = replayer.ReplayDeadLetter(ctx, id)
+		}
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, application.ErrReplayFailed) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			log.Error("failed to replay dead letter", "err", err.Error())
+			http.Error(w, "failed to replay dead letter", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func deleteDeadLetterHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "delete-dead-letter")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		id := r.PathValue("id")
+		log := logging.GetFromContext(ctx).With(slog.String("id", id))
+
+		_, err = getDeadLetter(ctx, s, id)
+		if err == nil {
+			err = s.DeleteDeadLetter(ctx, id)
+		}
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Error("failed to delete dead letter", "err", err.Error())
+			http.Error(w, "failed to delete dead letter", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// purgeDeadLettersHandler deletes the dead letters that were stored before the required parameter before, optionally
+// filtered by topic, handler type and tenant, so that all dead letters are not deleted by mistake
+func purgeDeadLettersHandler(s storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "purge-dead-letters")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+
+		log := logging.GetFromContext(ctx)
+
+		var params storage.DeadLetterQuery
+		params, err = deadLetterQueryParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if params.Before.IsZero() {
+			err = errors.New("query parameter before is required")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var deleted int64
+
+		var ok bool
+		params.Tenants, ok = accessFromContext(ctx).filter(tenantsFromQuery(r))
+		if ok {
+			deleted, err = s.PurgeDeadLetters(ctx, params)
+			if err != nil {
+				log.Error("failed to purge dead letters", "err", err.Error())
+				http.Error(w, "failed to purge dead letters", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, dataResponse{Data: map[string]int64{"deleted": deleted}})
+	}
+}
+
+// getDeadLetter returns storage.ErrNotFound if the dead letter does not exist, or if it belongs to a tenant that the
+// request may not access, so that the dead letters of other tenants can not be found
+func getDeadLetter(ctx context.Context, s storage.Storage, id string) (storage.DeadLetter, error) {
+	dl, err := s.GetDeadLetter(ctx, id)
+	if err != nil {
+		return storage.DeadLetter{}, err
+	}
+
+	if !accessFromContext(ctx).allows(dl.Tenant) {
+		return storage.DeadLetter{}, storage.ErrNotFound
+	}
+
+	return dl, nil
+}
+
+func deadLetterQueryParams(r *http.Request) (storage.DeadLetterQuery, error) {
+	p, err := queryParams(r)
+	if err != nil {
+		return storage.DeadLetterQuery{}, err
+	}
+
+	params := storage.DeadLetterQuery{
+		Topic:       r.URL.Query().Get("topic"),
+		HandlerType: r.URL.Query().Get("handlerType"),
+		Offset:      p.Offset,
+		Limit:       p.Limit,
+	}
+
+	params.Before, err = timeFromQuery(r, "before")
+	if err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const healthCheckTimeout time.Duration = 5 * time.Second
+
+const (
+	statusUp   string = "up"
+	statusDown string = "down"
+)
+
+// HealthCheck returns an error if the component Name is not healthy
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type componentHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components,omitempty"`
+}
+
+// livenessHandler reports that the service is running. It does not check any dependencies, since restarting
+// the service will not fix a database or message broker that is unavailable.
+func livenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthResponse{Status: statusUp})
+	}
+}
+
+// readinessHandler runs all checks in parallel and reports the status and latency of each component.
+// Responds with 503 Service Unavailable if any component is down.
+func readinessHandler(checks []HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		response := checkHealth(ctx, checks)
+
+		statusCode := http.StatusOK
+		if response.Status != statusUp {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, statusCode, response)
+	}
+}
+
+func checkHealth(ctx context.Context, checks []HealthCheck) healthResponse {
+	response := healthResponse{
+		Status:     statusUp,
+		Components: make(map[string]componentHealth, len(checks)),
+	}
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			err := c.Check(ctx)
+			latency := time.Since(start)
+
+			component := componentHealth{
+				Status:    statusUp,
+				LatencyMs: float64(latency.Microseconds()) / 1000,
+			}
+
+			if err != nil {
+				component.Status = statusDown
+				component.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			response.Components[c.Name] = component
+			if err != nil {
+				response.Status = statusDown
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return response
+}